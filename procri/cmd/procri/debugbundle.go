@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+
+	"github.com/elotl/procri/pkg/debugbundle"
+	"github.com/elotl/procri/pkg/redact"
+)
+
+const debugBundleUsage = `Usage:
+  procri debug-bundle [-o FILE] [--log-file FILE]... [--config-file FILE]...
+
+Debug-bundle writes a gzipped tarball, to attach to bug reports, with the
+pods, containers, stats and status of procri, the end of its log and of the
+logs of containers, the process list, and configuration files. manifest.json
+in the tarball describes the files, and what couldn't be collected.
+
+Annotations with sensitive keys, the arguments of processes other than
+procri, the environment variables of launchd plists and what looks like a
+secret in the logs of procri, e.g. password=..., are masked. Container logs
+and other configuration files are included as they are, and marked
+unredacted in manifest.json. Binary plists are left out.
+
+Flags:
+      --admin-socket string     admin socket of the procri server
+      --config-file strings     configuration files to include, e.g. policies
+      --data-store string       data store of the procri server
+      --log-file strings        logs of procri to include
+      --max-log-size int        bytes included from the end of each log
+  -o, --output string           file to write, - for stdout
+      --socket string           socket of the procri server
+`
+
+// The plist installing procri as a launch agent, see the README.
+var defaultConfigFiles = []string{
+	"/Library/LaunchDaemons/com.elotl.procri.plist",
+	"/Users/*/Library/LaunchAgents/com.elotl.procri.plist",
+}
+
+// debugBundleCommand runs "procri debug-bundle".
+func debugBundleCommand(args []string) error {
+	flags := pflag.NewFlagSet("debug-bundle", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, debugBundleUsage) }
+	output := flags.StringP("output", "o", "", "file to write, - for stdout")
+	socket := flags.String("socket", defaultSocket, "socket of the procri server")
+	adminSocket := flags.String("admin-socket", defaultAdminSocket, "admin socket of the procri server")
+	dataStore := flags.String("data-store", defaultDataStoreBasePath, "data store of the procri server")
+	logFiles := flags.StringSlice("log-file", []string{"/tmp/procri.log"}, "logs of procri to include")
+	configFiles := flags.StringSlice("config-file", defaultConfigFiles, "configuration files to include, e.g. policies")
+	maxLogSize := flags.Int64("max-log-size", 5<<20, "bytes included from the end of each log")
+	redactPatterns := flags.StringSlice("redact-patterns", redact.DefaultPatterns, "glob patterns for annotation keys whose values are masked")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+	if err := redact.SetPatterns(*redactPatterns); err != nil {
+		return err
+	}
+
+	name := "procri-debug-" + time.Now().UTC().Format("20060102T150405Z")
+	if *output == "" {
+		*output = name + ".tar.gz"
+	}
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	client, closeClient, err := connectRuntime(*socket, *dataStore)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	_, online := client.(grpcRuntimeClient)
+
+	b := debugbundle.New(w, name, BuildVersion)
+	collectors := []func() error{
+		func() error { return addRuntimeState(b, client, online, *adminSocket, *maxLogSize) },
+		func() error { return addLogs(b, *logFiles, *maxLogSize) },
+		func() error { return addProcesses(b) },
+		func() error { return addConfigFiles(b, *configFiles) },
+	}
+	for _, collect := range collectors {
+		if err := collect(); err != nil {
+			return err
+		}
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "wrote %s\n", *output)
+	}
+	return nil
+}
+
+func addRuntimeState(b *debugbundle.Bundle, client runtimeClient, online bool, adminSocket string, maxLogSize int64) error {
+	ctx := context.Background()
+	var err error
+	var status *cri.StatusResponse
+	if online {
+		status, err = client.Status(ctx, &cri.StatusRequest{Verbose: true})
+	} else {
+		err = fmt.Errorf("procri is not running, the state is read from its data store")
+	}
+	if err := b.AddJSON(debugbundle.Entry{Name: "status.json", Description: "runtime conditions"}, status, err); err != nil {
+		return err
+	}
+	drain, err := requestDrain(adminSocket, http.MethodGet, "")
+	if err := b.AddJSON(debugbundle.Entry{Name: "drain.json", Description: "drain mode", Source: adminSocket}, drain, err); err != nil {
+		return err
+	}
+
+	pods := []*cri.PodSandboxStatusResponse{}
+	podList, err := client.ListPodSandbox(ctx, &cri.ListPodSandboxRequest{Filter: &cri.PodSandboxFilter{}})
+	if err == nil {
+		for _, p := range podList.Items {
+			resp, err := client.PodSandboxStatus(ctx, &cri.PodSandboxStatusRequest{PodSandboxId: p.Id, Verbose: true})
+			if err != nil {
+				continue
+			}
+			resp.Status.Annotations = redact.Annotations(resp.Status.Annotations)
+			pods = append(pods, resp)
+		}
+	}
+	if err := b.AddJSON(debugbundle.Entry{Name: "pods.json", Description: "status of pods"}, pods, err); err != nil {
+		return err
+	}
+
+	containers := []*cri.ContainerStatusResponse{}
+	containerList, err := client.ListContainers(ctx, &cri.ListContainersRequest{Filter: &cri.ContainerFilter{}})
+	if err == nil {
+		for _, c := range containerList.Containers {
+			resp, err := client.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: c.Id, Verbose: true})
+			if err != nil {
+				continue
+			}
+			resp.Status.Annotations = redact.Annotations(resp.Status.Annotations)
+			containers = append(containers, resp)
+		}
+	}
+	if err := b.AddJSON(debugbundle.Entry{Name: "containers.json", Description: "status of containers"}, containers, err); err != nil {
+		return err
+	}
+
+	stats, err := client.ListContainerStats(ctx, &cri.ListContainerStatsRequest{Filter: &cri.ContainerStatsFilter{}})
+	if err := b.AddJSON(debugbundle.Entry{Name: "stats.json", Description: "resource usage of containers"}, stats, err); err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		status := c.Status
+		if status.LogPath == "" {
+			continue
+		}
+		name := fmt.Sprintf("logs/containers/%s_%d_%s.log", status.GetMetadata().GetName(), status.GetMetadata().GetAttempt(), status.Id)
+		entry := debugbundle.Entry{Name: name, Description: "log of container " + status.Id, Unredacted: true}
+		if err := b.AddFile(entry, status.LogPath, maxLogSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLogs adds the logs of procri. Requests are logged redacted, but errors
+// and other messages can still quote secrets, so they are masked too.
+func addLogs(b *debugbundle.Bundle, logFiles []string, maxLogSize int64) error {
+	redactLog := func(data []byte) ([]byte, error) {
+		return []byte(redact.Text(string(data))), nil
+	}
+	for _, path := range logFiles {
+		entry := debugbundle.Entry{Name: "logs/procri/" + filepath.Base(path), Description: "log of procri"}
+		if err := b.AddFilteredFile(entry, path, maxLogSize, redactLog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The columns of the process list before the command.
+const processColumns = "pid,ppid,pgid,user,stat,etime"
+
+// addProcesses adds the process list.
+func addProcesses(b *debugbundle.Bundle) error {
+	entry := debugbundle.Entry{Name: "processes.txt", Description: "process list", Source: "ps -axo " + processColumns + ",command"}
+	out, err := exec.Command("ps", "-axo", processColumns+",command").Output()
+	if err == nil {
+		out, err = redactProcesses(out)
+	}
+	return b.Add(entry, out, err)
+}
+
+// redactProcesses masks the arguments in the output of ps with the columns of
+// processColumns and the command. Arguments can carry secrets, so only those
+// of procri are kept.
+func redactProcesses(out []byte) ([]byte, error) {
+	n := strings.Count(processColumns, ",") + 1
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > n && filepath.Base(fields[n]) != "procri" {
+			fields = append(fields[:n], redact.Command(fields[n:])...)
+		}
+		fmt.Fprintln(&buf, strings.Join(fields, " "))
+	}
+	return buf.Bytes(), scanner.Err()
+}
+
+func addConfigFiles(b *debugbundle.Bundle, patterns []string) error {
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil || len(paths) == 0 {
+			// Default locations that don't exist are left out.
+			if err != nil || !isDefaultConfigFile(pattern) {
+				entry := debugbundle.Entry{Name: "config/" + filepath.Base(pattern), Description: "configuration file", Source: pattern}
+				if err == nil {
+					err = fmt.Errorf("no such file")
+				}
+				if err := b.Add(entry, nil, err); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for _, path := range paths {
+			entry := debugbundle.Entry{Name: "config/" + strings.TrimPrefix(path, "/"), Description: "configuration file"}
+			var err error
+			if filepath.Ext(path) == ".plist" {
+				err = b.AddFilteredFile(entry, path, 1<<20, redactPlist)
+			} else {
+				entry.Unredacted = true
+				err = b.AddFile(entry, path, 1<<20)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	plistEnvRegexp    = regexp.MustCompile(`(?s)<key>EnvironmentVariables</key>\s*<dict>.*?</dict>`)
+	plistStringRegexp = regexp.MustCompile(`(?s)<string>.*?</string>`)
+)
+
+// redactPlist masks the values of the environment variables of a launchd
+// plist, which can carry secrets. Only XML plists can be redacted.
+func redactPlist(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("<?xml")) {
+		return nil, fmt.Errorf("not an XML property list, it can't be redacted")
+	}
+	masked := []byte("<string>" + html.EscapeString(redact.Mask) + "</string>")
+	return plistEnvRegexp.ReplaceAllFunc(data, func(env []byte) []byte {
+		return plistStringRegexp.ReplaceAll(env, masked)
+	}), nil
+}
+
+func isDefaultConfigFile(pattern string) bool {
+	for _, p := range defaultConfigFiles {
+		if p == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+
+	"github.com/elotl/procri/pkg/runtimeservice"
+	"github.com/elotl/procri/pkg/server"
+)
+
+const defaultAdminSocket = "/var/run/procri-admin.sock"
+
+const drainUsage = `Usage:
+  procri drain [--admin-socket PATH] [--timeout DURATION]
+  procri drain --status [--admin-socket PATH]
+  procri undrain [--admin-socket PATH]
+
+Drain puts the procri server into drain mode for maintenance of the host: it
+refuses new pods, reports the runtime not ready, and stops all pods, killing
+containers still running after --timeout. It returns once all containers have
+exited. Drain mode lasts, even across restarts, until undrain.
+`
+
+// drainCommand runs "procri drain" and "procri undrain" against the admin
+// socket of a running procri server.
+func drainCommand(name string, args []string) error {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, drainUsage) }
+	socket := flags.String("admin-socket", defaultAdminSocket, "admin socket of the procri server")
+	timeout := flags.Duration("timeout", 2*time.Minute, "time containers get to exit before they are killed")
+	status := flags.Bool("status", false, "only print whether the server is draining")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	method := http.MethodDelete
+	query := ""
+	if name == "drain" {
+		method = http.MethodPost
+		query = "?" + url.Values{"timeout": {timeout.String()}}.Encode()
+		if *status {
+			method = http.MethodGet
+			query = ""
+		}
+	}
+	if method == http.MethodPost {
+		fmt.Fprintf(os.Stderr, "draining, waiting up to %v for containers to exit\n", *timeout)
+	}
+	drain, err := requestDrain(*socket, method, query)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("draining: %v, ready pods: %d, running containers: %d\n", drain.Draining, drain.Sandboxes, drain.Containers)
+	return nil
+}
+
+// requestDrain sends a request for the drain mode resource to the admin API
+// on socket.
+func requestDrain(socket, method, query string) (*runtimeservice.DrainStatus, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	req, err := http.NewRequest(method, "http://procri"+server.AdminDrainPath+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", body)
+	}
+	var drain runtimeservice.DrainStatus
+	if err := json.Unmarshal(body, &drain); err != nil {
+		return nil, err
+	}
+	return &drain, nil
+}
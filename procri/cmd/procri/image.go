@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+
+	"github.com/elotl/procri/pkg/server"
+)
+
+const imageUsage = `Usage:
+  procri image import [--data-store DIR] [--image-policy FILE] ARCHIVE
+  procri image export [--data-store DIR] [-o FILE] IMAGE...
+
+Import adds the images of an OCI image layout or docker save tarball, "-" for
+stdin, to the image store. With --image-policy, the policy of the server,
+images have to pass it for pods of any namespace, and images that have to be
+signed need their signatures in the archive. Export writes images as a
+tarball that is both an OCI image layout and a docker save archive, to stdout
+unless -o is given.
+`
+
+// imageCommand runs "procri image", to move images in and out of the store
+// of a procri server without a registry.
+func imageCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, imageUsage)
+		return fmt.Errorf("missing command")
+	}
+	flags := pflag.NewFlagSet("image "+args[0], pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, imageUsage) }
+	dataStore := flags.String("data-store", defaultDataStoreBasePath, "directory for persisting data of the procri server")
+	output := flags.StringP("output", "o", "-", "file to export to, - for stdout")
+	imagePolicyFile := flags.String("image-policy", "", "image verification policy imported images have to pass")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "import":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return fmt.Errorf("import takes one archive")
+		}
+		return importImages(*dataStore, *imagePolicyFile, flags.Arg(0))
+	case "export":
+		if flags.NArg() == 0 {
+			flags.Usage()
+			return fmt.Errorf("export takes at least one image")
+		}
+		return exportImages(*dataStore, *output, flags.Args())
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func importImages(dataStore, imagePolicyFile, archive string) error {
+	var r io.Reader = os.Stdin
+	if archive != "-" {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if imagePolicyFile == "" {
+		fmt.Fprintln(os.Stderr, "no --image-policy given, imported images are not verified")
+	}
+	is, err := server.OpenImageService(dataStore, imagePolicyFile)
+	if err != nil {
+		return err
+	}
+	imported, err := is.Import(context.Background(), r)
+	if err != nil {
+		return err
+	}
+	for _, img := range imported {
+		fmt.Printf("%s %s\n", img.ID, strings.Join(img.RepoTags, ","))
+	}
+	return nil
+}
+
+func exportImages(dataStore, output string, images []string) error {
+	is, err := server.OpenImageService(dataStore, "")
+	if err != nil {
+		return err
+	}
+	if output == "-" {
+		return is.Export(context.Background(), os.Stdout, images)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := is.Export(context.Background(), f, images); err != nil {
+		f.Close()
+		os.Remove(output)
+		return err
+	}
+	return f.Close()
+}
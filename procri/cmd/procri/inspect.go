@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+
+	"github.com/elotl/procri/pkg/server"
+)
+
+const defaultSocket = "/var/run/procri.sock"
+
+const inspectUsage = `Usage:
+  procri ps [-a] [--pod POD] [-o table|json]
+  procri pods [-o table|json]
+  procri inspect ID
+  procri logs [-f] ID
+  procri stats [-o table|json]
+
+Ps lists containers, only running ones unless -a is given, pods lists pods,
+inspect prints the status of a container or pod as JSON, logs prints the log
+of a container, following it with -f, and stats lists the resource usage of
+containers. IDs may be abbreviated to a unique prefix.
+
+The commands ask the procri server on --socket. If it doesn't run, they read
+its data store, --data-store, where containers have the state the server last
+recorded.
+
+Flags:
+  -a, --all                 list all containers
+      --data-store string   data store of the procri server
+  -f, --follow              follow the log until the container exits
+  -o, --output string       table or json
+      --pod string          list only containers of this pod
+      --socket string       socket of the procri server
+`
+
+var inspectCommands = map[string]bool{"ps": true, "pods": true, "inspect": true, "logs": true, "stats": true}
+
+// runtimeClient is the part of the CRI runtime API the inspection commands
+// use, served by a running procri server, or by the runtime service on its
+// data store.
+type runtimeClient interface {
+	ListPodSandbox(ctx context.Context, req *cri.ListPodSandboxRequest) (*cri.ListPodSandboxResponse, error)
+	PodSandboxStatus(ctx context.Context, req *cri.PodSandboxStatusRequest) (*cri.PodSandboxStatusResponse, error)
+	ListContainers(ctx context.Context, req *cri.ListContainersRequest) (*cri.ListContainersResponse, error)
+	ContainerStatus(ctx context.Context, req *cri.ContainerStatusRequest) (*cri.ContainerStatusResponse, error)
+	ListContainerStats(ctx context.Context, req *cri.ListContainerStatsRequest) (*cri.ListContainerStatsResponse, error)
+	Status(ctx context.Context, req *cri.StatusRequest) (*cri.StatusResponse, error)
+}
+
+type grpcRuntimeClient struct {
+	client cri.RuntimeServiceClient
+}
+
+func (c grpcRuntimeClient) ListPodSandbox(ctx context.Context, req *cri.ListPodSandboxRequest) (*cri.ListPodSandboxResponse, error) {
+	return c.client.ListPodSandbox(ctx, req)
+}
+
+func (c grpcRuntimeClient) PodSandboxStatus(ctx context.Context, req *cri.PodSandboxStatusRequest) (*cri.PodSandboxStatusResponse, error) {
+	return c.client.PodSandboxStatus(ctx, req)
+}
+
+func (c grpcRuntimeClient) ListContainers(ctx context.Context, req *cri.ListContainersRequest) (*cri.ListContainersResponse, error) {
+	return c.client.ListContainers(ctx, req)
+}
+
+func (c grpcRuntimeClient) ContainerStatus(ctx context.Context, req *cri.ContainerStatusRequest) (*cri.ContainerStatusResponse, error) {
+	return c.client.ContainerStatus(ctx, req)
+}
+
+func (c grpcRuntimeClient) ListContainerStats(ctx context.Context, req *cri.ListContainerStatsRequest) (*cri.ListContainerStatsResponse, error) {
+	return c.client.ListContainerStats(ctx, req)
+}
+
+func (c grpcRuntimeClient) Status(ctx context.Context, req *cri.StatusRequest) (*cri.StatusResponse, error) {
+	return c.client.Status(ctx, req)
+}
+
+// connectRuntime connects to the procri server on socket, or opens its data
+// store if it doesn't run.
+func connectRuntime(socket, dataStore string) (runtimeClient, func(), error) {
+	if _, err := os.Stat(socket); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, socket,
+			grpc.WithInsecure(),
+			grpc.WithBlock(),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+			}),
+		)
+		if err == nil {
+			return grpcRuntimeClient{cri.NewRuntimeServiceClient(conn)}, func() { conn.Close() }, nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "procri is not running on %s, reading %s\n", socket, dataStore)
+	rs, err := server.OpenRuntimeService(dataStore)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rs, func() {}, nil
+}
+
+// inspectCommand runs "procri ps", "pods", "inspect", "logs" and "stats".
+func inspectCommand(name string, args []string) error {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, inspectUsage) }
+	socket := flags.String("socket", defaultSocket, "socket of the procri server")
+	dataStore := flags.String("data-store", defaultDataStoreBasePath, "data store of the procri server")
+	output := flags.StringP("output", "o", "table", "table or json")
+	all := flags.BoolP("all", "a", false, "list all containers")
+	pod := flags.String("pod", "", "list only containers of this pod")
+	follow := flags.BoolP("follow", "f", false, "follow the log until the container exits")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "table" && *output != "json" {
+		flags.Usage()
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+	wantArgs := 0
+	if name == "inspect" || name == "logs" {
+		wantArgs = 1
+	}
+	if flags.NArg() != wantArgs {
+		flags.Usage()
+		return fmt.Errorf("%s takes %d arguments", name, wantArgs)
+	}
+
+	client, closeClient, err := connectRuntime(*socket, *dataStore)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	ctx := context.Background()
+	switch name {
+	case "ps":
+		return listContainers(ctx, client, *all, *pod, *output)
+	case "pods":
+		return listPods(ctx, client, *output)
+	case "inspect":
+		return inspect(ctx, client, flags.Arg(0))
+	case "logs":
+		return printLogs(ctx, client, flags.Arg(0), *follow, os.Stdout, os.Stderr)
+	case "stats":
+		return listStats(ctx, client, *output)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func printJSON(v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
+}
+
+func shortID(id string) string {
+	if len(id) > 13 {
+		return id[:13]
+	}
+	return id
+}
+
+func age(nanos int64) string {
+	if nanos == 0 {
+		return ""
+	}
+	d := time.Since(time.Unix(0, nanos))
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
+
+func stateName(state fmt.Stringer, prefix string) string {
+	return strings.TrimPrefix(state.String(), prefix)
+}
+
+func listContainers(ctx context.Context, client runtimeClient, all bool, pod, output string) error {
+	filter := &cri.ContainerFilter{}
+	if !all {
+		filter.State = &cri.ContainerStateValue{State: cri.ContainerState_CONTAINER_RUNNING}
+	}
+	if pod != "" {
+		id, err := resolvePodID(ctx, client, pod)
+		if err != nil {
+			return err
+		}
+		filter.PodSandboxId = id
+	}
+	resp, err := client.ListContainers(ctx, &cri.ListContainersRequest{Filter: filter})
+	if err != nil {
+		return err
+	}
+	containers := append([]*cri.Container{}, resp.Containers...)
+	sort.Slice(containers, func(i, j int) bool { return containers[i].CreatedAt > containers[j].CreatedAt })
+	if output == "json" {
+		return printJSON(containers)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tIMAGE\tCREATED\tSTATE\tNAME\tATTEMPT\tPOD ID")
+	for _, c := range containers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			shortID(c.Id), c.GetImage().GetImage(), age(c.CreatedAt), stateName(c.State, "CONTAINER_"),
+			c.GetMetadata().GetName(), c.GetMetadata().GetAttempt(), c.PodSandboxId)
+	}
+	return w.Flush()
+}
+
+func listPods(ctx context.Context, client runtimeClient, output string) error {
+	resp, err := client.ListPodSandbox(ctx, &cri.ListPodSandboxRequest{Filter: &cri.PodSandboxFilter{}})
+	if err != nil {
+		return err
+	}
+	pods := append([]*cri.PodSandbox{}, resp.Items...)
+	sort.Slice(pods, func(i, j int) bool { return pods[i].CreatedAt > pods[j].CreatedAt })
+	if output == "json" {
+		return printJSON(pods)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "POD ID\tCREATED\tSTATE\tNAME\tNAMESPACE\tATTEMPT")
+	for _, p := range pods {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n",
+			p.Id, age(p.CreatedAt), stateName(p.State, "SANDBOX_"),
+			p.GetMetadata().GetName(), p.GetMetadata().GetNamespace(), p.GetMetadata().GetAttempt())
+	}
+	return w.Flush()
+}
+
+func listStats(ctx context.Context, client runtimeClient, output string) error {
+	resp, err := client.ListContainerStats(ctx, &cri.ListContainerStatsRequest{Filter: &cri.ContainerStatsFilter{}})
+	if err != nil {
+		return err
+	}
+	stats := append([]*cri.ContainerStats{}, resp.Stats...)
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].GetAttributes().GetId() < stats[j].GetAttributes().GetId()
+	})
+	if output == "json" {
+		return printJSON(stats)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tNAME\tCPU TIME\tMEMORY\tDISK\tINODES")
+	for _, s := range stats {
+		cpu := time.Duration(s.GetCpu().GetUsageCoreNanoSeconds().GetValue())
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n",
+			shortID(s.GetAttributes().GetId()), s.GetAttributes().GetMetadata().GetName(),
+			cpu.Round(time.Millisecond), formatBytes(s.GetMemory().GetWorkingSetBytes().GetValue()),
+			formatBytes(s.GetWritableLayer().GetUsedBytes().GetValue()), s.GetWritableLayer().GetInodesUsed().GetValue())
+	}
+	return w.Flush()
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// resolveID returns the only ID in ids starting with prefix.
+func resolveID(prefix string, ids []string) (string, error) {
+	var matches []string
+	for _, id := range ids {
+		if id == prefix {
+			return id, nil
+		}
+		if strings.HasPrefix(id, prefix) {
+			matches = append(matches, id)
+		}
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("%s is ambiguous, it matches %s", prefix, strings.Join(matches, ", "))
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	return matches[0], nil
+}
+
+func resolveContainerID(ctx context.Context, client runtimeClient, prefix string) (string, error) {
+	resp, err := client.ListContainers(ctx, &cri.ListContainersRequest{Filter: &cri.ContainerFilter{}})
+	if err != nil {
+		return "", err
+	}
+	ids := make([]string, 0, len(resp.Containers))
+	for _, c := range resp.Containers {
+		ids = append(ids, c.Id)
+	}
+	return resolveID(prefix, ids)
+}
+
+func resolvePodID(ctx context.Context, client runtimeClient, prefix string) (string, error) {
+	resp, err := client.ListPodSandbox(ctx, &cri.ListPodSandboxRequest{Filter: &cri.PodSandboxFilter{}})
+	if err != nil {
+		return "", err
+	}
+	ids := make([]string, 0, len(resp.Items))
+	for _, p := range resp.Items {
+		ids = append(ids, p.Id)
+	}
+	id, err := resolveID(prefix, ids)
+	if err == nil && id == "" {
+		err = fmt.Errorf("no pod %s", prefix)
+	}
+	return id, err
+}
+
+func inspect(ctx context.Context, client runtimeClient, prefix string) error {
+	id, err := resolveContainerID(ctx, client, prefix)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		resp, err := client.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: id, Verbose: true})
+		if err != nil {
+			return err
+		}
+		return printJSON(resp)
+	}
+	id, err = resolvePodID(ctx, client, prefix)
+	if err != nil {
+		return fmt.Errorf("no container or pod %s", prefix)
+	}
+	resp, err := client.PodSandboxStatus(ctx, &cri.PodSandboxStatusRequest{PodSandboxId: id, Verbose: true})
+	if err != nil {
+		return err
+	}
+	return printJSON(resp)
+}
+
+// printLogs writes the log of the container with ID prefix to stdout and
+// stderr, following it while the container runs if follow is set.
+func printLogs(ctx context.Context, client runtimeClient, prefix string, follow bool, stdout, stderr io.Writer) error {
+	id, err := resolveContainerID(ctx, client, prefix)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("no container %s", prefix)
+	}
+	status, err := client.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: id})
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(status.GetStatus().GetLogPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := r.ReadString('\n')
+		if err == nil {
+			writeLogLine(stdout, stderr, partial+line)
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		// A line being written is completed by the next read.
+		partial += line
+		if !follow {
+			break
+		}
+		status, err := client.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: id})
+		if err != nil || status.GetStatus().GetState() != cri.ContainerState_CONTAINER_RUNNING {
+			// Read what was written until the container exited.
+			follow = false
+			continue
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if partial != "" {
+		writeLogLine(stdout, stderr, partial)
+	}
+	return nil
+}
+
+// writeLogLine writes the message of a line of a container log, in the CRI
+// format "<time> <stream> <tag> <message>", to stdout or stderr like the
+// container did. The newline ending partial messages, tag P, is not part of
+// the message.
+func writeLogLine(stdout, stderr io.Writer, line string) {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) != 4 {
+		fmt.Fprint(stdout, line)
+		return
+	}
+	out, message := stdout, parts[3]
+	if parts[1] == "stderr" {
+		out = stderr
+	}
+	if parts[2] == "P" {
+		message = strings.TrimSuffix(message, "\n")
+	}
+	fmt.Fprint(out, message)
+}
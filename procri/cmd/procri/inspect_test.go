@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+
+	"github.com/elotl/procri/pkg/runtimeservice"
+	"github.com/elotl/procri/pkg/server"
+)
+
+func TestResolveID(t *testing.T) {
+	ids := []string{"abc", "abcd", "abef", "xyz"}
+	testCases := []struct {
+		prefix string
+		id     string
+		err    string
+	}{
+		{prefix: "abc", id: "abc"},
+		{prefix: "abcd", id: "abcd"},
+		{prefix: "abe", id: "abef"},
+		{prefix: "x", id: "xyz"},
+		{prefix: "ab", err: "ab is ambiguous, it matches abc, abcd, abef"},
+		{prefix: "q", id: ""},
+	}
+	for _, tc := range testCases {
+		id, err := resolveID(tc.prefix, ids)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.prefix)
+			continue
+		}
+		assert.NoError(t, err, tc.prefix)
+		assert.Equal(t, tc.id, id, tc.prefix)
+	}
+}
+
+func TestWriteLogLine(t *testing.T) {
+	testCases := []struct {
+		name   string
+		line   string
+		stdout string
+		stderr string
+	}{
+		{
+			name:   "stdout",
+			line:   "2021-01-01T00:00:00.000000000Z stdout F hello world\n",
+			stdout: "hello world\n",
+		},
+		{
+			name:   "stderr",
+			line:   "2021-01-01T00:00:00.000000000Z stderr F oops\n",
+			stderr: "oops\n",
+		},
+		{
+			name:   "partial message",
+			line:   "2021-01-01T00:00:00.000000000Z stdout P hel\n",
+			stdout: "hel",
+		},
+		{
+			name:   "line being written",
+			line:   "2021-01-01T00:00:00.000000000Z stderr F unfinished",
+			stderr: "unfinished",
+		},
+		{
+			name:   "not in CRI format",
+			line:   "plain\n",
+			stdout: "plain\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			writeLogLine(stdout, stderr, tc.line)
+			assert.Equal(t, tc.stdout, stdout.String())
+			assert.Equal(t, tc.stderr, stderr.String())
+		})
+	}
+}
+
+func TestInspectDataStore(t *testing.T) {
+	dataStore := t.TempDir()
+	logDir := t.TempDir()
+	rs, err := server.OpenRuntimeService(dataStore)
+	require.NoError(t, err)
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata:     &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+		LogDirectory: logDir,
+	}
+	pod, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	require.NoError(t, err)
+	created, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: pod.PodSandboxId,
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+			LogPath:  "app/0.log",
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	require.NoError(t, err)
+	cid := created.ContainerId
+	require.NoError(t, os.MkdirAll(filepath.Join(logDir, "app"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "app", "0.log"), []byte(
+		"2021-01-01T00:00:00.000000000Z stdout F hello\n"+
+			"2021-01-01T00:00:00.000000000Z stderr F oops\n"+
+			"2021-01-01T00:00:01.000000000Z stdout P part\n"+
+			"2021-01-01T00:00:01.000000000Z stdout F ial\n"+
+			"2021-01-01T00:00:02.000000000Z stdout F unfinished"), 0644))
+
+	// Without a server on the socket, the data store is read.
+	client, closeClient, err := connectRuntime(filepath.Join(t.TempDir(), "procri.sock"), dataStore)
+	require.NoError(t, err)
+	defer closeClient()
+	assert.IsType(t, &runtimeservice.RuntimeService{}, client)
+
+	id, err := resolveContainerID(ctx, client, cid[:len(cid)-1])
+	assert.NoError(t, err)
+	assert.Equal(t, cid, id)
+	id, err = resolvePodID(ctx, client, "default_")
+	assert.NoError(t, err)
+	assert.Equal(t, pod.PodSandboxId, id)
+	_, err = resolvePodID(ctx, client, "kube-system_")
+	assert.EqualError(t, err, "no pod kube-system_")
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, printLogs(ctx, client, cid, false, stdout, stderr))
+	assert.Equal(t, "hello\npartial\nunfinished", stdout.String())
+	assert.Equal(t, "oops\n", stderr.String())
+
+	err = printLogs(ctx, client, "missing", false, stdout, stderr)
+	assert.EqualError(t, err, "no container missing")
+}
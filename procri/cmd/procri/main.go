@@ -7,13 +7,17 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"time"
 
 	k8sstreaming "k8s.io/kubernetes/pkg/kubelet/server/streaming"
 
 	"github.com/spf13/pflag"
 
+	"github.com/elotl/procri/pkg/metrics"
+	"github.com/elotl/procri/pkg/redact"
 	"github.com/elotl/procri/pkg/server"
 	"github.com/elotl/procri/pkg/streaming"
+	"github.com/elotl/procri/pkg/tracing"
 
 	k8snet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/klog"
@@ -23,14 +27,66 @@ var (
 	BuildVersion = "N/A"
 )
 
+const defaultDataStoreBasePath = "/tmp/procri-data.noindex"
+
 var (
-	version           = pflag.Bool("version", false, "Print version and exit")
-	streamingPort     = pflag.Int("streaming-port", 8099, "Port used for streaming")
-	listen            = pflag.String("listen", "/var/run/procri.sock", "The sockets to listen on, e.g. /var/run/procri.sock")
-	dataStoreBasePath = flag.String("data-store", "/tmp/procri-data.noindex", "directory for persisting data")
+	version            = pflag.Bool("version", false, "Print version and exit")
+	streamingPort      = pflag.Int("streaming-port", 8099, "Port used for streaming")
+	listen             = pflag.String("listen", defaultSocket, "The sockets to listen on, e.g. /var/run/procri.sock")
+	adminListen        = pflag.String("admin-listen", defaultAdminSocket, "Unix socket to serve the admin API on, used by procri drain. Empty disables it")
+	otlpEndpoint       = pflag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to export request traces to, e.g. http://localhost:4318. Empty disables tracing")
+	redactPatterns     = pflag.StringSlice("redact-patterns", redact.DefaultPatterns, "Glob patterns, matched case-insensitively, for annotation keys whose values are masked in logs")
+	credentialKeyFile  = pflag.String("credential-key-file", "", "File with base64 encoded AES-256 keys, one per line, to keep registry credentials encrypted on disk. The first key encrypts. Empty keeps credentials in memory only during pulls")
+	pullImages         = pflag.Bool("pull-images", false, "Pull images from registries and run containers from their darwin payload. If false, pulls only record the image and containers run host binaries")
+	insecureRegistries = pflag.StringSlice("insecure-registries", nil, "Registries to access via plain HTTP, e.g. localhost:5000")
+	imagePolicyFile    = pflag.String("image-policy", "", "JSON file with the image verification policy, e.g. requiring signatures for some registries. If empty, all images are accepted")
+	mountPolicyFile    = pflag.String("mount-policy", "", "JSON file with the policy for the paths containers may mount volumes at, with per-namespace rules. If empty, mounts over /etc, /usr, /bin, /sbin and /Library are denied")
+	dnsListen          = pflag.String("dns-listen", "", "Address, e.g. 127.0.0.1:53, to serve a stub resolver on over UDP and TCP that forwards queries for the cluster domain to the cluster DNS servers of pods. Empty disables it")
+	dnsResolverDir     = pflag.String("dns-resolver-dir", "/etc/resolver", "Directory of the resolver configuration of the host, where procri points the cluster domain to the stub resolver of --dns-listen. Empty leaves it alone")
+	clusterDomain      = pflag.String("cluster-domain", "cluster.local", "Domain of the cluster, answered by the DNS stub resolver")
+	hostPortProxy      = pflag.Bool("host-port-proxy", false, "Forward TCP and UDP host ports of pods to their container ports, if they differ. Host ports are reserved either way")
+	maxConcurrentPulls = pflag.Int("max-concurrent-pulls", 3, "Maximum number of images pulled at a time, or 0 for no limit")
+	debugListen        = pflag.String("debug-listen", "127.0.0.1:8098", "Address of the debug HTTP server serving /metrics, and /debug/pprof if PPROF_DEBUG is set. Empty disables it")
+	dataStoreBasePath  = flag.String("data-store", defaultDataStoreBasePath, "directory for persisting data")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "image" {
+		if err := imageCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "procri image: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "drain" || os.Args[1] == "undrain") {
+		if err := drainCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "procri %s: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && inspectCommands[os.Args[1]] {
+		if err := inspectCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "procri %s: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "debug-bundle" {
+		if err := debugBundleCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "procri debug-bundle: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "udp-forward" {
+		if err := udpForwardCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "procri udp-forward: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	klogFlags := goflag.NewFlagSet(os.Args[0], goflag.ExitOnError)
 	klog.InitFlags(klogFlags)
 
@@ -45,6 +101,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := redact.SetPatterns(*redactPatterns); err != nil {
+		klog.Fatalf("%v", err)
+	}
+
 	ipAddress, err := k8snet.ChooseHostInterface()
 	if err != nil {
 		klog.Fatalf("getting bind address for streaming server: %v", err)
@@ -75,8 +135,33 @@ func main() {
 		klog.Fatalf("ensuring data store directory: %v", err)
 	}
 
+	var exporter *tracing.Exporter
+	if *otlpEndpoint != "" {
+		exporter, err = tracing.NewExporter(*otlpEndpoint, "procri")
+		if err != nil {
+			klog.Fatalf("creating trace exporter: %v", err)
+		}
+		defer exporter.Close()
+		klog.Infof("exporting traces to %s", *otlpEndpoint)
+	}
+
 	klog.Infof("starting GRPC server")
-	s, err := server.NewServer(streamingServer, ipAddress.String(), *dataStoreBasePath, BuildVersion)
+	s, err := server.NewServer(streamingServer, server.Options{
+		IPAddress:          ipAddress.String(),
+		DataStoreBasePath:  *dataStoreBasePath,
+		RuntimeVersion:     BuildVersion,
+		Exporter:           exporter,
+		CredentialKeyFile:  *credentialKeyFile,
+		PullImages:         *pullImages,
+		InsecureRegistries: *insecureRegistries,
+		MaxConcurrentPulls: *maxConcurrentPulls,
+		ImagePolicyFile:    *imagePolicyFile,
+		MountPolicyFile:    *mountPolicyFile,
+		DNSListen:          *dnsListen,
+		DNSResolverDir:     *dnsResolverDir,
+		ClusterDomain:      *clusterDomain,
+		HostPortProxy:      *hostPortProxy,
+	})
 	if err != nil {
 		klog.Fatalf("creating server: %v", err)
 	}
@@ -87,12 +172,26 @@ func main() {
 		}
 	}(s)
 
-	if os.Getenv("PPROF_DEBUG") != "" {
-		http.HandleFunc("/debug/pprof/", pprof.Index)
-		http.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		http.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		http.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		http.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if *debugListen != "" {
+		debugServer := &http.Server{
+			Addr:              *debugListen,
+			Handler:           debugHandler(os.Getenv("PPROF_DEBUG") != ""),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			klog.Infof("starting debug server on %s", *debugListen)
+			if err := debugServer.ListenAndServe(); err != nil {
+				klog.Errorf("debug server: %v", err)
+			}
+		}()
+	}
+
+	if *adminListen != "" {
+		go func() {
+			if err := s.ServeAdmin(*adminListen); err != nil {
+				klog.Errorf("admin server: %v", err)
+			}
+		}()
 	}
 
 	err = s.Serve(*listen)
@@ -100,3 +199,19 @@ func main() {
 		klog.Fatalf("starting server: %v", err)
 	}
 }
+
+// debugHandler serves /metrics, and /debug/pprof/ if pprof is set. The pprof
+// package also registers itself on http.DefaultServeMux, which is why the
+// debug server has a mux of its own.
+func debugHandler(pprofEnabled bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	if pprofEnabled {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugHandler(t *testing.T) {
+	testCases := []struct {
+		pprof bool
+		path  string
+		code  int
+	}{
+		{false, "/metrics", http.StatusOK},
+		{false, "/debug/pprof/", http.StatusNotFound},
+		{true, "/metrics", http.StatusOK},
+		{true, "/debug/pprof/", http.StatusOK},
+		{true, "/debug/pprof/cmdline", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		debugHandler(tc.pprof).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		assert.Equal(t, tc.code, rec.Code, "pprof %v %s", tc.pprof, tc.path)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/elotl/procri/pkg/streaming"
+)
+
+const udpForwardUsage = `Usage:
+  procri udp-forward [--listen ADDRESS] FORWARDED
+
+Udp-forward receives datagrams on the UDP address --listen and sends them via
+FORWARDED, the local TCP address of "kubectl port-forward" to a UDP port of a
+pod, to the pod. Each client gets its own port-forward connection.
+`
+
+// udpIdleTimeout ends the sessions of clients sending nothing for this long.
+const udpIdleTimeout = 60 * time.Second
+
+// udpForwardCommand runs "procri udp-forward", the client side of
+// port-forward of UDP ports, which frames datagrams on the TCP stream.
+func udpForwardCommand(args []string) error {
+	flags := pflag.NewFlagSet("udp-forward", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, udpForwardUsage) }
+	listen := flags.String("listen", "127.0.0.1:0", "UDP address to receive datagrams on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("udp-forward takes one forwarded address")
+	}
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(os.Stderr, "Forwarding from %s -> %s\n", conn.LocalAddr(), flags.Arg(0))
+	return forwardDatagrams(conn, flags.Arg(0))
+}
+
+// forwardDatagrams forwards the datagrams received on conn via port-forward
+// at forwarded, until conn is closed.
+func forwardDatagrams(conn net.PacketConn, forwarded string) error {
+	var mu sync.Mutex
+	sessions := make(map[string]net.Conn)
+	buf := make([]byte, streaming.MaxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		key := addr.String()
+		mu.Lock()
+		stream, ok := sessions[key]
+		mu.Unlock()
+		if !ok {
+			stream, err = net.Dial("tcp", forwarded)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "connecting to %s: %v\n", forwarded, err)
+				continue
+			}
+			mu.Lock()
+			sessions[key] = stream
+			mu.Unlock()
+			go func() {
+				defer func() {
+					mu.Lock()
+					delete(sessions, key)
+					mu.Unlock()
+					stream.Close()
+				}()
+				for {
+					_ = stream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+					datagram, err := streaming.ReadDatagram(stream)
+					if err != nil {
+						return
+					}
+					if _, err := conn.WriteTo(datagram, addr); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		_ = stream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		if err := streaming.WriteDatagram(stream, buf[:n]); err != nil {
+			fmt.Fprintf(os.Stderr, "forwarding datagram of %s: %v\n", key, err)
+		}
+	}
+}
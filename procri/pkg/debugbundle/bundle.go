@@ -0,0 +1,164 @@
+// Package debugbundle writes gzipped tarballs of diagnostic files, with a
+// manifest describing them, to attach to bug reports.
+package debugbundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ManifestName is the name of the manifest in the tarball.
+const ManifestName = "manifest.json"
+
+// Entry describes a file of the bundle, or one that couldn't be collected.
+type Entry struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Source is the file or command the entry was collected from.
+	Source string `json:"source,omitempty"`
+	Size   int64  `json:"size"`
+	// Truncated is set if only the end of the source is included.
+	Truncated bool `json:"truncated,omitempty"`
+	// Unredacted is set if the file is included as it is, with any secrets
+	// it has.
+	Unredacted bool `json:"unredacted,omitempty"`
+	// Error is set if the entry couldn't be collected, and is not in the
+	// tarball.
+	Error string `json:"error,omitempty"`
+}
+
+// Manifest is the content of the manifest of a bundle.
+type Manifest struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Version   string    `json:"version"`
+	Entries   []Entry   `json:"entries"`
+}
+
+// Bundle writes files to a gzipped tarball. Its manifest is written last, by
+// Close.
+type Bundle struct {
+	dir      string
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest Manifest
+}
+
+// New returns a bundle writing to w, with its files in the directory dir of
+// the tarball. version is the version of the program writing it.
+func New(w io.Writer, dir, version string) *Bundle {
+	gz := gzip.NewWriter(w)
+	return &Bundle{
+		dir: dir,
+		gz:  gz,
+		tw:  tar.NewWriter(gz),
+		manifest: Manifest{
+			CreatedAt: time.Now().UTC(),
+			Version:   version,
+		},
+	}
+}
+
+func (b *Bundle) write(name string, data []byte) error {
+	err := b.tw.WriteHeader(&tar.Header{
+		Name:     b.dir + "/" + name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  b.manifest.CreatedAt,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = b.tw.Write(data)
+	return err
+}
+
+// Add adds a file with data. If err is not nil, the file couldn't be
+// collected and only its error is recorded.
+func (b *Bundle) Add(entry Entry, data []byte, err error) error {
+	if err != nil {
+		entry.Error = err.Error()
+		b.manifest.Entries = append(b.manifest.Entries, entry)
+		return nil
+	}
+	entry.Size = int64(len(data))
+	b.manifest.Entries = append(b.manifest.Entries, entry)
+	return b.write(entry.Name, data)
+}
+
+// AddJSON adds a file with v as JSON.
+func (b *Bundle) AddJSON(entry Entry, v interface{}, err error) error {
+	var data []byte
+	if err == nil {
+		data, err = json.MarshalIndent(v, "", "  ")
+	}
+	return b.Add(entry, data, err)
+}
+
+// AddFile adds the file at path, with at most maxBytes from its end if it is
+// larger.
+func (b *Bundle) AddFile(entry Entry, path string, maxBytes int64) error {
+	entry.Source = path
+	data, truncated, err := readTail(path, maxBytes)
+	entry.Truncated = truncated
+	return b.Add(entry, data, err)
+}
+
+// AddFilteredFile adds the file at path like AddFile, with its content passed
+// through filter, e.g. to redact secrets. The file is left out if filter
+// fails.
+func (b *Bundle) AddFilteredFile(entry Entry, path string, maxBytes int64, filter func([]byte) ([]byte, error)) error {
+	entry.Source = path
+	data, truncated, err := readTail(path, maxBytes)
+	entry.Truncated = truncated
+	if err == nil {
+		data, err = filter(data)
+	}
+	return b.Add(entry, data, err)
+}
+
+func readTail(path string, maxBytes int64) ([]byte, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, false, fmt.Errorf("%s is not a regular file", path)
+	}
+	truncated := false
+	if info.Size() > maxBytes {
+		if _, err := f.Seek(-maxBytes, io.SeekEnd); err != nil {
+			return nil, false, err
+		}
+		truncated = true
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxBytes))
+	return data, truncated, err
+}
+
+// Close writes the manifest and finishes the tarball. It doesn't close the
+// underlying writer.
+func (b *Bundle) Close() error {
+	data, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.write(ManifestName, data); err != nil {
+		return err
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
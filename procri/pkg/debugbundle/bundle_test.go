@@ -0,0 +1,69 @@
+package debugbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readBundle(t *testing.T, r io.Reader) map[string]string {
+	gz, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(data)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, ioutil.WriteFile(log, []byte("old line\nnew line\n"), 0644))
+
+	var buf bytes.Buffer
+	b := New(&buf, "bundle", "v1.2.3")
+	require.NoError(t, b.Add(Entry{Name: "ps.txt", Description: "processes", Source: "ps"}, []byte("PID\n"), nil))
+	require.NoError(t, b.AddJSON(Entry{Name: "pods.json", Description: "pods"}, []string{"web"}, nil))
+	require.NoError(t, b.AddFile(Entry{Name: "logs/app.log", Description: "log"}, log, 9))
+	require.NoError(t, b.AddFile(Entry{Name: "logs/missing.log", Description: "log"}, log+".missing", 9))
+	require.NoError(t, b.Add(Entry{Name: "status.json", Description: "status"}, nil, fmt.Errorf("not running")))
+	upper := func(data []byte) ([]byte, error) { return bytes.ToUpper(data), nil }
+	require.NoError(t, b.AddFilteredFile(Entry{Name: "logs/filtered.log", Description: "log"}, log, 100, upper))
+	fail := func(data []byte) ([]byte, error) { return nil, fmt.Errorf("can't filter") }
+	require.NoError(t, b.AddFilteredFile(Entry{Name: "logs/unfiltered.log", Description: "log"}, log, 100, fail))
+	require.NoError(t, b.Close())
+
+	files := readBundle(t, &buf)
+	assert.Equal(t, "PID\n", files["bundle/ps.txt"])
+	assert.JSONEq(t, `["web"]`, files["bundle/pods.json"])
+	assert.Equal(t, "new line\n", files["bundle/logs/app.log"])
+	assert.NotContains(t, files, "bundle/logs/missing.log")
+	assert.NotContains(t, files, "bundle/status.json")
+	assert.Equal(t, "OLD LINE\nNEW LINE\n", files["bundle/logs/filtered.log"])
+	assert.NotContains(t, files, "bundle/logs/unfiltered.log")
+
+	var manifest Manifest
+	require.NoError(t, json.Unmarshal([]byte(files["bundle/"+ManifestName]), &manifest))
+	assert.Equal(t, "v1.2.3", manifest.Version)
+	require.Len(t, manifest.Entries, 7)
+	assert.Equal(t, Entry{Name: "logs/app.log", Description: "log", Source: log, Size: 9, Truncated: true}, manifest.Entries[2])
+	assert.Contains(t, manifest.Entries[3].Error, "no such file")
+	assert.Equal(t, "not running", manifest.Entries[4].Error)
+	assert.Equal(t, "can't filter", manifest.Entries[6].Error)
+}
@@ -0,0 +1,344 @@
+// Package dns is a stub resolver forwarding queries for the cluster domain to
+// the DNS servers of the cluster, so processes of pods, which use the
+// resolver of the host, can resolve services.
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"k8s.io/klog"
+)
+
+const (
+	maxMessageSize = 65535
+	forwardTimeout = 2 * time.Second
+	// How long a TCP connection is kept open without a query.
+	tcpIdleTimeout = 10 * time.Second
+)
+
+// Stub answers queries for names in its domain by forwarding them to the
+// cluster DNS servers, and refuses all other queries. Queries are forwarded
+// with the protocol they came in, so clients retry truncated UDP answers over
+// TCP as usual.
+type Stub struct {
+	domain   string
+	conn     net.PacketConn
+	listener net.Listener
+	// resolverFile is the resolver configuration of the host pointing to
+	// the stub, if it installed one.
+	resolverFile string
+
+	mu      sync.Mutex
+	servers []string
+}
+
+// NewStub returns a stub resolver for domain, e.g. "cluster.local", answering
+// queries received on conn, and on connections accepted by listener if it
+// isn't nil, once it serves.
+func NewStub(domain string, conn net.PacketConn, listener net.Listener) *Stub {
+	return &Stub{domain: strings.Trim(strings.ToLower(domain), "."), conn: conn, listener: listener}
+}
+
+// Domain returns the cluster domain, without a trailing dot.
+func (s *Stub) Domain() string {
+	return s.domain
+}
+
+// SetServers sets the cluster DNS servers, IP addresses with an optional
+// port, queries are forwarded to.
+func (s *Stub) SetServers(servers []string) {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs = append(addrs, server)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.Join(addrs, ",") != strings.Join(s.servers, ",") {
+		klog.V(2).Infof("forwarding queries for %s to %v", s.domain, addrs)
+	}
+	s.servers = addrs
+}
+
+func (s *Stub) getServers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers
+}
+
+// Serve answers queries until the stub is closed. Queries received before are
+// answered too, so the stub is up as soon as it is created.
+func (s *Stub) Serve() error {
+	if s.listener != nil {
+		go func() {
+			if err := s.serveTCP(); err != nil {
+				klog.V(2).Infof("DNS stub resolver stopped serving TCP: %v", err)
+			}
+		}()
+	}
+	conn := s.conn
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			resp := s.handle("udp", buf[:n])
+			if resp == nil {
+				return
+			}
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				klog.V(4).Infof("answering DNS query of %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *Stub) serveTCP() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers the queries of a connection until the client closes it
+// or stays idle.
+func (s *Stub) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		if err := conn.SetDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+			return
+		}
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle("tcp", query)
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, resp); err != nil {
+			klog.V(4).Infof("answering DNS query of %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// readTCPMessage reads a message prefixed by its length, as sent over TCP.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// localAddr returns the UDP address local clients reach the stub at.
+func (s *Stub) localAddr() *net.UDPAddr {
+	addr := s.conn.LocalAddr().(*net.UDPAddr)
+	if addr.IP.IsUnspecified() {
+		addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: addr.Port}
+	}
+	return addr
+}
+
+// Check returns an error if the stub resolver doesn't answer queries over UDP.
+func (s *Stub) Check() error {
+	addr := s.localAddr()
+	// A name outside the domain is refused without asking the cluster.
+	id := uint16(time.Now().UnixNano())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	if err := b.StartQuestions(); err != nil {
+		return err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("procri-check.invalid."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	if _, err := forward("udp", addr.String(), query, id); err != nil {
+		return fmt.Errorf("DNS stub resolver is not answering: %v", err)
+	}
+	return nil
+}
+
+// resolverConfig returns the configuration sending queries of the resolver
+// of macOS to the stub, see resolver(5).
+func (s *Stub) resolverConfig() string {
+	addr := s.localAddr()
+	return fmt.Sprintf("nameserver %s\nport %d\n", addr.IP, addr.Port)
+}
+
+// InstallResolver points the resolver of the host to the stub for its domain,
+// by writing dir/<domain>, e.g. /etc/resolver/cluster.local. Other files of
+// dir, for other domains, are left alone. Close removes the file again.
+func (s *Stub) InstallResolver(dir string) error {
+	config := s.resolverConfig()
+	path := filepath.Join(dir, s.domain)
+	if existing, err := ioutil.ReadFile(path); err == nil && string(existing) != config {
+		klog.Infof("replacing resolver configuration %s: %q", path, existing)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		return err
+	}
+	s.resolverFile = path
+	return nil
+}
+
+// Close stops serving, and removes the resolver configuration it installed
+// unless it was changed since.
+func (s *Stub) Close() error {
+	if s.resolverFile != "" {
+		if existing, err := ioutil.ReadFile(s.resolverFile); err == nil && string(existing) == s.resolverConfig() {
+			if err := os.Remove(s.resolverFile); err != nil {
+				klog.Warningf("removing resolver configuration: %v", err)
+			}
+		}
+	}
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	return s.conn.Close()
+}
+
+// handle returns the response to query, received over network, or nil if it
+// is not a valid query.
+func (s *Stub) handle(network string, query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	if name != s.domain && !strings.HasSuffix(name, "."+s.domain) {
+		return errorResponse(header, question, dnsmessage.RCodeRefused)
+	}
+	servers := s.getServers()
+	for _, server := range servers {
+		resp, err := forward(network, server, query, header.ID)
+		if err == nil {
+			return resp
+		}
+		klog.V(4).Infof("forwarding DNS query for %s to %s: %v", name, server, err)
+	}
+	return errorResponse(header, question, dnsmessage.RCodeServerFailure)
+}
+
+// forward sends query to server over network, "udp" or "tcp", and returns
+// the answer. Truncated UDP answers are returned as they are, for the client
+// to retry over TCP.
+func forward(network, server string, query []byte, id uint16) ([]byte, error) {
+	conn, err := net.Dial(network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(forwardTimeout)); err != nil {
+		return nil, err
+	}
+	read := func() ([]byte, error) {
+		buf := make([]byte, maxMessageSize)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		read = func() ([]byte, error) { return readTCPMessage(conn) }
+	} else if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := read()
+		if err != nil {
+			return nil, err
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(resp)
+		if err != nil || !header.Response || header.ID != id {
+			// Not the answer to this query.
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func errorResponse(query dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               query.ID,
+		Response:         true,
+		OpCode:           query.OpCode,
+		RecursionDesired: query.RecursionDesired,
+		RCode:            rcode,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := b.Question(question); err != nil {
+		return nil
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		klog.Warningf("building DNS response: %v", err)
+		return nil
+	}
+	return resp
+}
+
+// ResolvConf returns the content of a resolv.conf file for servers, search
+// domains and options.
+func ResolvConf(servers, searches, options []string) string {
+	var b strings.Builder
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(searches) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(searches, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return b.String()
+}
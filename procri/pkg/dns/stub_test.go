@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveCluster runs a stand-in for the cluster DNS on UDP and TCP, answering
+// A queries with addrs, and returns its address. UDP answers with more than
+// one address are truncated.
+func serveCluster(t *testing.T, addrs map[string][][4]byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	answer := func(query []byte, truncate bool) []byte {
+		var p dnsmessage.Parser
+		header, err := p.Start(query)
+		if err != nil {
+			return nil
+		}
+		question, err := p.Question()
+		if err != nil {
+			return nil
+		}
+		ips := addrs[question.Name.String()]
+		if question.Type != dnsmessage.TypeA {
+			ips = nil
+		}
+		truncated := truncate && len(ips) > 1
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true, Truncated: truncated})
+		_ = b.StartQuestions()
+		_ = b.Question(question)
+		_ = b.StartAnswers()
+		for _, ip := range ips {
+			if !truncated {
+				_ = b.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 30}, dnsmessage.AResource{A: ip})
+			}
+		}
+		resp, _ := b.Finish()
+		return resp
+	}
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := answer(buf[:n], true); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				query, err := readTCPMessage(c)
+				if err != nil {
+					return
+				}
+				_ = writeTCPMessage(c, answer(query, false))
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func resolverFor(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestStub(t *testing.T) {
+	cluster := serveCluster(t, map[string][][4]byte{
+		"web.default.svc.cluster.local.":  {{10, 96, 0, 20}},
+		"pods.default.svc.cluster.local.": {{10, 0, 0, 1}, {10, 0, 0, 2}},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	require.NoError(t, err)
+	stub := NewStub("cluster.local.", conn, listener)
+	assert.Equal(t, "cluster.local", stub.Domain())
+	go func() { _ = stub.Serve() }()
+	defer stub.Close()
+	resolver := resolverFor(conn.LocalAddr().String())
+	ctx := context.Background()
+
+	// Without cluster DNS servers, queries fail.
+	_, err = resolver.LookupHost(ctx, "web.default.svc.cluster.local")
+	assert.Error(t, err)
+
+	stub.SetServers([]string{cluster})
+	addrs, err := resolver.LookupHost(ctx, "web.default.svc.cluster.local")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.96.0.20"}, addrs)
+
+	// Truncated answers are retried over TCP.
+	addrs, err = resolver.LookupHost(ctx, "pods.default.svc.cluster.local")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+
+	// Names outside the cluster domain are refused, not forwarded.
+	_, err = resolver.LookupHost(ctx, "example.com")
+	assert.Error(t, err)
+
+	// Unreachable servers are skipped.
+	stub.SetServers([]string{"127.0.0.1:1", cluster})
+	addrs, err = resolver.LookupHost(ctx, "web.default.svc.cluster.local")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.96.0.20"}, addrs)
+}
+
+func TestResolvConf(t *testing.T) {
+	assert.Equal(t, "nameserver 10.96.0.10\nsearch default.svc.cluster.local svc.cluster.local\noptions ndots:5\n",
+		ResolvConf([]string{"10.96.0.10"}, []string{"default.svc.cluster.local", "svc.cluster.local"}, []string{"ndots:5"}))
+	assert.Equal(t, "", ResolvConf(nil, nil, nil))
+}
+
+func TestStubCheck(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stub := NewStub("cluster.local", conn, nil)
+	// The stub is up as soon as it serves, without waiting for the goroutine.
+	go func() { _ = stub.Serve() }()
+	assert.NoError(t, stub.Check())
+
+	require.NoError(t, stub.Close())
+	assert.Error(t, stub.Check())
+}
+
+func TestInstallResolver(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "resolver")
+	conn, err := net.ListenPacket("udp", "0.0.0.0:0")
+	require.NoError(t, err)
+	stub := NewStub("cluster.local", conn, nil)
+	require.NoError(t, stub.InstallResolver(dir))
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "cluster.local"))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("nameserver 127.0.0.1\nport %d\n", port), string(buf))
+
+	require.NoError(t, stub.Close())
+	_, err = os.Stat(filepath.Join(dir, "cluster.local"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A configuration changed in the meantime is kept.
+	conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stub = NewStub("cluster.local", conn, nil)
+	require.NoError(t, stub.InstallResolver(dir))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cluster.local"), []byte("nameserver 10.0.0.10\n"), 0644))
+	require.NoError(t, stub.Close())
+	buf, err = ioutil.ReadFile(filepath.Join(dir, "cluster.local"))
+	require.NoError(t, err)
+	assert.Equal(t, "nameserver 10.0.0.10\n", string(buf))
+}
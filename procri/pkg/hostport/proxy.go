@@ -0,0 +1,186 @@
+// Package hostport forwards host ports of pods to the ports their processes
+// listen on, in userspace.
+package hostport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// UDP sessions without traffic for this long are closed.
+	udpIdleTimeout = 60 * time.Second
+	maxDatagram    = 65535
+)
+
+// Proxy forwards TCP connections or UDP datagrams from a host address to a
+// target address.
+type Proxy struct {
+	listener net.Listener
+	conn     net.PacketConn
+	target   string
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[string]net.Conn
+	closed   bool
+}
+
+// Listen starts forwarding protocol, "tcp" or "udp", from host to target.
+func Listen(protocol, host, target string) (*Proxy, error) {
+	p := &Proxy{target: target, sessions: make(map[string]net.Conn)}
+	switch protocol {
+	case "tcp":
+		listener, err := net.Listen("tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		p.listener = listener
+		p.wg.Add(1)
+		go p.serveTCP()
+	case "udp":
+		conn, err := net.ListenPacket("udp", host)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+		p.wg.Add(1)
+		go p.serveUDP()
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", protocol)
+	}
+	klog.V(3).Infof("forwarding %s %s to %s", protocol, host, target)
+	return p, nil
+}
+
+// Close stops forwarding, and closes forwarded connections.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	for _, conn := range p.sessions {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	} else {
+		err = p.conn.Close()
+	}
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) track(key string, conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.sessions[key] = conn
+	return true
+}
+
+func (p *Proxy) untrack(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, key)
+}
+
+func (p *Proxy) serveTCP() {
+	defer p.wg.Done()
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.wg.Add(1)
+		go p.forwardTCP(client)
+	}
+}
+
+func (p *Proxy) forwardTCP(client net.Conn) {
+	defer p.wg.Done()
+	defer client.Close()
+	key := client.RemoteAddr().String()
+	if !p.track(key, client) {
+		return
+	}
+	defer p.untrack(key)
+	backend, err := net.Dial("tcp", p.target)
+	if err != nil {
+		klog.V(4).Infof("forwarding connection from %s to %s: %v", key, p.target, err)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(backend, client)
+		if tcp, ok := backend.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	_, _ = io.Copy(client, backend)
+	if tcp, ok := client.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+	<-done
+}
+
+func (p *Proxy) serveUDP() {
+	defer p.wg.Done()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := addr.String()
+		p.mu.Lock()
+		backend, ok := p.sessions[key]
+		p.mu.Unlock()
+		if !ok {
+			backend, err = net.Dial("udp", p.target)
+			if err != nil {
+				klog.V(4).Infof("forwarding datagrams from %s to %s: %v", key, p.target, err)
+				continue
+			}
+			if !p.track(key, backend) {
+				backend.Close()
+				return
+			}
+			p.wg.Add(1)
+			go p.replyUDP(key, addr, backend)
+		}
+		_ = backend.SetDeadline(time.Now().Add(udpIdleTimeout))
+		if _, err := backend.Write(buf[:n]); err != nil {
+			klog.V(4).Infof("forwarding datagram from %s to %s: %v", key, p.target, err)
+		}
+	}
+}
+
+// replyUDP sends the replies of the target to the client at addr, until the
+// session is idle.
+func (p *Proxy) replyUDP(key string, addr net.Addr, backend net.Conn) {
+	defer p.wg.Done()
+	defer backend.Close()
+	defer p.untrack(key)
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		_ = backend.SetDeadline(time.Now().Add(udpIdleTimeout))
+		if _, err := p.conn.WriteTo(buf[:n], addr); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package hostport
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPProxy(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				_, _ = conn.Write([]byte("echo " + line))
+			}()
+		}
+	}()
+
+	p, err := Listen("tcp", "127.0.0.1:0", backend.Addr().String())
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\n", reply)
+
+	assert.NoError(t, p.Close())
+	_, err = net.Dial("tcp", p.listener.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestUDPProxy(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = backend.WriteTo(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+
+	p, err := Listen("udp", "127.0.0.1:0", backend.LocalAddr().String())
+	require.NoError(t, err)
+	defer p.Close()
+	conn, err := net.Dial("udp", p.conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 512)
+	for _, msg := range []string{"one", "two"} {
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "echo "+msg, string(buf[:n]))
+	}
+}
+
+func TestUnsupportedProtocol(t *testing.T) {
+	_, err := Listen("sctp", "127.0.0.1:0", "127.0.0.1:1")
+	assert.Error(t, err)
+}
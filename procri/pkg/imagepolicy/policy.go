@@ -0,0 +1,240 @@
+// Package imagepolicy decides which images procri pulls, based on where they
+// come from, the namespace of the pod pulling them, and their signatures.
+package imagepolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+// Requirements of a rule.
+const (
+	// Accept images without checking them.
+	Accept = "accept"
+	// Reject images.
+	Reject = "reject"
+	// Accept images signed with one of the public keys of the rule.
+	Signed = "signed"
+)
+
+// Source is where images and their signatures are read from, a registry
+// repository or an image archive. Manifests are looked up by tag or digest,
+// and missing ones are reported with registry.ErrNotFound.
+type Source interface {
+	Manifest(ctx context.Context, ref string) ([]byte, string, digest.Digest, error)
+	Blob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error)
+}
+
+// Policy is the image verification policy, read from a JSON file, e.g.
+//
+//	{
+//	  "default": "reject",
+//	  "rules": [
+//	    {
+//	      "scope": "registry.example.com/pipeline",
+//	      "require": "signed",
+//	      "publicKeys": ["/etc/procri/pipeline.pub"]
+//	    },
+//	    {
+//	      "scope": "docker.io/library",
+//	      "namespaces": ["kube-system"],
+//	      "require": "accept"
+//	    }
+//	  ]
+//	}
+type Policy struct {
+	// Requirement for images no rule applies to, "accept" or "reject".
+	// Defaults to "accept".
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule sets the requirement for images in a scope. If several rules apply
+// to an image, the one with the longest scope wins, and among those a rule
+// listing the namespace of the pod wins over one for all namespaces.
+type Rule struct {
+	// Registry, e.g. "registry.example.com:5000", or repository prefix, e.g.
+	// "docker.io/library". Matches whole path components of normalized
+	// repository names.
+	Scope string `json:"scope"`
+	// Kubernetes namespaces of the pods the rule applies to. All namespaces
+	// if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// "accept", "reject" or "signed".
+	Require string `json:"require"`
+	// PEM files with ECDSA public keys, for "signed".
+	PublicKeys []string `json:"publicKeys,omitempty"`
+
+	keys []*ecdsa.PublicKey
+}
+
+// Load reads a policy and the public keys it refers to.
+func Load(path string) (*Policy, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading image policy: %v", err)
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("parsing image policy %s: %v", path, err)
+	}
+	switch p.Default {
+	case "":
+		p.Default = Accept
+	case Accept, Reject:
+	default:
+		return nil, fmt.Errorf("image policy %s: invalid default %q", path, p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		rule.Scope = strings.TrimSuffix(rule.Scope, "/")
+		if rule.Scope == "" {
+			return nil, fmt.Errorf("image policy %s: rule %d has no scope", path, i)
+		}
+		switch rule.Require {
+		case Accept, Reject:
+		case Signed:
+			if len(rule.PublicKeys) == 0 {
+				return nil, fmt.Errorf("image policy %s: rule for %s requires signatures but has no public keys", path, rule.Scope)
+			}
+			for _, keyFile := range rule.PublicKeys {
+				key, err := loadPublicKey(keyFile)
+				if err != nil {
+					return nil, fmt.Errorf("image policy %s: %v", path, err)
+				}
+				rule.keys = append(rule.keys, key)
+			}
+		default:
+			return nil, fmt.Errorf("image policy %s: rule for %s has invalid requirement %q", path, rule.Scope, rule.Require)
+		}
+	}
+	return p, nil
+}
+
+func loadPublicKey(path string) (*ecdsa.PublicKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key: %v", err)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("public key %s is not PEM encoded", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key %s: %v", path, err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is a %T, only ECDSA keys are supported", path, pub)
+	}
+	return key, nil
+}
+
+// DependsOnNamespace returns whether the decision for an image can depend on
+// the namespace of the pod pulling it.
+func (p *Policy) DependsOnNamespace() bool {
+	for _, rule := range p.Rules {
+		if len(rule.Namespaces) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the rule for repository name pulled by a pod in namespace,
+// or nil if there is none.
+func (p *Policy) rule(name, namespace string) *Rule {
+	var best *Rule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if name != rule.Scope && !strings.HasPrefix(name, rule.Scope+"/") {
+			continue
+		}
+		if len(rule.Namespaces) > 0 && !contains(rule.Namespaces, namespace) {
+			continue
+		}
+		if best == nil || len(rule.Scope) > len(best.Scope) ||
+			len(rule.Scope) == len(best.Scope) && len(rule.Namespaces) > 0 && len(best.Namespaces) == 0 {
+			best = rule
+		}
+	}
+	return best
+}
+
+// Verify checks the image with manifest or index digest dgst in src, whose
+// normalized name is name, pulled by a pod in namespace.
+func (p *Policy) Verify(ctx context.Context, src Source, name, namespace string, dgst digest.Digest) error {
+	require := p.Default
+	rule := p.rule(name, namespace)
+	if rule != nil {
+		require = rule.Require
+	}
+	switch require {
+	case Accept:
+		return nil
+	case Signed:
+		if err := verifySignatures(ctx, src, dgst, rule.keys); err != nil {
+			return fmt.Errorf("image %s@%s rejected by policy for %s: %v", name, dgst, rule.Scope, err)
+		}
+		return nil
+	}
+	if name == "" {
+		name = dgst.String()
+	}
+	if rule != nil {
+		return fmt.Errorf("image %s rejected by policy for %s", name, rule.Scope)
+	}
+	return fmt.Errorf("image %s rejected by policy: no rule allows it", name)
+}
+
+// VerifyAll checks an image pods of any namespace may run without pulling
+// it, e.g. an imported one, with the normalized repository names names. It
+// has to pass the rules for all of them in all namespaces. An image without
+// names can be used by its ID, so it has to pass every rule and the default.
+func (p *Policy) VerifyAll(ctx context.Context, src Source, names []string, dgst digest.Digest) error {
+	if len(names) == 0 {
+		names = []string{""}
+		for _, rule := range p.Rules {
+			names = append(names, rule.Scope)
+		}
+	}
+	namespaces := []string{""}
+	for _, rule := range p.Rules {
+		namespaces = append(namespaces, rule.Namespaces...)
+	}
+	checked := make(map[*Rule]bool)
+	for _, name := range names {
+		for _, namespace := range namespaces {
+			rule := p.rule(name, namespace)
+			if rule != nil && checked[rule] {
+				continue
+			}
+			if err := p.Verify(ctx, src, name, namespace, dgst); err != nil {
+				return err
+			}
+			if rule != nil {
+				checked[rule] = true
+			}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package imagepolicy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicy(t *testing.T, policy string) string {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(policy), 0644))
+	return path
+}
+
+func TestRuleSelection(t *testing.T) {
+	p, err := Load(writePolicy(t, `{
+		"default": "reject",
+		"rules": [
+			{"scope": "registry.example.com", "require": "accept"},
+			{"scope": "registry.example.com/team/", "require": "reject"},
+			{"scope": "registry.example.com/team", "namespaces": ["dev"], "require": "accept"},
+			{"scope": "docker.io/library/nginx", "require": "accept"}
+		]
+	}`))
+	require.NoError(t, err)
+	assert.True(t, p.DependsOnNamespace())
+
+	testCases := []struct {
+		name      string
+		namespace string
+		expected  string
+	}{
+		{name: "registry.example.com/app", expected: Accept},
+		{name: "registry.example.com/team/app", expected: Reject},
+		{name: "registry.example.com/team/app", namespace: "dev", expected: Accept},
+		{name: "registry.example.com/teamwork/app", expected: Accept},
+		{name: "registry.example.com:5000/app", expected: ""},
+		{name: "docker.io/library/nginx", expected: Accept},
+		{name: "docker.io/library/nginx-unprivileged", expected: ""},
+	}
+	for _, tc := range testCases {
+		require := ""
+		if rule := p.rule(tc.name, tc.namespace); rule != nil {
+			require = rule.Require
+		}
+		assert.Equal(t, tc.expected, require, "%s in namespace %q", tc.name, tc.namespace)
+	}
+}
+
+func TestLoadInvalidPolicy(t *testing.T) {
+	for _, policy := range []string{
+		`{"default": "signed"}`,
+		`{"rules": [{"require": "accept"}]}`,
+		`{"rules": [{"scope": "quay.io", "require": "maybe"}]}`,
+		`{"rules": [{"scope": "quay.io", "require": "signed"}]}`,
+		`{"rules": [{"scope": "quay.io", "require": "signed", "publicKeys": ["/nonexistent.pub"]}]}`,
+	} {
+		_, err := Load(writePolicy(t, policy))
+		assert.Error(t, err, policy)
+	}
+}
@@ -0,0 +1,129 @@
+package imagepolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/elotl/procri/pkg/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"k8s.io/klog"
+)
+
+const (
+	// Annotation of signature layers with the base64 encoded signature of
+	// the layer, as pushed by cosign.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// Type of signed payloads, in the "simple signing" format.
+	SignaturePayloadType = "cosign container image signature"
+
+	// Payloads are small, anything bigger than this is not a signature.
+	maxPayloadSize = 1 << 20
+)
+
+// Payload is the signed document, identifying the image by its digest.
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// SignatureTag returns the tag signatures of the image with digest dgst are
+// stored under, e.g. "sha256-<hex>.sig".
+func SignatureTag(dgst digest.Digest) string {
+	return strings.Replace(dgst.String(), ":", "-", 1) + ".sig"
+}
+
+// verifySignatures checks that the image with digest dgst has a signature
+// made with one of keys.
+func verifySignatures(ctx context.Context, src Source, dgst digest.Digest, keys []*ecdsa.PublicKey) error {
+	buf, _, _, err := src.Manifest(ctx, SignatureTag(dgst))
+	if errors.Is(err, registry.ErrNotFound) {
+		return fmt.Errorf("image is not signed")
+	}
+	if err != nil {
+		return fmt.Errorf("fetching signatures: %v", err)
+	}
+	manifest := specs.Manifest{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return fmt.Errorf("parsing signature manifest: %v", err)
+	}
+	for _, layer := range manifest.Layers {
+		sig, ok := layer.Annotations[SignatureAnnotation]
+		if !ok {
+			continue
+		}
+		err := verifySignature(ctx, src, dgst, layer, sig, keys)
+		if err == nil {
+			return nil
+		}
+		klog.V(4).Infof("signature %s of %s: %v", layer.Digest, dgst, err)
+	}
+	return fmt.Errorf("no valid signature from a trusted key")
+}
+
+func verifySignature(ctx context.Context, src Source, dgst digest.Digest, layer specs.Descriptor, sig string, keys []*ecdsa.PublicKey) error {
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %v", err)
+	}
+	if err := layer.Digest.Validate(); err != nil {
+		return err
+	}
+	if layer.Size > maxPayloadSize {
+		return fmt.Errorf("payload is larger than %d bytes", maxPayloadSize)
+	}
+	body, err := src.Blob(ctx, layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	payload, err := ioutil.ReadAll(io.LimitReader(body, maxPayloadSize))
+	if err != nil {
+		return fmt.Errorf("reading payload: %v", err)
+	}
+	verifier := layer.Digest.Verifier()
+	_, _ = verifier.Write(payload)
+	if !verifier.Verified() {
+		return fmt.Errorf("payload digest mismatch")
+	}
+
+	hash := sha256.Sum256(payload)
+	signed := false
+	for _, key := range keys {
+		if ecdsa.VerifyASN1(key, hash[:], rawSig) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("signature does not match any trusted key")
+	}
+	// Only trust the payload once it is known to be signed.
+	p := Payload{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("parsing payload: %v", err)
+	}
+	if p.Critical.Type != SignaturePayloadType {
+		return fmt.Errorf("unexpected payload type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != dgst.String() {
+		return fmt.Errorf("signature is for %s", p.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
@@ -0,0 +1,562 @@
+package imageservice
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/elotl/procri/pkg/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"k8s.io/klog"
+)
+
+const (
+	// Annotation with the full name of an image in an OCI image layout, as
+	// written by containerd and docker.
+	annotationImageName = "io.containerd.image.name"
+
+	mediaTypeDockerLayerTar = "application/vnd.docker.image.rootfs.diff.tar"
+
+	layoutIndexFile    = "index.json"
+	dockerManifestFile = "manifest.json"
+
+	// Symlinks in archives are followed this many times at most.
+	maxArchiveLinks = 16
+)
+
+// ImportedImage is an image imported from an archive.
+type ImportedImage struct {
+	ID       string
+	RepoTags []string
+}
+
+// dockerManifest is an entry of the manifest.json of docker save archives.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// archive is an image archive, an OCI image layout or the output of docker
+// save, extracted to a temporary directory. Entries are kept in files named
+// by their index, so that names in the archive never become paths.
+type archive struct {
+	// Regular files, by normalized name in the archive.
+	files map[string]string
+	// Symbolic and hard links, by normalized name, to the normalized name
+	// of their target.
+	links map[string]string
+	// Manifests made up for docker save archives, by digest.
+	manifests map[digest.Digest][]byte
+	// Files of blobs outside of blobs/<algorithm>/<hex>, by digest.
+	blobs map[digest.Digest]string
+	// Media types of manifests, from their descriptors.
+	mediaTypes map[digest.Digest]string
+	// Manifests of an OCI image layout by tag, e.g. signatures under
+	// sha256-<hex>.sig.
+	tags map[string]digest.Digest
+}
+
+// archiveImage is an image in an archive.
+type archiveImage struct {
+	desc specs.Descriptor
+	// Normalized references.
+	refs []string
+}
+
+func cleanArchivePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func readArchive(r io.Reader, dir string) (*archive, error) {
+	a := &archive{
+		files:      make(map[string]string),
+		links:      make(map[string]string),
+		manifests:  make(map[digest.Digest][]byte),
+		blobs:      make(map[digest.Digest]string),
+		mediaTypes: make(map[digest.Digest]string),
+		tags:       make(map[string]digest.Digest),
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading archive: %v", err)
+		}
+		name := cleanArchivePath(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			file := filepath.Join(dir, strconv.Itoa(len(a.files)))
+			if err := writeArchiveFile(file, tr); err != nil {
+				return nil, fmt.Errorf("extracting %s: %v", name, err)
+			}
+			a.files[name] = file
+		case tar.TypeSymlink:
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir("/"+name), target)
+			}
+			a.links[name] = cleanArchivePath(target)
+		case tar.TypeLink:
+			a.links[name] = cleanArchivePath(hdr.Linkname)
+		}
+	}
+}
+
+func writeArchiveFile(file string, r io.Reader) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// open opens the file name in the archive, following links.
+func (a *archive) open(name string) (*os.File, error) {
+	name = cleanArchivePath(name)
+	for i := 0; i < maxArchiveLinks; i++ {
+		target, ok := a.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	file, ok := a.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in archive", name)
+	}
+	return os.Open(file)
+}
+
+func (a *archive) has(name string) bool {
+	f, err := a.open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func (a *archive) readJSON(name string, v interface{}) error {
+	f, err := a.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("parsing %s: %v", name, err)
+	}
+	return nil
+}
+
+func blobName(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// Manifest returns a manifest or index of the archive, by digest, or by tag
+// for OCI image layouts.
+func (a *archive) Manifest(ctx context.Context, ref string) ([]byte, string, digest.Digest, error) {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		tagged, ok := a.tags[ref]
+		if !ok {
+			return nil, "", "", fmt.Errorf("manifest %s: %w", ref, registry.ErrNotFound)
+		}
+		dgst = tagged
+	}
+	buf, ok := a.manifests[dgst]
+	if !ok {
+		f, err := a.Blob(ctx, dgst)
+		if err != nil {
+			return nil, "", "", err
+		}
+		defer f.Close()
+		buf, err = ioutil.ReadAll(f)
+		if err != nil {
+			return nil, "", "", err
+		}
+		verifier := dgst.Verifier()
+		_, _ = verifier.Write(buf)
+		if !verifier.Verified() {
+			return nil, "", "", fmt.Errorf("manifest %s: digest mismatch", dgst)
+		}
+	}
+	var versioned struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(buf, &versioned); err != nil {
+		return nil, "", "", fmt.Errorf("parsing manifest %s: %v", dgst, err)
+	}
+	mediaType := versioned.MediaType
+	if mediaType == "" {
+		mediaType = a.mediaTypes[dgst]
+	}
+	if mediaType == "" {
+		mediaType = specs.MediaTypeImageManifest
+		if versioned.Manifests != nil {
+			mediaType = specs.MediaTypeImageIndex
+		}
+	}
+	return buf, mediaType, dgst, nil
+}
+
+// Blob opens a blob of the archive. Its content is verified when it is
+// written to the store.
+func (a *archive) Blob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	if name, ok := a.blobs[dgst]; ok {
+		return a.open(name)
+	}
+	return a.open(blobName(dgst))
+}
+
+// images returns the images of an OCI image layout, or of a docker save
+// archive.
+func (a *archive) images() ([]archiveImage, error) {
+	if a.has(layoutIndexFile) {
+		return a.layoutImages()
+	}
+	if a.has(dockerManifestFile) {
+		return a.dockerImages()
+	}
+	return nil, fmt.Errorf("not an OCI image layout or docker save archive")
+}
+
+func (a *archive) layoutImages() ([]archiveImage, error) {
+	index := specs.Index{}
+	if err := a.readJSON(layoutIndexFile, &index); err != nil {
+		return nil, err
+	}
+	images := make([]archiveImage, 0, len(index.Manifests))
+	for _, desc := range index.Manifests {
+		if err := desc.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid manifest digest %q: %v", desc.Digest, err)
+		}
+		a.mediaTypes[desc.Digest] = desc.MediaType
+		image := archiveImage{desc: desc}
+		// The ref.name annotation is often only a tag, which is no use
+		// without the repository.
+		name := desc.Annotations[annotationImageName]
+		refName := desc.Annotations[specs.AnnotationRefName]
+		if name == "" && strings.ContainsAny(refName, "/:@") {
+			name = refName
+		}
+		tag := refName
+		if named, err := reference.ParseNormalizedNamed(name); err == nil {
+			if t, ok := named.(reference.Tagged); ok {
+				tag = t.Tag()
+			}
+		}
+		if tag != "" {
+			a.tags[tag] = desc.Digest
+		}
+		if isSignatureTag(tag) {
+			// Signatures are read by the image policy, not imported.
+			continue
+		}
+		if name != "" {
+			refs, err := normalizedReferences(name)
+			if err != nil {
+				return nil, err
+			}
+			image.refs = refs
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// dockerImages makes up a manifest for each image of a docker save archive,
+// whose layers are usually uncompressed and identified by file name.
+func (a *archive) dockerImages() ([]archiveImage, error) {
+	var entries []dockerManifest
+	if err := a.readJSON(dockerManifestFile, &entries); err != nil {
+		return nil, err
+	}
+	images := make([]archiveImage, 0, len(entries))
+	for _, entry := range entries {
+		config, err := a.describe(entry.Config, mediaTypeDockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		manifest := struct {
+			MediaType string `json:"mediaType"`
+			specs.Manifest
+		}{
+			MediaType: registry.MediaTypeDockerManifest,
+			Manifest:  specs.Manifest{Config: config},
+		}
+		manifest.SchemaVersion = 2
+		for _, layer := range entry.Layers {
+			desc, err := a.describe(layer, mediaTypeDockerLayerTar)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		buf, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		dgst := digest.FromBytes(buf)
+		a.manifests[dgst] = buf
+		image := archiveImage{
+			desc: specs.Descriptor{MediaType: manifest.MediaType, Digest: dgst, Size: int64(len(buf))},
+		}
+		for _, tag := range entry.RepoTags {
+			refs, err := normalizedReferences(tag)
+			if err != nil {
+				return nil, err
+			}
+			image.refs = append(image.refs, refs...)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// describe hashes the file name of the archive, and returns its descriptor.
+func (a *archive) describe(name, mediaType string) (specs.Descriptor, error) {
+	f, err := a.open(name)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	dgst, err := digest.FromReader(f)
+	if err != nil {
+		return specs.Descriptor{}, fmt.Errorf("hashing %s: %v", name, err)
+	}
+	a.blobs[dgst] = name
+	return specs.Descriptor{MediaType: mediaType, Digest: dgst, Size: info.Size()}, nil
+}
+
+// isSignatureTag returns whether tag is the tag of signatures, as returned
+// by imagepolicy.SignatureTag.
+func isSignatureTag(tag string) bool {
+	return strings.HasSuffix(tag, ".sig") && strings.Contains(tag, "-") &&
+		digest.Digest(strings.Replace(strings.TrimSuffix(tag, ".sig"), "-", ":", 1)).Validate() == nil
+}
+
+func normalizedReferences(image string) ([]string, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]string, 0, 2)
+	for _, r := range []string{ref.tag, ref.digest} {
+		if r != "" {
+			refs = append(refs, r)
+		}
+	}
+	return refs, nil
+}
+
+// Import adds the images of an archive read from r, an OCI image layout or
+// the output of docker save, to the store, tagged with the names they have
+// in the archive. If the image service has a policy, images have to pass it
+// for pods of any namespace, with the signatures in the archive.
+func (is *ImageService) Import(ctx context.Context, r io.Reader) ([]ImportedImage, error) {
+	if is.puller == nil {
+		return nil, fmt.Errorf("importing images requires an image store")
+	}
+	dir, err := is.puller.store.TempDir("import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	a, err := readArchive(r, dir)
+	if err != nil {
+		return nil, err
+	}
+	images, err := a.images()
+	if err != nil {
+		return nil, err
+	}
+
+	hold := is.puller.newHold()
+	defer hold.release()
+	imported := make([]ImportedImage, 0, len(images))
+	for _, image := range images {
+		buf, mediaType, dgst, err := a.Manifest(ctx, image.desc.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		if policy := is.puller.policy; policy != nil {
+			names, err := repositoryNames(image.refs)
+			if err != nil {
+				return nil, err
+			}
+			if err := policy.VerifyAll(ctx, a, names, dgst); err != nil {
+				return nil, fmt.Errorf("importing %s: %v", dgst, err)
+			}
+		}
+		pulled, err := is.puller.fetch(ctx, hold, a, buf, mediaType, dgst)
+		if err != nil {
+			return nil, fmt.Errorf("importing %s: %v", dgst, err)
+		}
+		img, err := is.recordImage(pulled, image.refs)
+		if err != nil {
+			return nil, err
+		}
+		if len(image.refs) == 0 {
+			klog.Warningf("imported image %s has no name, it can only be used by ID", img.ID)
+		}
+		imported = append(imported, ImportedImage{ID: img.ID, RepoTags: img.RepoTags})
+	}
+	return imported, nil
+}
+
+// repositoryNames returns the normalized repository names of refs.
+func repositoryNames(refs []string) ([]string, error) {
+	names := make([]string, 0, len(refs))
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[named.Name()] {
+			seen[named.Name()] = true
+			names = append(names, named.Name())
+		}
+	}
+	return names, nil
+}
+
+// Export writes images to w as an OCI image layout, which also has the
+// manifest.json of docker save archives, so docker load can read it too.
+// Only images with a darwin payload can be exported.
+func (is *ImageService) Export(ctx context.Context, w io.Writer, images []string) error {
+	if is.puller == nil {
+		return fmt.Errorf("exporting images requires an image store")
+	}
+	store := is.puller.store
+	index := specs.Index{}
+	index.SchemaVersion = 2
+	var dockerManifests []dockerManifest
+	var blobs []digest.Digest
+	exported := make(map[digest.Digest]bool)
+
+	for _, image := range images {
+		img, err := is.resolveImage(image)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			return fmt.Errorf("image %s not found", image)
+		}
+		if img.ManifestDigest == "" || len(img.Blobs) < 2 {
+			return fmt.Errorf("image %s has no darwin payload to export", image)
+		}
+		manifestDigest := digest.Digest(img.ManifestDigest)
+		buf, err := store.ReadBlob(manifestDigest)
+		if err != nil {
+			return err
+		}
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		_ = json.Unmarshal(buf, &versioned)
+		if versioned.MediaType == "" {
+			versioned.MediaType = specs.MediaTypeImageManifest
+		}
+		desc := specs.Descriptor{MediaType: versioned.MediaType, Digest: manifestDigest, Size: int64(len(buf))}
+		entry := dockerManifest{Config: blobName(digest.Digest(img.Blobs[1]))}
+		for _, layer := range img.Blobs[2:] {
+			entry.Layers = append(entry.Layers, blobName(digest.Digest(layer)))
+		}
+		for _, tag := range img.RepoTags {
+			named, err := reference.ParseNormalizedNamed(tag)
+			if err != nil {
+				return err
+			}
+			tagged := desc
+			tagged.Annotations = map[string]string{annotationImageName: tag}
+			if t, ok := named.(reference.Tagged); ok {
+				tagged.Annotations[specs.AnnotationRefName] = t.Tag()
+			}
+			index.Manifests = append(index.Manifests, tagged)
+			entry.RepoTags = append(entry.RepoTags, reference.FamiliarString(named))
+		}
+		if len(img.RepoTags) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		dockerManifests = append(dockerManifests, entry)
+		for _, b := range img.Blobs {
+			if !exported[digest.Digest(b)] {
+				exported[digest.Digest(b)] = true
+				blobs = append(blobs, digest.Digest(b))
+			}
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeTarJSON(tw, specs.ImageLayoutFile, specs.ImageLayout{Version: specs.ImageLayoutVersion}); err != nil {
+		return err
+	}
+	for _, dgst := range blobs {
+		if err := writeTarBlob(tw, store.OpenBlob, dgst); err != nil {
+			return fmt.Errorf("exporting blob %s: %v", dgst, err)
+		}
+	}
+	if err := writeTarJSON(tw, layoutIndexFile, index); err != nil {
+		return err
+	}
+	if err := writeTarJSON(tw, dockerManifestFile, dockerManifests); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarJSON(tw *tar.Writer, name string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(buf)), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = tw.Write(buf)
+	return err
+}
+
+func writeTarBlob(tw *tar.Writer, open func(digest.Digest) (*os.File, error), dgst digest.Digest) error {
+	f, err := open(dgst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: blobName(dgst), Mode: 0644, Size: info.Size(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
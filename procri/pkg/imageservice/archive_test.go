@@ -0,0 +1,197 @@
+package imageservice
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/elotl/procri/pkg/imagepolicy"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func TestExportImport(t *testing.T) {
+	reg := newTestRegistry(t)
+	darwin := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "darwin"}))
+	reg.tagIndex(t, "v1", map[string]specs.Descriptor{"darwin": darwin})
+	is, _ := newPullingImageService(t, reg)
+	ctx := context.Background()
+	image := reg.host() + "/app:v1"
+	pulled, err := is.PullImage(ctx, &cri.PullImageRequest{Image: &cri.ImageSpec{Image: image}})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, is.Export(ctx, buf, []string{image}))
+
+	offline, _ := newPullingImageService(t, reg)
+	reg.Close()
+	imported, err := offline.Import(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	assert.Equal(t, pulled.ImageRef, imported[0].ID)
+	assert.Equal(t, []string{image}, imported[0].RepoTags)
+	id, root, err := offline.ResolveImage(image)
+	require.NoError(t, err)
+	assert.Equal(t, pulled.ImageRef, id)
+	content, err := ioutil.ReadFile(filepath.Join(root, "bin/hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "darwin", string(content))
+}
+
+func TestImportDockerSave(t *testing.T) {
+	layer := &bytes.Buffer{}
+	lw := tar.NewWriter(layer)
+	require.NoError(t, lw.WriteHeader(&tar.Header{Name: "bin/hello", Mode: 0755, Size: 6, Typeflag: tar.TypeReg}))
+	_, err := lw.Write([]byte("darwin"))
+	require.NoError(t, err)
+	require.NoError(t, lw.Close())
+	config, err := json.Marshal(specs.Image{OS: "darwin", Architecture: runtime.GOARCH})
+	require.NoError(t, err)
+	manifest, err := json.Marshal([]dockerManifest{{
+		Config:   "cafe.json",
+		RepoTags: []string{"app:v1", "registry.example.com/team/app:v1"},
+		Layers:   []string{"aaaa/layer.tar", "bbbb/layer.tar"},
+	}})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{"cafe.json", config},
+		{"aaaa/layer.tar", layer.Bytes()},
+		{"manifest.json", manifest},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(f.content)
+		require.NoError(t, err)
+	}
+	// docker save links layers that are in an archive twice.
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bbbb/layer.tar", Linkname: "../aaaa/layer.tar", Typeflag: tar.TypeSymlink}))
+	require.NoError(t, tw.Close())
+
+	is, _ := newPullingImageService(t, newTestRegistry(t))
+	imported, err := is.Import(context.Background(), buf)
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	assert.ElementsMatch(t, []string{"docker.io/library/app:v1", "registry.example.com/team/app:v1"}, imported[0].RepoTags)
+	_, root, err := is.ResolveImage("app:v1")
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(root, "bin/hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "darwin", string(content))
+}
+
+// layoutArchive writes the blobs of reg as an OCI image layout, with index
+// entries for manifests, by name.
+func layoutArchive(t *testing.T, reg *testRegistry, manifests map[string]specs.Descriptor) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	add := func(name string, content []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	for dgst, content := range reg.blobs {
+		add(filepath.Join("blobs", dgst.Algorithm().String(), dgst.Hex()), content)
+	}
+	index := specs.Index{}
+	index.SchemaVersion = 2
+	for name, desc := range manifests {
+		key := annotationImageName
+		if isSignatureTag(name) {
+			key = specs.AnnotationRefName
+		}
+		desc.Annotations = map[string]string{key: name}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	content, err := json.Marshal(index)
+	require.NoError(t, err)
+	add(layoutIndexFile, content)
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestImportVerifiesSignatures(t *testing.T) {
+	reg := newTestRegistry(t)
+	trusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signed := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "signed"}))
+	reg.sign(t, trusted, signed.Digest)
+	unsigned := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "unsigned"}))
+	sigTag := imagepolicy.SignatureTag(signed.Digest)
+	sig := specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: digest.FromBytes(reg.manifests[sigTag]), Size: int64(len(reg.manifests[sigTag]))}
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte(fmt.Sprintf(`{
+		"rules": [
+			{"scope": "registry.example.com/pipeline", "require": "signed", "publicKeys": [%q]},
+			{"scope": "registry.example.com/pipeline", "namespaces": ["dev"], "require": "accept"},
+			{"scope": "registry.example.com/other", "namespaces": ["prod"], "require": "reject"}
+		]
+	}`, writePublicKey(t, trusted))), 0644))
+	policy, err := imagepolicy.Load(policyFile)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		manifests map[string]specs.Descriptor
+		err       string
+	}{
+		{
+			name:      "signed",
+			manifests: map[string]specs.Descriptor{"registry.example.com/pipeline/app:v1": signed, sigTag: sig},
+		},
+		{
+			name:      "signature missing from the archive",
+			manifests: map[string]specs.Descriptor{"registry.example.com/pipeline/app:v1": signed},
+			err:       "not signed",
+		},
+		{
+			name:      "unsigned",
+			manifests: map[string]specs.Descriptor{"registry.example.com/pipeline/app:v2": unsigned},
+			err:       "not signed",
+		},
+		{
+			name:      "rejected in a namespace",
+			manifests: map[string]specs.Descriptor{"registry.example.com/other/app:v1": unsigned},
+			err:       "rejected by policy for registry.example.com/other",
+		},
+		{
+			name:      "without a name",
+			manifests: map[string]specs.Descriptor{"": unsigned},
+			err:       "rejected by policy",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			is, store := newPullingImageService(t, reg)
+			is.puller.policy = policy
+			imported, err := is.Import(context.Background(), bytes.NewReader(layoutArchive(t, reg, tc.manifests)))
+			if tc.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.err)
+				}
+				assert.False(t, store.HasRootFS(unsigned.Digest))
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, imported, 1, "signatures are not imported")
+			assert.True(t, store.HasRootFS(signed.Digest))
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package imageservice
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/diskv"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+const (
+	credentialKeySize = 32 // AES-256
+)
+
+// CredentialStore keeps registry credentials encrypted at rest with
+// AES-256-GCM.
+//
+// The key file holds one base64 encoded 32 byte key per line. The first key
+// encrypts, all of them decrypt. To rotate, add a new key as the first line
+// and restart procri: every record is re-encrypted with the new key, and the
+// old key can be removed from the file afterwards.
+type CredentialStore struct {
+	dataStore *diskv.Diskv
+	keys      []credentialKey
+}
+
+type credentialKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+type encryptedCredential struct {
+	KeyID      string `json:"keyID"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func NewCredentialStore(dataStore *diskv.Diskv, keyFile string) (*CredentialStore, error) {
+	keys, err := loadCredentialKeys(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cs := &CredentialStore{
+		dataStore: dataStore,
+		keys:      keys,
+	}
+	if err := cs.Rotate(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func loadCredentialKeys(keyFile string) ([]credentialKey, error) {
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading credential key file: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		klog.Warningf("credential key file %s is accessible by other users (mode %v)", keyFile, info.Mode().Perm())
+	}
+
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading credential key file: %v", err)
+	}
+	defer f.Close()
+
+	keys := make([]credentialKey, 0)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || len(raw) != credentialKeySize {
+			return nil, fmt.Errorf("credential key file %s line %d: expected a base64 encoded %d byte key", keyFile, line, credentialKeySize)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		keys = append(keys, credentialKey{
+			id:   hex.EncodeToString(sum[:8]),
+			aead: aead,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading credential key file: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("credential key file %s contains no keys", keyFile)
+	}
+	return keys, nil
+}
+
+func (cs *CredentialStore) findKey(id string) *credentialKey {
+	for i := range cs.keys {
+		if cs.keys[i].id == id {
+			return &cs.keys[i]
+		}
+	}
+	return nil
+}
+
+func (cs *CredentialStore) encrypt(auth *cri.AuthConfig) (*encryptedCredential, error) {
+	plaintext, err := auth.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	key := cs.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &encryptedCredential{
+		KeyID:      key.id,
+		Nonce:      nonce,
+		Ciphertext: key.aead.Seal(nil, nonce, plaintext, []byte(key.id)),
+	}, nil
+}
+
+func (cs *CredentialStore) decrypt(ec *encryptedCredential) (*cri.AuthConfig, error) {
+	key := cs.findKey(ec.KeyID)
+	if key == nil {
+		return nil, fmt.Errorf("credential was encrypted with unknown key %s", ec.KeyID)
+	}
+	plaintext, err := key.aead.Open(nil, ec.Nonce, ec.Ciphertext, []byte(ec.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting credential: %v", err)
+	}
+	auth := &cri.AuthConfig{}
+	if err := auth.Unmarshal(plaintext); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (cs *CredentialStore) read(key string) (*encryptedCredential, error) {
+	buf, err := cs.dataStore.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	ec := &encryptedCredential{}
+	if err := json.Unmarshal(buf, ec); err != nil {
+		return nil, fmt.Errorf("deserializing credential %s: %v", key, err)
+	}
+	return ec, nil
+}
+
+func (cs *CredentialStore) write(key string, ec *encryptedCredential) error {
+	buf, err := json.Marshal(ec)
+	if err != nil {
+		return err
+	}
+	return cs.dataStore.Write(key, buf)
+}
+
+// Put encrypts and stores the credentials used for an image.
+func (cs *CredentialStore) Put(key string, auth *cri.AuthConfig) error {
+	ec, err := cs.encrypt(auth)
+	if err != nil {
+		return fmt.Errorf("encrypting credential %s: %v", key, err)
+	}
+	if err := cs.write(key, ec); err != nil {
+		return fmt.Errorf("storing credential %s: %v", key, err)
+	}
+	return nil
+}
+
+// Get returns the stored credentials for an image, or nil if there are none.
+func (cs *CredentialStore) Get(key string) (*cri.AuthConfig, error) {
+	if !cs.dataStore.Has(key) {
+		return nil, nil
+	}
+	ec, err := cs.read(key)
+	if err != nil {
+		return nil, err
+	}
+	return cs.decrypt(ec)
+}
+
+// Delete removes the stored credentials for an image.
+func (cs *CredentialStore) Delete(key string) {
+	if !cs.dataStore.Has(key) {
+		return
+	}
+	if err := cs.dataStore.Erase(key); err != nil {
+		klog.Errorf("deleting credential %s: %v", key, err)
+	}
+}
+
+// Rotate re-encrypts every record that is not encrypted with the current
+// key.
+func (cs *CredentialStore) Rotate() error {
+	rotated := 0
+	for key := range cs.dataStore.Keys(nil) {
+		ec, err := cs.read(key)
+		if err != nil {
+			return err
+		}
+		if ec.KeyID == cs.keys[0].id {
+			continue
+		}
+		auth, err := cs.decrypt(ec)
+		if err != nil {
+			return fmt.Errorf("rotating credential %s: %v", key, err)
+		}
+		if err := cs.Put(key, auth); err != nil {
+			return err
+		}
+		rotated++
+	}
+	if rotated > 0 {
+		klog.Infof("re-encrypted %d registry credentials with key %s", rotated, cs.keys[0].id)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package imageservice
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/peterbourgon/diskv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func newKey(t *testing.T) string {
+	key := make([]byte, credentialKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func writeKeyFile(t *testing.T, dir string, keys ...string) string {
+	path := filepath.Join(dir, "credential.key")
+	err := ioutil.WriteFile(path, []byte(strings.Join(keys, "\n")+"\n"), 0600)
+	require.NoError(t, err)
+	return path
+}
+
+// readAll returns the content of every file under dir.
+func readAll(t *testing.T, dir string) string {
+	var sb strings.Builder
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		sb.Write(buf)
+		return err
+	})
+	require.NoError(t, err)
+	return sb.String()
+}
+
+func TestCredentialStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	keyFile := writeKeyFile(t, dir, "# comment", newKey(t))
+	cs, err := NewCredentialStore(diskv.New(diskv.Options{BasePath: dataDir}), keyFile)
+	require.NoError(t, err)
+
+	auth := &cri.AuthConfig{Username: "robot", Password: "hunter2-registry-secret"}
+	require.NoError(t, cs.Put("img", auth))
+	assert.NotContains(t, readAll(t, dataDir), auth.Password)
+
+	got, err := cs.Get("img")
+	require.NoError(t, err)
+	assert.Equal(t, auth, got)
+
+	cs.Delete("img")
+	got, err = cs.Get("img")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestCredentialStoreRotate(t *testing.T) {
+	dir := t.TempDir()
+	dataStore := diskv.New(diskv.Options{BasePath: filepath.Join(dir, "data")})
+	oldKey, newerKey := newKey(t), newKey(t)
+
+	cs, err := NewCredentialStore(dataStore, writeKeyFile(t, dir, oldKey))
+	require.NoError(t, err)
+	auth := &cri.AuthConfig{Username: "robot", Password: "hunter2-registry-secret"}
+	require.NoError(t, cs.Put("img", auth))
+
+	// Restart with the new key first: the record is re-encrypted with it.
+	cs, err = NewCredentialStore(dataStore, writeKeyFile(t, dir, newerKey, oldKey))
+	require.NoError(t, err)
+	ec, err := cs.read("img")
+	require.NoError(t, err)
+	assert.Equal(t, cs.keys[0].id, ec.KeyID)
+
+	// The old key is no longer needed.
+	cs, err = NewCredentialStore(dataStore, writeKeyFile(t, dir, newerKey))
+	require.NoError(t, err)
+	got, err := cs.Get("img")
+	require.NoError(t, err)
+	assert.Equal(t, auth, got)
+
+	// A store without the current key can't read the records.
+	_, err = NewCredentialStore(dataStore, writeKeyFile(t, dir, newKey(t)))
+	assert.Error(t, err)
+}
+
+func TestCredentialStoreInvalidKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	dataStore := diskv.New(diskv.Options{BasePath: filepath.Join(dir, "data")})
+	testCases := []struct {
+		name string
+		keys []string
+	}{
+		{name: "empty", keys: []string{"# no keys"}},
+		{name: "not base64", keys: []string{"not a key!"}},
+		{name: "short key", keys: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewCredentialStore(dataStore, writeKeyFile(t, dir, tc.keys...))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMigratePlaintextCredentials(t *testing.T) {
+	secret := "hunter2-registry-secret"
+	legacy := map[string]interface{}{
+		"image":         "registry.example.com/app:v1",
+		"username":      "robot",
+		"password":      secret,
+		"auth":          "",
+		"serverAddress": "registry.example.com",
+		"identityToken": "",
+		"registryToken": "",
+		"Tags":          []string{"registry.example.com/app:v1"},
+	}
+	buf, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	key := makeImgKey("registry.example.com/app")
+
+	for _, withStore := range []bool{false, true} {
+		dir := t.TempDir()
+		imageDir := filepath.Join(dir, "images")
+		dataStore := diskv.New(diskv.Options{BasePath: imageDir})
+		require.NoError(t, dataStore.Write(key, buf))
+
+		var cs *CredentialStore
+		if withStore {
+			cs, err = NewCredentialStore(diskv.New(diskv.Options{BasePath: filepath.Join(dir, "credentials")}), writeKeyFile(t, dir, newKey(t)))
+			require.NoError(t, err)
+		}
+		is, err := NewImageService(dataStore, cs, nil)
+		require.NoError(t, err)
+
+		assert.NotContains(t, readAll(t, imageDir), secret)
+		img, err := is.resolveImage("registry.example.com/app:v1")
+		require.NoError(t, err)
+		require.NotNil(t, img)
+		assert.Equal(t, []string{"registry.example.com/app:v1"}, img.RepoTags)
+		if withStore {
+			auth, err := cs.Get(key)
+			require.NoError(t, err)
+			require.NotNil(t, auth)
+			assert.Equal(t, "robot", auth.Username)
+			assert.Equal(t, secret, auth.Password)
+			assert.NotContains(t, readAll(t, filepath.Join(dir, "credentials")), secret)
+		}
+	}
+}
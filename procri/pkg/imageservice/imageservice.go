@@ -5,9 +5,17 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/docker/distribution/reference"
+	"github.com/elotl/procri/pkg/imagestore"
+	"github.com/elotl/procri/pkg/redact"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/peterbourgon/diskv"
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/net/context"
@@ -16,34 +24,102 @@ import (
 	"k8s.io/klog"
 )
 
+const (
+	imageSubdir = "image/"
+	imagePrefix = "img_"
+	refSubdir   = "ref/"
+	refPrefix   = "ref_"
+)
+
 type ImageService struct {
 	// UUID generated when the service is started, to fake a storage UUID.
 	uuid string
 	// Persistent store for image and runtime data.
 	dataStore *diskv.Diskv
+	// Encrypted store for registry credentials. If nil, credentials are only
+	// kept in memory while a pull is running.
+	credentialStore *CredentialStore
+	// Fetches images from registries. If nil, pulls only record the image
+	// name, and containers run binaries from the host.
+	puller *Puller
+	// Reports the images used by containers, which can't be removed. If
+	// nil, all images can be removed.
+	users ImageUsers
+	// Running pulls, by normalized reference.
+	pulls *pullGroup
+	// Serializes updates of image and reference records.
+	mu sync.Mutex
+}
+
+// ImageUsers reports which images are used by containers.
+type ImageUsers interface {
+	// ImagesInUse returns the IDs or names of the images of all containers.
+	ImagesInUse() []string
 }
 
 type Image struct {
-	Image         string   `json:"image"`
-	Username      string   `json:"username"`
-	Password      string   `json:"password"`
-	Auth          string   `json:"auth"`
-	ServerAddress string   `json:"serverAddress"`
-	IdentityToken string   `json:"identityToken"`
-	RegistryToken string   `json:"registryToken"`
-	Tags          []string `json:",omitempty"`
-	Digests       []string `json:",omitempty"`
-}
-
-func NewImageService(dataStore *diskv.Diskv) *ImageService {
+	// Content digest identifying the image: the digest of the config for
+	// images with a darwin payload, of the manifest or index for images
+	// without one, and of the reference if pulling is disabled.
+	ID string `json:"id"`
+	// Tags and digest references pointing to the image. Tags can move to
+	// other images when they are pulled again.
+	RepoTags    []string `json:"repoTags,omitempty"`
+	RepoDigests []string `json:"repoDigests,omitempty"`
+	// Digest of the pulled manifest. Empty for host images, which have no
+	// darwin payload.
+	ManifestDigest string `json:"manifestDigest,omitempty"`
+	// Directory the layers are unpacked to.
+	RootFS string `json:"rootfs,omitempty"`
+	// Bytes used by the unpacked root filesystem.
+	Size uint64 `json:"size,omitempty"`
+	// Blobs in the image store used by the image.
+	Blobs []string `json:"blobs,omitempty"`
+}
+
+// imageRef points a tag or digest reference to an image.
+type imageRef struct {
+	Reference string `json:"reference"`
+	ImageID   string `json:"imageID"`
+}
+
+func NewImageService(dataStore *diskv.Diskv, credentialStore *CredentialStore, puller *Puller) (*ImageService, error) {
+	for _, dir := range []string{imageSubdir, refSubdir} {
+		if err := os.MkdirAll(filepath.Join(dataStore.BasePath, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
 	is := ImageService{
-		uuid:      uuid.NewV4().String(),
-		dataStore: dataStore,
+		uuid:            uuid.NewV4().String(),
+		dataStore:       dataStore,
+		credentialStore: credentialStore,
+		puller:          puller,
+		pulls:           newPullGroup(),
 	}
-	return &is
+	is.migrateLegacyImages()
+	is.measureImages()
+	return &is, nil
 }
 
-func (is *ImageService) getImage(key string) *Image {
+// SetImageUsers sets what reports the images used by containers. Images in
+// use are protected from RemoveImage.
+func (is *ImageService) SetImageUsers(users ImageUsers) {
+	is.users = users
+}
+
+func makeImageKey(id string) string {
+	return filepath.Join(imageSubdir, imagePrefix+digest.Digest(id).Hex())
+}
+
+func makeRefKey(ref string) string {
+	return filepath.Join(refSubdir, refPrefix+makeImgKey(ref))
+}
+
+func (is *ImageService) getImage(id string) *Image {
+	if digest.Digest(id).Validate() != nil {
+		return nil
+	}
+	key := makeImageKey(id)
 	buf, err := is.dataStore.Read(key)
 	if err != nil {
 		klog.V(5).Infof("looking up image %s: %v", key, err)
@@ -56,24 +132,12 @@ func (is *ImageService) getImage(key string) *Image {
 		klog.Errorf("deserializing image data for %s: %v", key, err)
 		return nil
 	}
-	if len(img.Tags) == 1 {
-		if img.Tags[0] == "" {
-			img.Tags = []string{}
-		}
-
-	}
-	if len(img.Digests) == 1 {
-		if img.Digests[0] == "" {
-			img.Digests = []string{}
-		}
-
-	}
 
 	return &img
 }
 
-func (is *ImageService) marshalAndSave(key string, img *Image) error {
-	buf, err := json.Marshal(img)
+func (is *ImageService) marshalAndSave(key string, v interface{}) error {
+	buf, err := json.Marshal(v)
 	if err != nil {
 		klog.Errorf("serializing image data for %s: %v", key, err)
 		return err
@@ -87,18 +151,18 @@ func (is *ImageService) marshalAndSave(key string, img *Image) error {
 	return nil
 }
 
-func (is *ImageService) putImage(key string, img *Image) error {
-	err := is.marshalAndSave(key, img)
+func (is *ImageService) putImage(img *Image) error {
+	err := is.marshalAndSave(makeImageKey(img.ID), img)
 	if err != nil {
-		return fmt.Errorf("saving image %s: %v", key, err)
+		return fmt.Errorf("saving image %s: %v", img.ID, err)
 	}
 	return nil
 }
 
-func (is *ImageService) deleteImage(key string) bool {
-	err := is.dataStore.Erase(key)
+func (is *ImageService) deleteImage(id string) bool {
+	err := is.dataStore.Erase(makeImageKey(id))
 	if err != nil {
-		klog.Errorf("deleting image %s: %v", key, err)
+		klog.Errorf("deleting image %s: %v", id, err)
 		return false
 	}
 
@@ -108,9 +172,9 @@ func (is *ImageService) deleteImage(key string) bool {
 func (is *ImageService) listImages() []*Image {
 	images := make([]*Image, 0)
 
-	for key := range is.dataStore.Keys(nil) {
-		klog.V(4).Infof("trying to get image under %s key", key)
-		img := is.getImage(key)
+	for key := range is.dataStore.KeysPrefix(imagePrefix, nil) {
+		id := "sha256:" + strings.TrimPrefix(key, imagePrefix)
+		img := is.getImage(id)
 		if img != nil {
 			images = append(images, img)
 		}
@@ -119,36 +183,175 @@ func (is *ImageService) listImages() []*Image {
 	return images
 }
 
+// getRef returns the ID of the image ref points to, or an empty string.
+func (is *ImageService) getRef(ref string) string {
+	buf, err := is.dataStore.Read(makeRefKey(ref))
+	if err != nil {
+		return ""
+	}
+	r := imageRef{}
+	if err := json.Unmarshal(buf, &r); err != nil {
+		klog.Errorf("deserializing image reference %s: %v", ref, err)
+		return ""
+	}
+	return r.ImageID
+}
+
+func (is *ImageService) putRef(ref, id string) error {
+	err := is.marshalAndSave(makeRefKey(ref), &imageRef{Reference: ref, ImageID: id})
+	if err != nil {
+		return fmt.Errorf("saving image reference %s: %v", ref, err)
+	}
+	return nil
+}
+
+func (is *ImageService) deleteRef(ref string) {
+	key := makeRefKey(ref)
+	if !is.dataStore.Has(key) {
+		return
+	}
+	if err := is.dataStore.Erase(key); err != nil {
+		klog.Errorf("deleting image reference %s: %v", ref, err)
+	}
+}
+
+func isDigestReference(ref string) bool {
+	return strings.Contains(ref, "@")
+}
+
+// tagImage points ref, a normalized tag or digest reference, to img. If it
+// pointed to another image before, it is removed from that image, which is
+// kept without it, like Docker keeps dangling images. The caller saves img.
+func (is *ImageService) tagImage(ref string, img *Image) {
+	if old := is.getRef(ref); old != "" && old != img.ID {
+		if oldImg := is.getImage(old); oldImg != nil {
+			oldImg.RepoTags = removeFromSlice(ref, oldImg.RepoTags)
+			oldImg.RepoDigests = removeFromSlice(ref, oldImg.RepoDigests)
+			if err := is.putImage(oldImg); err != nil {
+				klog.Errorf("moving %s from image %s: %v", ref, old, err)
+			}
+			klog.V(2).Infof("%s moved from image %s to %s", ref, old, img.ID)
+		}
+	}
+	if err := is.putRef(ref, img.ID); err != nil {
+		klog.Error(err)
+		return
+	}
+	if isDigestReference(ref) {
+		img.RepoDigests = addToSliceWithoutDuplicate(ref, img.RepoDigests)
+	} else {
+		img.RepoTags = addToSliceWithoutDuplicate(ref, img.RepoTags)
+	}
+}
+
+// parseImageID parses an image ID, with or without the "sha256:" prefix.
+func parseImageID(image string) (string, bool) {
+	if len(image) == 64 {
+		image = "sha256:" + image
+	}
+	dgst, err := digest.Parse(image)
+	if err != nil {
+		return "", false
+	}
+	return dgst.String(), true
+}
+
+// resolveImage finds the image an image ID or a reference in any equivalent
+// form refers to. It returns nil if there is no such image.
+func (is *ImageService) resolveImage(image string) (*Image, error) {
+	if id, ok := parseImageID(image); ok {
+		return is.getImage(id), nil
+	}
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range []string{ref.digest, ref.tag} {
+		if r == "" {
+			continue
+		}
+		if id := is.getRef(r); id != "" {
+			return is.getImage(id), nil
+		}
+	}
+	return nil, nil
+}
+
+// repositoryInUse reports whether an image still has a tag or digest in the
+// repository name.
+func (is *ImageService) repositoryInUse(name string) bool {
+	for _, img := range is.listImages() {
+		for _, r := range append(append([]string{}, img.RepoTags...), img.RepoDigests...) {
+			if ref, err := parseImageReference(r); err == nil && ref.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 //
 // Implementation of cri.ImageService.
 //
 
+// size returns the size of an image reported to kubelet. Host images have
+// no payload, but kubelet expects images to have a size.
+func (img *Image) size() uint64 {
+	if img.Size == 0 {
+		return 1
+	}
+	return img.Size
+}
+
+// imageInUse returns whether a container uses the image.
+func (is *ImageService) imageInUse(img *Image) bool {
+	if is.users == nil {
+		return false
+	}
+	for _, image := range is.users.ImagesInUse() {
+		if image == img.ID {
+			return true
+		}
+		used, err := is.resolveImage(image)
+		if err == nil && used != nil && used.ID == img.ID {
+			return true
+		}
+	}
+	return false
+}
+
 // ListImages lists existing images.
 func (is *ImageService) ListImages(ctx context.Context, req *cri.ListImagesRequest) (*cri.ListImagesResponse, error) {
-	klog.V(4).Infof("ListImages request %+v", req)
-
 	resp := &cri.ListImagesResponse{
 		Images: make([]*cri.Image, 0),
 	}
 
-	for _, img := range is.listImages() {
-		klog.V(4).Infof("ListImages img: %v", img)
-		if req.Filter == nil || req.Filter.Image == nil || req.Filter.Image.Image == img.Image {
-			image := &cri.Image{
-				Id:          img.Image,
-				RepoTags:    img.Tags,
-				RepoDigests: img.Digests,
-				Size_:       0,
-				Uid: &cri.Int64Value{
-					Value: 0,
-				},
-				Username: "",
-			}
-			resp.Images = append(resp.Images, image)
+	images := is.listImages()
+	if image := req.GetFilter().GetImage().GetImage(); image != "" {
+		img, err := is.resolveImage(image)
+		if err != nil {
+			return nil, err
+		}
+		images = images[:0]
+		if img != nil {
+			images = append(images, img)
+		}
+	}
+
+	for _, img := range images {
+		image := &cri.Image{
+			Id:          img.ID,
+			RepoTags:    img.RepoTags,
+			RepoDigests: img.RepoDigests,
+			Size_:       img.size(),
+			Uid: &cri.Int64Value{
+				Value: 0,
+			},
+			Username: "",
 		}
+		resp.Images = append(resp.Images, image)
 	}
 
-	klog.V(4).Infof("ListImages request %+v: %+v", req, resp)
 	return resp, nil
 }
 
@@ -156,158 +359,352 @@ func (is *ImageService) ListImages(ctx context.Context, req *cri.ListImagesReque
 // present, returns a response with ImageStatusResponse.Image set to
 // nil.
 func (is *ImageService) ImageStatus(ctx context.Context, req *cri.ImageStatusRequest) (*cri.ImageStatusResponse, error) {
-	klog.V(4).Infof("ImageStatus request %+v", req)
-
 	resp := cri.ImageStatusResponse{
 		Image: nil,
 	}
 
 	if req.Image == nil {
-		klog.V(5).Infof("ImageStatus request %v: %v", req, resp)
 		return &resp, nil
 	}
-	imgName, _, _ := getImageNameTagAndDigest(req.Image.Image)
-	klog.V(4).Infof("trying to getImage under %s key", imgName)
+	img, err := is.resolveImage(req.Image.Image)
+	if err != nil {
+		return nil, err
+	}
 
-	if img := is.getImage(imgName); img != nil {
-		klog.V(4).Infof("got image: %v", img)
+	if img != nil {
 		image := &cri.Image{
-			Id:    req.Image.Image,
-			Size_: 1, // This can't be zero.
+			Id:    img.ID,
+			Size_: img.size(),
 			Uid: &cri.Int64Value{
 				Value: 0,
 			},
 			Username: "",
 		}
-		if len(img.Tags) > 0 {
-			klog.V(4).Infof("adding tags: %s", img.Tags)
-			klog.V(4).Infof("adding tags with len: %v", len(img.Tags))
-			klog.V(4).Infof("adding tag: %s", img.Tags[0])
-			image.RepoTags = img.Tags
+		if len(img.RepoTags) > 0 {
+			image.RepoTags = img.RepoTags
 		}
-		if len(img.Digests) > 0 {
-			klog.V(4).Infof("adding digests: %s", img.Tags)
-			image.RepoDigests = img.Digests
+		if len(img.RepoDigests) > 0 {
+			image.RepoDigests = img.RepoDigests
 		}
 
 		resp.Image = image
 		return &resp, nil
 	}
 
-	klog.V(4).Infof("ImageStatus request %v: %v", req, resp)
 	return &resp, nil
 }
 
 // PullImage pulls an image with authentication config.
 func (is *ImageService) PullImage(ctx context.Context, req *cri.PullImageRequest) (*cri.PullImageResponse, error) {
-	klog.V(4).Infof("PullImage request %+v", req)
-
 	if req.Image == nil {
 		err := fmt.Errorf("invalid PullImageRequest, Image is nil")
-		klog.Errorf("PullImage request %v: %v", req, err)
 		return nil, err
 	}
 
-	imageName, imageTag, imageDigest := getImageNameTagAndDigest(req.Image.Image)
-	// check if image already exists
-	img := is.getImage(imageName)
-	var err error
-	if img != nil {
-		klog.V(4).Infof("add imageTag to img.Tags")
-		tags := addToSliceWithoutDuplicate(imageTag, img.Tags)
-		klog.V(4).Infof("add imageDigest to img.Digests")
-		digests := addToSliceWithoutDuplicate(imageDigest, img.Digests)
-		img.Tags = tags
-		img.Digests = digests
-		err = is.putImage(imageName, img)
-
-	} else {
-		klog.V(4).Infof("add imageTag to img.Tags")
-		tags := addToSliceWithoutDuplicate(imageTag, []string{})
-		klog.V(4).Infof("add imageDigest to img.Digests")
-		digests := addToSliceWithoutDuplicate(imageDigest, []string{})
-		image := Image{
-			Image:   req.Image.Image,
-			Tags:    tags,
-			Digests: digests,
-		}
-		if req.Auth != nil {
-			klog.V(4).Infof("PullImage authentication is needed for image %s", imageName)
-			image.Auth = req.Auth.Auth
-			image.Username = req.Auth.Username
-			image.Password = req.Auth.Password
-			image.ServerAddress = req.Auth.ServerAddress
-			image.IdentityToken = req.Auth.IdentityToken
-			image.RegistryToken = req.Auth.RegistryToken
-		}
-
-		err = is.putImage(imageName, &image)
+	ref, err := parseImageReference(req.Image.Image)
+	if err != nil {
+		return nil, err
+	}
+	if req.Auth != nil {
+		klog.V(4).Infof("PullImage authentication is needed for image %s: %+v", req.Image.Image, redact.AuthConfig(req.Auth))
+	}
+	// Concurrent pulls of the same reference, e.g. by several pods, share
+	// one download, using the credentials of the first request. If the
+	// image policy depends on the namespace, only pulls for the same
+	// namespace do.
+	key := ref.named.String()
+	if is.puller != nil && is.puller.policy != nil && is.puller.policy.DependsOnNamespace() {
+		key = req.GetSandboxConfig().GetMetadata().GetNamespace() + "/" + key
 	}
+	id, err := is.pulls.do(ctx, key, func(ctx context.Context) (string, error) {
+		return is.pullAndRecord(ctx, ref, req)
+	})
 	if err != nil {
 		return nil, err
 	}
 	resp := cri.PullImageResponse{
-		ImageRef: imageName,
+		ImageRef: id,
 	}
-	klog.V(4).Infof("PullImage request %v: %v", req, resp)
 	return &resp, nil
 }
 
+// pullAndRecord pulls an image and records it with its references, and
+// returns its ID.
+func (is *ImageService) pullAndRecord(ctx context.Context, ref *imageReference, req *cri.PullImageRequest) (string, error) {
+	var hold *pullHold
+	if is.puller != nil {
+		// Until the image is recorded, nothing else keeps its content
+		// from being removed.
+		hold = is.puller.newHold()
+		defer hold.release()
+	}
+	pulled, err := is.pull(ctx, hold, ref, req)
+	if err != nil {
+		return "", err
+	}
+
+	refs := []string{ref.tag, ref.digest}
+	if pulled.RepoDigest != "" {
+		refs = append(refs, ref.name+"@"+pulled.RepoDigest.String())
+	}
+	img, err := is.recordImage(pulled, refs)
+	if err != nil {
+		return "", err
+	}
+	if req.Auth != nil {
+		if is.credentialStore != nil {
+			if err := is.credentialStore.Put(ref.key, req.Auth); err != nil {
+				return "", err
+			}
+		}
+	}
+	return img.ID, nil
+}
+
+// recordImage saves the record of an image in the store, and points refs,
+// normalized references, to it.
+func (is *ImageService) recordImage(pulled *pulledImage, refs []string) (*Image, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	// check if image already exists
+	img := is.getImage(pulled.ID.String())
+	if img == nil {
+		img = &Image{
+			ID: pulled.ID.String(),
+		}
+	}
+	img.ManifestDigest = pulled.ManifestDigest.String()
+	img.RootFS = pulled.RootFS
+	img.Size = pulled.Size
+	img.Blobs = make([]string, 0, len(pulled.Blobs))
+	for _, b := range pulled.Blobs {
+		img.Blobs = append(img.Blobs, b.String())
+	}
+
+	for _, r := range refs {
+		if r != "" {
+			is.tagImage(r, img)
+		}
+	}
+	if err := is.putImage(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
 // RemoveImage removes the image.
 // This call is idempotent, and must not return an error if the image has
 // already been removed.
 func (is *ImageService) RemoveImage(ctx context.Context, req *cri.RemoveImageRequest) (*cri.RemoveImageResponse, error) {
-	klog.V(4).Infof("RemoveImage request %+v", req)
-
 	if req.Image == nil {
 		err := fmt.Errorf("invalid RemoveImageRequest, Image is nil")
-		klog.Errorf("RemoveImage request %v: %v", req, err)
 		return nil, err
 	}
-	imageName, imageTag, imageDigest := getImageNameTagAndDigest(req.Image.Image)
-	klog.V(4).Infof("RemoveImage: got %s to remove, key: %s tag: %s digest: %s", req.Image.Image, imageName, imageTag, imageDigest)
-	img := is.getImage(imageName)
-	if img != nil {
-		// case: image exists and has only one tag
-		if (len(img.Tags) == 1 && img.Tags[0] == imageTag) || len(img.Digests) == 1 && img.Digests[0] == imageDigest {
-			is.deleteImage(imageName)
-			resp := cri.RemoveImageResponse{}
-			klog.V(4).Infof("RemoveImage request %v: %v", req, resp)
-			return &resp, nil
-		}
-		// case: there are multiple tags for this image. Go over the tag list,
-		// remove one specified in request and update image entry
-		newTagList := removeFromSlice(imageTag, img.Tags)
-		newDigestsList := removeFromSlice(imageDigest, img.Digests)
-		img.Tags = newTagList
-		img.Digests = newDigestsList
-		klog.V(4).Infof("tags or digests list changed, updating with tags: %s, digests: %s", img.Tags, img.Digests)
-		err := is.putImage(imageName, img)
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	img, err := is.resolveImage(req.Image.Image)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		klog.Warningf("RemoveImage: unknown image %s", req.Image.Image)
+		return &cri.RemoveImageResponse{}, nil
+	}
+
+	// An image ID removes the image with all its references. A reference
+	// only removes itself, and the image with its digests once no tags are
+	// left, like docker rmi does.
+	removed := append(append([]string{}, img.RepoTags...), img.RepoDigests...)
+	if _, ok := parseImageID(req.Image.Image); !ok {
+		ref, err := parseImageReference(req.Image.Image)
 		if err != nil {
 			return nil, err
 		}
-		return &cri.RemoveImageResponse{}, nil
+		removed = []string{ref.tag, ref.digest}
+	}
+	klog.V(4).Infof("RemoveImage: got %s to remove, image %s references %v", req.Image.Image, img.ID, removed)
+	remainingTags := img.RepoTags
+	for _, r := range removed {
+		if r != "" && is.getRef(r) == img.ID {
+			remainingTags = removeFromSlice(r, remainingTags)
+		}
+	}
+	if len(remainingTags) == 0 && is.imageInUse(img) {
+		return nil, fmt.Errorf("image %s is in use by a container", req.Image.Image)
+	}
+	for _, r := range removed {
+		if r == "" || is.getRef(r) != img.ID {
+			continue
+		}
+		is.deleteRef(r)
+		img.RepoTags = removeFromSlice(r, img.RepoTags)
+		img.RepoDigests = removeFromSlice(r, img.RepoDigests)
+	}
 
+	if len(img.RepoTags) == 0 {
+		for _, r := range img.RepoDigests {
+			if is.getRef(r) == img.ID {
+				is.deleteRef(r)
+			}
+			removed = append(removed, r)
+		}
+		is.deleteImage(img.ID)
+		is.removeUnusedContent(img)
+	} else {
+		klog.V(4).Infof("tags or digests list changed, updating with tags: %s, digests: %s", img.RepoTags, img.RepoDigests)
+		if err := is.putImage(img); err != nil {
+			return nil, err
+		}
 	}
-	klog.Warningf("RemoveImage request %v: unknown image %s", req, imageName)
+	is.removeUnusedCredentials(removed)
 	return &cri.RemoveImageResponse{}, nil
 }
 
+// pull fetches an image from its registry, using the credentials from the
+// request, or the stored ones. If pulling is disabled, the image is
+// identified by the digest of its reference.
+func (is *ImageService) pull(ctx context.Context, hold *pullHold, ref *imageReference, req *cri.PullImageRequest) (*pulledImage, error) {
+	if is.puller == nil {
+		return &pulledImage{ID: unpulledImageID(ref)}, nil
+	}
+	auth := req.Auth
+	if auth == nil && is.credentialStore != nil {
+		var err error
+		auth, err = is.credentialStore.Get(ref.key)
+		if err != nil {
+			klog.Warningf("reading stored credentials for %s: %v", req.Image.Image, err)
+		}
+	}
+	namespace := req.GetSandboxConfig().GetMetadata().GetNamespace()
+	pulled, err := is.puller.Pull(ctx, hold, ref.named, auth, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("pulling image %s: %v", req.Image.Image, err)
+	}
+	if pulled.RootFS == "" {
+		klog.V(2).Infof("PullImage %s: no darwin payload, containers will run host binaries", req.Image.Image)
+	} else {
+		klog.V(2).Infof("PullImage %s: unpacked %s to %s", req.Image.Image, pulled.ID, pulled.RootFS)
+	}
+	return pulled, nil
+}
+
+// unpulledImageID returns the ID of an image that wasn't pulled: the digest of
+// its normalized reference, so each tag is an image of its own.
+func unpulledImageID(ref *imageReference) digest.Digest {
+	if ref.digest != "" {
+		return digest.FromString(ref.digest)
+	}
+	return digest.FromString(ref.tag)
+}
+
+// removeUnusedContent deletes the root filesystem and blobs of a removed
+// image, unless other images or pulls in progress still use them.
+func (is *ImageService) removeUnusedContent(removed *Image) {
+	if is.puller == nil || removed.ManifestDigest == "" {
+		return
+	}
+	inUse := make(map[string]bool)
+	for _, img := range is.listImages() {
+		inUse[img.ManifestDigest] = true
+		for _, b := range img.Blobs {
+			inUse[b] = true
+		}
+	}
+	unused := func(dgst string) bool {
+		return !inUse[dgst] && !is.puller.isHeld(digest.Digest(dgst))
+	}
+	store := is.puller.store
+	if unused(removed.ManifestDigest) && removed.RootFS != "" {
+		if err := store.RemoveRootFS(digest.Digest(removed.ManifestDigest)); err != nil {
+			klog.Errorf("removing root filesystem of %s: %v", removed.ID, err)
+		}
+	}
+	for _, b := range removed.Blobs {
+		if !unused(b) {
+			continue
+		}
+		if err := store.DeleteBlob(digest.Digest(b)); err != nil {
+			klog.Errorf("removing blob %s of %s: %v", b, removed.ID, err)
+		}
+	}
+}
+
+// removeUnusedCredentials deletes the stored credentials of the
+// repositories of removed references that no image uses anymore.
+func (is *ImageService) removeUnusedCredentials(removed []string) {
+	if is.credentialStore == nil {
+		return
+	}
+	for _, r := range removed {
+		ref, err := parseImageReference(r)
+		if err != nil || is.repositoryInUse(ref.name) {
+			continue
+		}
+		is.credentialStore.Delete(ref.key)
+	}
+}
+
+// ResolveImage returns the ID of an image, and the directory it is unpacked
+// to, which is empty for host images.
+func (is *ImageService) ResolveImage(image string) (string, string, error) {
+	img, err := is.resolveImage(image)
+	if err != nil {
+		return "", "", err
+	}
+	if img == nil {
+		return "", "", fmt.Errorf("image %s not found", image)
+	}
+	return img.ID, img.RootFS, nil
+}
+
+// ImageConfig returns the execution parameters of an image, e.g. its
+// entrypoint, or nil if it has none, like host images and artifacts.
+func (is *ImageService) ImageConfig(image string) (*specs.ImageConfig, error) {
+	img, err := is.resolveImage(image)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("image %s not found", image)
+	}
+	// Blobs of images with a payload are the manifest, the config and the
+	// layers.
+	if is.puller == nil || img.RootFS == "" || len(img.Blobs) < 2 {
+		return nil, nil
+	}
+	buf, err := is.puller.store.ReadBlob(digest.Digest(img.Blobs[1]))
+	if err != nil {
+		return nil, fmt.Errorf("reading config of image %s: %v", image, err)
+	}
+	config := specs.Image{}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		klog.V(4).Infof("config of image %s is not an image config: %v", image, err)
+		return nil, nil
+	}
+	return &config.Config, nil
+}
+
 // ImageFSInfo returns information of the filesystem that is used to store
 // images.
 func (is *ImageService) ImageFsInfo(ctx context.Context, req *cri.ImageFsInfoRequest) (*cri.ImageFsInfoResponse, error) {
-	klog.V(4).Infof("ImageFsInfo request %+v", req)
-
+	root := is.dataStore.BasePath
+	if is.puller != nil {
+		root = is.puller.store.Root()
+	}
+	bytes, inodes, err := imagestore.Usage(root)
+	if err != nil {
+		return nil, fmt.Errorf("measuring image filesystem usage: %v", err)
+	}
 	fu := cri.FilesystemUsage{
 		Timestamp: time.Now().UnixNano(),
 		FsId: &cri.FilesystemIdentifier{
-			Mountpoint: "/",
+			Mountpoint: root,
 		},
 		UsedBytes: &cri.UInt64Value{
-			Value: 0,
+			Value: bytes,
 		},
 		InodesUsed: &cri.UInt64Value{
-			Value: 0,
+			Value: inodes,
 		},
 	}
 
@@ -317,22 +714,47 @@ func (is *ImageService) ImageFsInfo(ctx context.Context, req *cri.ImageFsInfoReq
 		},
 	}
 
-	klog.V(4).Infof("ImageFsInfo request %v: %v", req, resp)
 	return &resp, nil
 }
 
-func getImageNameTagAndDigest(image string) (string, string, string) {
-	defaultTag := ":latest"
-	if strings.Contains(image, "@sha256") {
-		imageParts := strings.Split(image, "@")
-		return makeImgKey(imageParts[0]), "", image
+// imageReference is a parsed and normalized image reference.
+type imageReference struct {
+	named reference.Named
+	// Key of the image record.
+	key string
+	// Repository name, e.g. "docker.io/library/nginx".
+	name string
+	// Tag reference, e.g. "docker.io/library/nginx:latest". Empty if the
+	// reference only has a digest.
+	tag string
+	// Digest reference, e.g. "docker.io/library/nginx@sha256:...", if any.
+	digest string
+}
+
+// parseImageReference parses an image reference and normalizes it the way
+// Docker does, so that e.g. "nginx", "nginx:latest" and
+// "docker.io/library/nginx:latest" refer to the same image, and
+// "registry:5000/app" is the repository "app" on "registry:5000".
+func parseImageReference(image string) (*imageReference, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %v", image, err)
+	}
+	ref := &imageReference{
+		named: named,
+		key:   makeImgKey(named.Name()),
+		name:  named.Name(),
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		ref.digest = named.Name() + "@" + canonical.Digest().String()
 	}
-	imageParts := strings.Split(image, ":")
-	if len(imageParts) > 1 {
-		imageName := imageParts[0]
-		return makeImgKey(imageName), image, ""
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.tag = named.Name() + ":" + tagged.Tag()
+	} else if ref.digest == "" {
+		ref.named = reference.TagNameOnly(named)
+		ref.tag = ref.named.String()
 	}
-	return makeImgKey(imageParts[0]), imageParts[0] + defaultTag, ""
+	return ref, nil
 }
 
 func makeImgKey(imgName string) string {
@@ -349,23 +771,19 @@ func addToSliceWithoutDuplicate(item string, slice []string) []string {
 	}
 	for _, i := range slice {
 		if i == item {
-			klog.V(4).Infof("item %s == %s", i, item)
 			return slice
 		}
 	}
 	slice = append(slice, item)
-	klog.V(4).Infof("added item: %s to slice: %v", item, slice)
 	return slice
 }
 
 func removeFromSlice(item string, slice []string) []string {
 	var updatedSlice []string
-	klog.V(4).Infof("trying to remove %s from %s", item, slice)
 	for _, i := range slice {
 		if i != item {
 			updatedSlice = append(updatedSlice, i)
 		}
 	}
-	klog.V(4).Infof("updated slice: %s", updatedSlice)
 	return updatedSlice
 }
@@ -0,0 +1,203 @@
+package imageservice
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/peterbourgon/diskv"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+
+	"github.com/elotl/procri/pkg/klogtest"
+)
+
+func newTestImageService(t *testing.T) *ImageService {
+	dataStore := diskv.New(diskv.Options{BasePath: t.TempDir()})
+	is, err := NewImageService(dataStore, nil, nil)
+	assert.NoError(t, err)
+	return is
+}
+
+func TestPullImageDoesNotLogCredentials(t *testing.T) {
+	is := newTestImageService(t)
+	secret := "hunter2-registry-secret"
+
+	logs := klogtest.Capture(t, func() {
+		_, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+			Image: &cri.ImageSpec{Image: "registry.example.com/app:v1"},
+			Auth: &cri.AuthConfig{
+				Username:      "robot",
+				Password:      secret,
+				Auth:          secret,
+				IdentityToken: secret,
+				RegistryToken: secret,
+			},
+		})
+		assert.NoError(t, err)
+	})
+
+	assert.Contains(t, logs, "PullImage")
+	assert.NotContains(t, logs, secret)
+}
+
+func TestParseImageReference(t *testing.T) {
+	testCases := []struct {
+		image  string
+		name   string
+		tag    string
+		digest string
+	}{
+		{
+			image: "nginx",
+			name:  "docker.io/library/nginx",
+			tag:   "docker.io/library/nginx:latest",
+		},
+		{
+			image: "docker.io/library/nginx:latest",
+			name:  "docker.io/library/nginx",
+			tag:   "docker.io/library/nginx:latest",
+		},
+		{
+			image: "registry:5000/app",
+			name:  "registry:5000/app",
+			tag:   "registry:5000/app:latest",
+		},
+		{
+			image: "registry:5000/team/app:v1",
+			name:  "registry:5000/team/app",
+			tag:   "registry:5000/team/app:v1",
+		},
+		{
+			image:  "nginx@sha256:" + strings.Repeat("a", 64),
+			name:   "docker.io/library/nginx",
+			digest: "docker.io/library/nginx@sha256:" + strings.Repeat("a", 64),
+		},
+		{
+			image:  "elotl/app:1.0@sha256:" + strings.Repeat("b", 64),
+			name:   "docker.io/elotl/app",
+			tag:    "docker.io/elotl/app:1.0",
+			digest: "docker.io/elotl/app@sha256:" + strings.Repeat("b", 64),
+		},
+	}
+	for _, tc := range testCases {
+		ref, err := parseImageReference(tc.image)
+		assert.NoError(t, err, tc.image)
+		assert.Equal(t, tc.name, ref.name, tc.image)
+		assert.Equal(t, makeImgKey(tc.name), ref.key, tc.image)
+		assert.Equal(t, tc.tag, ref.tag, tc.image)
+		assert.Equal(t, tc.digest, ref.digest, tc.image)
+	}
+
+	for _, image := range []string{"", "UPPER/case", "nginx:bad tag", "nginx@sha256:short"} {
+		_, err := parseImageReference(image)
+		assert.Error(t, err, image)
+	}
+}
+
+func TestImageAliasesResolveToOneRecord(t *testing.T) {
+	is := newTestImageService(t)
+	ctx := context.Background()
+
+	for _, image := range []string{"nginx", "docker.io/library/nginx:latest", "library/nginx:1.19"} {
+		_, err := is.PullImage(ctx, &cri.PullImageRequest{Image: &cri.ImageSpec{Image: image}})
+		assert.NoError(t, err, image)
+	}
+	// Without pulling, each tag is an image of its own.
+	list, err := is.ListImages(ctx, &cri.ListImagesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, list.Images, 2)
+
+	for _, image := range []string{"nginx", "nginx:latest", "docker.io/library/nginx:1.19"} {
+		status, err := is.ImageStatus(ctx, &cri.ImageStatusRequest{Image: &cri.ImageSpec{Image: image}})
+		assert.NoError(t, err, image)
+		assert.NotNil(t, status.Image, image)
+		filtered, err := is.ListImages(ctx, &cri.ListImagesRequest{
+			Filter: &cri.ImageFilter{Image: &cri.ImageSpec{Image: image}},
+		})
+		assert.NoError(t, err, image)
+		assert.Len(t, filtered.Images, 1, image)
+	}
+	latest, err := is.ImageStatus(ctx, &cri.ImageStatusRequest{Image: &cri.ImageSpec{Image: "nginx"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/library/nginx:latest"}, latest.Image.RepoTags)
+	assert.Equal(t, digest.FromString("docker.io/library/nginx:latest").String(), latest.Image.Id)
+
+	// Removing one tag leaves the others alone.
+	_, err = is.RemoveImage(ctx, &cri.RemoveImageRequest{Image: &cri.ImageSpec{Image: latest.Image.Id}})
+	assert.NoError(t, err)
+	status, err := is.ImageStatus(ctx, &cri.ImageStatusRequest{Image: &cri.ImageSpec{Image: "nginx:1.19"}})
+	assert.NoError(t, err)
+	if assert.NotNil(t, status.Image) {
+		assert.Equal(t, []string{"docker.io/library/nginx:1.19"}, status.Image.RepoTags)
+	}
+
+	_, err = is.RemoveImage(ctx, &cri.RemoveImageRequest{Image: &cri.ImageSpec{Image: "library/nginx:1.19"}})
+	assert.NoError(t, err)
+	list, err = is.ListImages(ctx, &cri.ListImagesRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, list.Images)
+}
+
+type fakeImageUsers []string
+
+func (f fakeImageUsers) ImagesInUse() []string {
+	return f
+}
+
+func TestRemoveImageInUse(t *testing.T) {
+	is := newTestImageService(t)
+	ctx := context.Background()
+	for _, image := range []string{"nginx:1.19", "nginx:1.20"} {
+		_, err := is.PullImage(ctx, &cri.PullImageRequest{Image: &cri.ImageSpec{Image: image}})
+		assert.NoError(t, err, image)
+	}
+	is.SetImageUsers(fakeImageUsers{"nginx:1.19"})
+
+	_, err := is.RemoveImage(ctx, &cri.RemoveImageRequest{Image: &cri.ImageSpec{Image: "nginx:1.20"}})
+	assert.NoError(t, err, "other tags are left")
+	_, err = is.RemoveImage(ctx, &cri.RemoveImageRequest{Image: &cri.ImageSpec{Image: "nginx:1.19"}})
+	assert.Error(t, err)
+	status, err := is.ImageStatus(ctx, &cri.ImageStatusRequest{Image: &cri.ImageSpec{Image: "nginx:1.19"}})
+	assert.NoError(t, err)
+	assert.NotNil(t, status.Image)
+
+	is.SetImageUsers(fakeImageUsers{})
+	_, err = is.RemoveImage(ctx, &cri.RemoveImageRequest{Image: &cri.ImageSpec{Image: status.Image.Id}})
+	assert.NoError(t, err)
+}
+
+func TestMigrateLegacyImages(t *testing.T) {
+	dataStore := diskv.New(diskv.Options{BasePath: t.TempDir()})
+	for _, img := range []legacyImage{
+		{Image: "nginx", Tags: []string{"nginx:latest"}},
+		{Image: "docker.io/library/nginx:1.19", Tags: []string{"docker.io/library/nginx:1.19"}},
+		{Image: "registry:5000/app", Tags: []string{"registry:5000/app"}},
+	} {
+		buf, err := json.Marshal(img)
+		assert.NoError(t, err)
+		// Keys of older versions.
+		assert.NoError(t, dataStore.Write(makeImgKey(img.Image), buf))
+	}
+
+	is, err := NewImageService(dataStore, nil, nil)
+	assert.NoError(t, err)
+	images := is.listImages()
+	assert.Len(t, images, 3)
+	nginx, err := is.resolveImage("nginx:1.19")
+	assert.NoError(t, err)
+	if assert.NotNil(t, nginx) {
+		assert.Equal(t, digest.FromString("docker.io/library/nginx:1.19").String(), nginx.ID)
+		assert.Equal(t, []string{"docker.io/library/nginx:1.19"}, nginx.RepoTags)
+	}
+	app, err := is.resolveImage("registry:5000/app")
+	assert.NoError(t, err)
+	if assert.NotNil(t, app) {
+		assert.Equal(t, []string{"registry:5000/app:latest"}, app.RepoTags)
+	}
+	for key := range dataStore.Keys(nil) {
+		assert.False(t, isLegacyKey(key), key)
+	}
+}
@@ -0,0 +1,178 @@
+package imageservice
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/elotl/procri/pkg/imagestore"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+// legacyImage is an image record of older versions of procri, stored under
+// the hash of the image name instead of the image ID.
+type legacyImage struct {
+	Image          string   `json:"image"`
+	Tags           []string `json:"Tags"`
+	Digests        []string `json:"Digests"`
+	ManifestDigest string   `json:"manifestDigest"`
+	RootFS         string   `json:"rootfs"`
+	Blobs          []string `json:"blobs"`
+	legacyCredentials
+}
+
+// legacyCredentials are the registry credentials older versions of procri
+// stored in plain text in image records.
+type legacyCredentials struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	ServerAddress string `json:"serverAddress"`
+	IdentityToken string `json:"identityToken"`
+	RegistryToken string `json:"registryToken"`
+}
+
+func isLegacyKey(key string) bool {
+	return !strings.HasPrefix(key, imagePrefix) && !strings.HasPrefix(key, refPrefix)
+}
+
+func (is *ImageService) getLegacyImage(key string) *legacyImage {
+	buf, err := is.dataStore.Read(key)
+	if err != nil {
+		klog.Errorf("reading image %s: %v", key, err)
+		return nil
+	}
+	img := legacyImage{}
+	if err := json.Unmarshal(buf, &img); err != nil {
+		klog.Errorf("deserializing image data for %s: %v", key, err)
+		return nil
+	}
+	return &img
+}
+
+// migrateLegacyImages converts image records of older versions of procri.
+// Plain text credentials are dropped, or moved to the credential store if
+// there is one, references are normalized and records are keyed by image ID,
+// with a reference record for each tag and digest.
+func (is *ImageService) migrateLegacyImages() {
+	migrated := 0
+	for key := range is.dataStore.Keys(nil) {
+		if !isLegacyKey(key) {
+			continue
+		}
+		legacy := is.getLegacyImage(key)
+		if legacy == nil {
+			continue
+		}
+		ref, err := parseImageReference(legacy.Image)
+		if err != nil {
+			klog.Warningf("dropping image %s: %v", legacy.Image, err)
+			is.deleteLegacyImage(key)
+			continue
+		}
+		is.migrateCredentials(ref, &legacy.legacyCredentials)
+
+		// Older versions only kept blobs of pulled images, with the config
+		// second. Other images were recorded per repository, their tags
+		// become images of their own, as when pulling is disabled.
+		var pulled *Image
+		images := make([]*Image, 0, 1)
+		if len(legacy.Blobs) > 1 {
+			pulled = is.getImage(legacy.Blobs[1])
+			if pulled == nil {
+				pulled = &Image{
+					ID:             legacy.Blobs[1],
+					ManifestDigest: legacy.ManifestDigest,
+					RootFS:         legacy.RootFS,
+					Blobs:          legacy.Blobs,
+				}
+			}
+			images = append(images, pulled)
+		}
+		for _, r := range append(legacy.Tags, legacy.Digests...) {
+			parsed, err := parseImageReference(r)
+			if err != nil {
+				klog.Warningf("dropping invalid reference %q of image %s: %v", r, legacy.Image, err)
+				continue
+			}
+			img := pulled
+			if img == nil {
+				id := unpulledImageID(parsed).String()
+				if img = is.getImage(id); img == nil {
+					img = &Image{ID: id}
+				}
+			}
+			for _, normalized := range []string{parsed.tag, parsed.digest} {
+				if normalized != "" {
+					is.tagImage(normalized, img)
+				}
+			}
+			if len(images) == 0 || images[len(images)-1] != img {
+				images = append(images, img)
+			}
+		}
+		failed := false
+		for _, img := range images {
+			if err := is.putImage(img); err != nil {
+				klog.Errorf("migrating image %s: %v", legacy.Image, err)
+				failed = true
+			}
+		}
+		if failed {
+			continue
+		}
+		is.deleteLegacyImage(key)
+		migrated++
+	}
+	if migrated > 0 {
+		klog.Infof("migrated %d image records", migrated)
+	}
+}
+
+// measureImages records the size of images pulled by older versions of
+// procri, which did not measure their root filesystems.
+func (is *ImageService) measureImages() {
+	for _, img := range is.listImages() {
+		if img.RootFS == "" || img.Size != 0 {
+			continue
+		}
+		size, _, err := imagestore.Usage(img.RootFS)
+		if err != nil {
+			klog.Warningf("measuring image %s: %v", img.ID, err)
+			continue
+		}
+		img.Size = size
+		if err := is.putImage(img); err != nil {
+			klog.Errorf("recording size of image %s: %v", img.ID, err)
+		}
+	}
+}
+
+// migrateCredentials moves plain text credentials of a legacy record to the
+// credential store, if there is one.
+func (is *ImageService) migrateCredentials(ref *imageReference, legacy *legacyCredentials) {
+	auth := &cri.AuthConfig{
+		Username:      legacy.Username,
+		Password:      legacy.Password,
+		Auth:          legacy.Auth,
+		ServerAddress: legacy.ServerAddress,
+		IdentityToken: legacy.IdentityToken,
+		RegistryToken: legacy.RegistryToken,
+	}
+	if auth.Password == "" && auth.Auth == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		return
+	}
+	if is.credentialStore == nil {
+		klog.Infof("removing plain text registry credentials of %s", ref.name)
+		return
+	}
+	if err := is.credentialStore.Put(ref.key, auth); err != nil {
+		klog.Errorf("migrating credentials of image %s: %v", ref.name, err)
+	}
+}
+
+func (is *ImageService) deleteLegacyImage(key string) {
+	if err := is.dataStore.Erase(key); err != nil {
+		klog.Errorf("deleting image %s: %v", key, err)
+	}
+}
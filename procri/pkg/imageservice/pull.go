@@ -0,0 +1,332 @@
+package imageservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/elotl/procri/pkg/imagepolicy"
+	"github.com/elotl/procri/pkg/imagestore"
+	"github.com/elotl/procri/pkg/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+const (
+	mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer  = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// errNoDarwinPayload is returned when an image has nothing procri can run,
+// e.g. because it only has Linux variants. Such images are recorded as host
+// images, whose containers run binaries from the host.
+var errNoDarwinPayload = errors.New("image has no darwin payload")
+
+// Puller fetches images and artifacts from registries into the image store.
+type Puller struct {
+	client *registry.Client
+	store  *imagestore.Store
+	// Verifies images before they are downloaded. Nil if all images are
+	// accepted.
+	policy *imagepolicy.Policy
+	// Limits the number of concurrent pulls. Nil if unlimited.
+	slots chan struct{}
+
+	// heldMu guards held, the number of pulls in progress using each blob
+	// and root filesystem, by digest, which are kept from removal until the
+	// pulls recorded their image.
+	heldMu sync.Mutex
+	held   map[digest.Digest]int
+}
+
+// NewPuller returns a Puller running at most maxConcurrentPulls pulls at a
+// time, or any number if maxConcurrentPulls is not positive. If policy is not
+// nil, images it rejects are not pulled.
+func NewPuller(client *registry.Client, store *imagestore.Store, policy *imagepolicy.Policy, maxConcurrentPulls int) *Puller {
+	p := &Puller{
+		client: client,
+		store:  store,
+		policy: policy,
+		held:   make(map[digest.Digest]int),
+	}
+	if maxConcurrentPulls > 0 {
+		p.slots = make(chan struct{}, maxConcurrentPulls)
+	}
+	return p
+}
+
+// pullHold keeps the content a pull uses from being removed, until it is
+// released once the image is recorded.
+type pullHold struct {
+	p       *Puller
+	digests []digest.Digest
+}
+
+func (p *Puller) newHold() *pullHold {
+	return &pullHold{p: p}
+}
+
+func (h *pullHold) add(dgst digest.Digest) {
+	h.p.heldMu.Lock()
+	defer h.p.heldMu.Unlock()
+	h.p.held[dgst]++
+	h.digests = append(h.digests, dgst)
+}
+
+func (h *pullHold) release() {
+	h.p.heldMu.Lock()
+	defer h.p.heldMu.Unlock()
+	for _, dgst := range h.digests {
+		if h.p.held[dgst]--; h.p.held[dgst] <= 0 {
+			delete(h.p.held, dgst)
+		}
+	}
+	h.digests = nil
+}
+
+// isHeld reports whether a pull in progress uses the blob or root filesystem
+// dgst.
+func (p *Puller) isHeld(dgst digest.Digest) bool {
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+	return p.held[dgst] > 0
+}
+
+// pulledImage describes an image in the store.
+type pulledImage struct {
+	// Image ID: the config digest, or RepoDigest for host images.
+	ID digest.Digest
+	// Digest of the manifest or index the reference resolved to.
+	RepoDigest digest.Digest
+	// Manifest of the darwin variant. Empty for host images.
+	ManifestDigest digest.Digest
+	RootFS         string
+	// Bytes used by RootFS.
+	Size uint64
+	// Manifest, config and layers.
+	Blobs []digest.Digest
+}
+
+// Pull fetches the manifest of named, checks it against the policy for pods
+// in namespace, selects the darwin variant, downloads and verifies its blobs
+// and unpacks the layers. Images without a darwin variant are returned
+// without a root filesystem. What the image uses is added to hold.
+func (p *Puller) Pull(ctx context.Context, hold *pullHold, named reference.Named, auth *cri.AuthConfig, namespace string) (*pulledImage, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+			defer func() { <-p.slots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return p.pull(ctx, hold, named, auth, namespace)
+}
+
+// source is where images are fetched from: a registry repository, or an
+// image archive.
+type source interface {
+	// Manifest returns the manifest or index ref, a tag or digest, with its
+	// media type and digest.
+	Manifest(ctx context.Context, ref string) ([]byte, string, digest.Digest, error)
+	// Blob opens the blob with digest dgst.
+	Blob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error)
+}
+
+func (p *Puller) pull(ctx context.Context, hold *pullHold, named reference.Named, auth *cri.AuthConfig, namespace string) (*pulledImage, error) {
+	repo := p.client.Repository(named, auth)
+	ref := "latest"
+	if canonical, ok := named.(reference.Canonical); ok {
+		ref = canonical.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+
+	buf, mediaType, dgst, err := repo.Manifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if p.policy != nil {
+		if err := p.policy.Verify(ctx, repo, named.Name(), namespace, dgst); err != nil {
+			return nil, err
+		}
+	}
+	klog.V(4).Infof("pulling %s manifest %s", named, dgst)
+	return p.fetch(ctx, hold, repo, buf, mediaType, dgst)
+}
+
+// fetch downloads the image with manifest or index buf from src into the
+// store, and unpacks it. Blobs are added to hold before they are looked up in
+// the store, so they can't be removed in between.
+func (p *Puller) fetch(ctx context.Context, hold *pullHold, src source, buf []byte, mediaType string, dgst digest.Digest) (*pulledImage, error) {
+	var err error
+	hold.add(dgst)
+	host := &pulledImage{ID: dgst, RepoDigest: dgst}
+	if mediaType == specs.MediaTypeImageIndex || mediaType == registry.MediaTypeDockerManifestList {
+		index := specs.Index{}
+		if err := json.Unmarshal(buf, &index); err != nil {
+			return nil, fmt.Errorf("parsing image index %s: %v", dgst, err)
+		}
+		desc, err := selectManifest(index.Manifests)
+		if err == errNoDarwinPayload {
+			return host, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf, mediaType, dgst, err = src.Manifest(ctx, desc.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		hold.add(dgst)
+	}
+	if mediaType != specs.MediaTypeImageManifest && mediaType != registry.MediaTypeDockerManifest {
+		return nil, fmt.Errorf("unsupported manifest media type %q", mediaType)
+	}
+	manifest := specs.Manifest{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %v", dgst, err)
+	}
+	klog.V(4).Infof("fetching manifest %s with %d layers", dgst, len(manifest.Layers))
+
+	hold.add(manifest.Config.Digest)
+	if err := p.fetchBlob(ctx, src, manifest.Config); err != nil {
+		return nil, err
+	}
+	err = p.checkConfig(manifest.Config)
+	if err == errNoDarwinPayload {
+		return host, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]digest.Digest, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		if !isLayerMediaType(layer.MediaType) {
+			return nil, fmt.Errorf("layer %s has unsupported media type %q", layer.Digest, layer.MediaType)
+		}
+		hold.add(layer.Digest)
+		if err := p.fetchBlob(ctx, src, layer); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer.Digest)
+	}
+	if err := p.store.WriteBlob(dgst, bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+
+	rootfs, err := p.store.Unpack(dgst, layers)
+	if err != nil {
+		return nil, err
+	}
+	size, _, err := imagestore.Usage(rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("measuring %s: %v", rootfs, err)
+	}
+	blobs := append([]digest.Digest{dgst, manifest.Config.Digest}, layers...)
+	return &pulledImage{
+		ID:             manifest.Config.Digest,
+		RepoDigest:     host.RepoDigest,
+		ManifestDigest: dgst,
+		RootFS:         rootfs,
+		Size:           size,
+		Blobs:          blobs,
+	}, nil
+}
+
+// selectManifest picks the manifest for this host from an index. On arm64,
+// amd64 binaries are accepted too, since they run under Rosetta.
+func selectManifest(manifests []specs.Descriptor) (*specs.Descriptor, error) {
+	var fallback *specs.Descriptor
+	for i := range manifests {
+		platform := manifests[i].Platform
+		if platform == nil || platform.OS != "darwin" {
+			continue
+		}
+		if platform.Architecture == runtime.GOARCH {
+			return &manifests[i], nil
+		}
+		if runtime.GOARCH == "arm64" && platform.Architecture == "amd64" && fallback == nil {
+			fallback = &manifests[i]
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, errNoDarwinPayload
+}
+
+// checkConfig makes sure an image is built for darwin. Artifacts, which have
+// a config of another media type, are assumed to carry a darwin payload.
+func (p *Puller) checkConfig(desc specs.Descriptor) error {
+	if desc.MediaType != specs.MediaTypeImageConfig && desc.MediaType != mediaTypeDockerConfig {
+		return nil
+	}
+	buf, err := p.store.ReadBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	config := specs.Image{}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return fmt.Errorf("parsing image config %s: %v", desc.Digest, err)
+	}
+	if config.OS != "darwin" {
+		return errNoDarwinPayload
+	}
+	return nil
+}
+
+func isLayerMediaType(mediaType string) bool {
+	switch mediaType {
+	case specs.MediaTypeImageLayer, specs.MediaTypeImageLayerGzip, mediaTypeDockerLayer:
+		return true
+	}
+	// Artifacts use their own media types, e.g.
+	// application/vnd.example.app.layer.v1.tar+gzip.
+	return strings.HasSuffix(mediaType, ".tar") || strings.HasSuffix(mediaType, ".tar+gzip")
+}
+
+func (p *Puller) fetchBlob(ctx context.Context, src source, desc specs.Descriptor) error {
+	if p.store.HasBlob(desc.Digest) {
+		return nil
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid blob digest %q: %v", desc.Digest, err)
+	}
+	if desc.Size < 0 {
+		return fmt.Errorf("invalid size %d of blob %s", desc.Size, desc.Digest)
+	}
+	body, err := src.Blob(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// The digest is only checked at the end, the size bounds what a broken
+	// source can write to the store until then.
+	r := &countingReader{r: io.LimitReader(body, desc.Size+1)}
+	err = p.store.WriteBlob(desc.Digest, r)
+	if r.n > desc.Size {
+		return fmt.Errorf("blob %s is larger than the %d bytes of its descriptor", desc.Digest, desc.Size)
+	}
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,602 @@
+package imageservice
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/elotl/procri/pkg/imagepolicy"
+	"github.com/elotl/procri/pkg/imagestore"
+	"github.com/elotl/procri/pkg/registry"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/peterbourgon/diskv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// testRegistry is an in-process stand-in for a registry. If user is set,
+// it requires a bearer token, which it hands out for basic auth with user and
+// password. If tokenUses is set, a token expires after that many requests.
+// If beforeBlob is set, it is called before a blob is served.
+type testRegistry struct {
+	*httptest.Server
+	manifests  map[string][]byte
+	blobs      map[digest.Digest][]byte
+	user       string
+	password   string
+	tokenUses  int
+	beforeBlob func(digest.Digest)
+
+	tokens int
+	uses   int
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		user, password, _ := req.BasicAuth()
+		if user != r.user || password != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.tokens++
+		r.uses = 0
+		fmt.Fprintf(w, `{"token": "test-token-%d"}`, r.tokens)
+		return
+	}
+	if r.user != "" {
+		token := fmt.Sprintf("Bearer test-token-%d", r.tokens)
+		expired := r.tokenUses > 0 && r.uses >= r.tokenUses
+		if req.Header.Get("Authorization") != token || expired {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.uses++
+	}
+	parts := strings.Split(req.URL.Path, "/")
+	ref := parts[len(parts)-1]
+	switch parts[len(parts)-2] {
+	case "manifests":
+		buf, ok := r.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		_ = json.Unmarshal(buf, &versioned)
+		w.Header().Set("Content-Type", versioned.MediaType)
+		_, _ = w.Write(buf)
+	case "blobs":
+		buf, ok := r.blobs[digest.Digest(ref)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.beforeBlob != nil {
+			r.beforeBlob(digest.Digest(ref))
+		}
+		_, _ = w.Write(buf)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) addBlob(t *testing.T, mediaType string, buf []byte) specs.Descriptor {
+	dgst := digest.FromBytes(buf)
+	r.blobs[dgst] = buf
+	return specs.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(buf))}
+}
+
+func (r *testRegistry) addJSON(t *testing.T, mediaType string, v interface{}) specs.Descriptor {
+	buf, err := json.Marshal(v)
+	require.NoError(t, err)
+	return r.addBlob(t, mediaType, buf)
+}
+
+// addImage adds an image for os with the given layers, and returns the
+// descriptor of its manifest.
+func (r *testRegistry) addImage(t *testing.T, os string, layers ...[]byte) specs.Descriptor {
+	image := specs.Image{OS: os, Architecture: runtime.GOARCH}
+	image.RootFS.Type = "layers"
+	for _, layer := range layers {
+		image.RootFS.DiffIDs = append(image.RootFS.DiffIDs, digest.FromBytes(layer))
+	}
+	config := r.addJSON(t, specs.MediaTypeImageConfig, image)
+	manifest := struct {
+		MediaType string `json:"mediaType"`
+		specs.Manifest
+	}{
+		MediaType: specs.MediaTypeImageManifest,
+		Manifest:  specs.Manifest{Config: config},
+	}
+	manifest.SchemaVersion = 2
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, r.addBlob(t, specs.MediaTypeImageLayerGzip, layer))
+	}
+	desc := r.addJSON(t, specs.MediaTypeImageManifest, manifest)
+	r.manifests[desc.Digest.String()] = r.blobs[desc.Digest]
+	return desc
+}
+
+func (r *testRegistry) tagIndex(t *testing.T, tag string, manifests map[string]specs.Descriptor) {
+	index := struct {
+		MediaType string `json:"mediaType"`
+		specs.Index
+	}{
+		MediaType: specs.MediaTypeImageIndex,
+	}
+	index.SchemaVersion = 2
+	for os, desc := range manifests {
+		desc.Platform = &specs.Platform{OS: os, Architecture: runtime.GOARCH}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	desc := r.addJSON(t, specs.MediaTypeImageIndex, index)
+	r.manifests[tag] = r.blobs[desc.Digest]
+}
+
+type tarEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+}
+
+func makeLayer(t *testing.T, entries ...tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0755, Size: int64(len(e.content)), Typeflag: e.typeflag, Linkname: e.linkname}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func newPullingImageService(t *testing.T, reg *testRegistry) (*ImageService, *imagestore.Store) {
+	dir := t.TempDir()
+	store, err := imagestore.New(filepath.Join(dir, "images"))
+	require.NoError(t, err)
+	puller := NewPuller(registry.NewClient([]string{reg.host()}), store, nil, 0)
+	dataStore := diskv.New(diskv.Options{BasePath: filepath.Join(dir, "imageservice")})
+	is, err := NewImageService(dataStore, nil, puller)
+	require.NoError(t, err)
+	return is, store
+}
+
+func TestPullImage(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.user, reg.password = "robot", "hunter2"
+	linux := reg.addImage(t, "linux", makeLayer(t, tarEntry{name: "bin/hello", content: "linux"}))
+	darwin := reg.addImage(t, "darwin",
+		makeLayer(t,
+			tarEntry{name: "bin/", typeflag: tar.TypeDir},
+			tarEntry{name: "bin/hello", content: "darwin"},
+			tarEntry{name: "etc/old.conf", content: "old"},
+		),
+		makeLayer(t,
+			tarEntry{name: "etc/.wh.old.conf"},
+			tarEntry{name: "etc/new.conf", content: "new"},
+			tarEntry{name: "bin/hi", typeflag: tar.TypeSymlink, linkname: "/bin/hello"},
+		),
+	)
+	reg.tagIndex(t, "v1", map[string]specs.Descriptor{"linux": linux, "darwin": darwin})
+	is, store := newPullingImageService(t, reg)
+	image := reg.host() + "/app:v1"
+
+	_, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+		Image: &cri.ImageSpec{Image: image},
+	})
+	assert.Error(t, err, "pull without credentials")
+
+	resp, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+		Image: &cri.ImageSpec{Image: image},
+		Auth:  &cri.AuthConfig{Username: "robot", Password: "hunter2"},
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.ImageRef)
+
+	id, root, err := is.ResolveImage(image)
+	require.NoError(t, err)
+	assert.Equal(t, resp.ImageRef, id)
+	assert.Equal(t, store.RootFSPath(darwin.Digest), root)
+	config, err := is.ImageConfig(id)
+	require.NoError(t, err)
+	assert.NotNil(t, config)
+	buf, err := ioutil.ReadFile(filepath.Join(root, "bin/hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "darwin", string(buf))
+	assertNotExist(t, filepath.Join(root, "etc/old.conf"))
+	assert.FileExists(t, filepath.Join(root, "etc/new.conf"))
+	assert.True(t, store.HasBlob(darwin.Digest))
+	assert.False(t, store.HasBlob(linux.Digest))
+
+	status, err := is.ImageStatus(context.Background(), &cri.ImageStatusRequest{
+		Image: &cri.ImageSpec{Image: image},
+	})
+	require.NoError(t, err)
+	assert.True(t, status.Image.Size_ > 1, "unpacked size is reported")
+	fsInfo, err := is.ImageFsInfo(context.Background(), &cri.ImageFsInfoRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, store.Root(), fsInfo.ImageFilesystems[0].FsId.Mountpoint)
+	assert.True(t, fsInfo.ImageFilesystems[0].UsedBytes.Value >= status.Image.Size_)
+	assert.NotZero(t, fsInfo.ImageFilesystems[0].InodesUsed.Value)
+
+	_, err = is.RemoveImage(context.Background(), &cri.RemoveImageRequest{
+		Image: &cri.ImageSpec{Image: image},
+	})
+	require.NoError(t, err)
+	assertNotExist(t, root)
+	assert.False(t, store.HasBlob(darwin.Digest))
+}
+
+func TestPullImageWithoutDarwinPayload(t *testing.T) {
+	reg := newTestRegistry(t)
+	linux := reg.addImage(t, "linux", makeLayer(t, tarEntry{name: "bin/hello", content: "linux"}))
+	reg.tagIndex(t, "v1", map[string]specs.Descriptor{"linux": linux})
+	reg.manifests["single"] = reg.blobs[linux.Digest]
+	is, _ := newPullingImageService(t, reg)
+
+	for _, image := range []string{reg.host() + "/app:v1", reg.host() + "/other:single"} {
+		_, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+			Image: &cri.ImageSpec{Image: image},
+		})
+		require.NoError(t, err)
+		_, root, err := is.ResolveImage(image)
+		assert.NoError(t, err)
+		assert.Empty(t, root, "host image")
+		config, err := is.ImageConfig(image)
+		assert.NoError(t, err)
+		assert.Nil(t, config, "host image")
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	manifest := func(os, arch string) specs.Descriptor {
+		return specs.Descriptor{
+			Digest:   digest.FromString(os + "/" + arch),
+			Platform: &specs.Platform{OS: os, Architecture: arch},
+		}
+	}
+	other := "arm64"
+	if runtime.GOARCH == "arm64" {
+		other = "ppc64le"
+	}
+	// Rosetta runs amd64 binaries on arm64.
+	amd64 := ""
+	if runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" {
+		amd64 = "darwin/amd64"
+	}
+	testCases := []struct {
+		name      string
+		manifests []specs.Descriptor
+		selected  string
+	}{
+		{
+			name:      "darwin for this architecture",
+			manifests: []specs.Descriptor{manifest("linux", runtime.GOARCH), manifest("darwin", "amd64"), manifest("darwin", runtime.GOARCH)},
+			selected:  "darwin/" + runtime.GOARCH,
+		},
+		{
+			name:      "only linux",
+			manifests: []specs.Descriptor{manifest("linux", runtime.GOARCH), {Digest: digest.FromString("no platform")}},
+		},
+		{
+			name:      "darwin for another architecture",
+			manifests: []specs.Descriptor{manifest("darwin", other)},
+		},
+		{
+			name:      "darwin for amd64",
+			manifests: []specs.Descriptor{manifest("linux", runtime.GOARCH), manifest("darwin", "amd64")},
+			selected:  amd64,
+		},
+	}
+	for _, tc := range testCases {
+		desc, err := selectManifest(tc.manifests)
+		if tc.selected == "" {
+			assert.Equal(t, errNoDarwinPayload, err, tc.name)
+			continue
+		}
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, digest.FromString(tc.selected), desc.Digest, tc.name)
+		}
+	}
+}
+
+func TestPullImageVerifiesDigests(t *testing.T) {
+	reg := newTestRegistry(t)
+	layer := makeLayer(t, tarEntry{name: "bin/hello", content: "darwin"})
+	darwin := reg.addImage(t, "darwin", layer)
+	reg.tagIndex(t, "v1", map[string]specs.Descriptor{"darwin": darwin})
+	for dgst, buf := range reg.blobs {
+		if bytes.Equal(buf, layer) {
+			reg.blobs[dgst] = makeLayer(t, tarEntry{name: "bin/hello", content: "tampered"})
+		}
+	}
+	is, store := newPullingImageService(t, reg)
+
+	_, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+		Image: &cri.ImageSpec{Image: reg.host() + "/app:v1"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "digest mismatch")
+	assert.False(t, store.HasRootFS(darwin.Digest))
+	entries, err := ioutil.ReadDir(filepath.Join(store.Root(), "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPullImageLimitsBlobSize(t *testing.T) {
+	reg := newTestRegistry(t)
+	layer := makeLayer(t, tarEntry{name: "bin/hello", content: "darwin"})
+	darwin := reg.addImage(t, "darwin", layer)
+	reg.tagIndex(t, "v1", map[string]specs.Descriptor{"darwin": darwin})
+	for dgst, buf := range reg.blobs {
+		if bytes.Equal(buf, layer) {
+			reg.blobs[dgst] = append(layer, make([]byte, 1<<20)...)
+		}
+	}
+	is, store := newPullingImageService(t, reg)
+
+	_, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+		Image: &cri.ImageSpec{Image: reg.host() + "/app:v1"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is larger than")
+	entries, err := ioutil.ReadDir(filepath.Join(store.Root(), "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPullImageByDigest(t *testing.T) {
+	reg := newTestRegistry(t)
+	darwin := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "darwin"}))
+	is, _ := newPullingImageService(t, reg)
+
+	resp, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+		Image: &cri.ImageSpec{Image: reg.host() + "/app@" + darwin.Digest.String()},
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.ImageRef)
+}
+
+func TestPullImageRenewsExpiredToken(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.user, reg.password = "robot", "hunter2"
+	reg.tokenUses = 2
+	darwin := reg.addImage(t, "darwin",
+		makeLayer(t, tarEntry{name: "bin/a", content: "a"}),
+		makeLayer(t, tarEntry{name: "bin/b", content: "b"}),
+	)
+	reg.tagIndex(t, "v1", map[string]specs.Descriptor{"darwin": darwin})
+	is, _ := newPullingImageService(t, reg)
+
+	_, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+		Image: &cri.ImageSpec{Image: reg.host() + "/app:v1"},
+		Auth:  &cri.AuthConfig{Username: "robot", Password: "hunter2"},
+	})
+	require.NoError(t, err)
+	assert.True(t, reg.tokens > 1, "token is renewed")
+}
+
+func assertNotExist(t *testing.T, path string) {
+	_, err := os.Lstat(path)
+	assert.True(t, os.IsNotExist(err), "%s should not exist", path)
+}
+
+func TestPullImageMovesTag(t *testing.T) {
+	reg := newTestRegistry(t)
+	v1 := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "v1"}))
+	v2 := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "v2"}))
+	is, _ := newPullingImageService(t, reg)
+	ctx := context.Background()
+	image := reg.host() + "/app:latest"
+
+	reg.manifests["latest"] = reg.blobs[v1.Digest]
+	first, err := is.PullImage(ctx, &cri.PullImageRequest{Image: &cri.ImageSpec{Image: image}})
+	require.NoError(t, err)
+	reg.manifests["latest"] = reg.blobs[v2.Digest]
+	second, err := is.PullImage(ctx, &cri.PullImageRequest{Image: &cri.ImageSpec{Image: image}})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ImageRef, second.ImageRef)
+	assert.True(t, strings.HasPrefix(second.ImageRef, "sha256:"))
+
+	status, err := is.ImageStatus(ctx, &cri.ImageStatusRequest{Image: &cri.ImageSpec{Image: image}})
+	require.NoError(t, err)
+	assert.Equal(t, second.ImageRef, status.Image.Id)
+	assert.Equal(t, []string{image}, status.Image.RepoTags)
+	assert.Equal(t, []string{reg.host() + "/app@" + v2.Digest.String()}, status.Image.RepoDigests)
+
+	// The old image is kept without the tag, until it is removed by ID.
+	old, err := is.ImageStatus(ctx, &cri.ImageStatusRequest{Image: &cri.ImageSpec{Image: first.ImageRef}})
+	require.NoError(t, err)
+	require.NotNil(t, old.Image)
+	assert.Empty(t, old.Image.RepoTags)
+	list, err := is.ListImages(ctx, &cri.ListImagesRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.Images, 2)
+
+	_, err = is.RemoveImage(ctx, &cri.RemoveImageRequest{Image: &cri.ImageSpec{Image: first.ImageRef}})
+	require.NoError(t, err)
+	list, err = is.ListImages(ctx, &cri.ListImagesRequest{})
+	require.NoError(t, err)
+	if assert.Len(t, list.Images, 1) {
+		assert.Equal(t, second.ImageRef, list.Images[0].Id)
+	}
+}
+
+func TestRemoveImageDuringPull(t *testing.T) {
+	reg := newTestRegistry(t)
+	shared := makeLayer(t, tarEntry{name: "bin/hello", content: "shared"})
+	own := makeLayer(t, tarEntry{name: "bin/other", content: "own"})
+	a := reg.addImage(t, "darwin", shared)
+	b := reg.addImage(t, "darwin", shared, own)
+	reg.manifests["a"] = reg.blobs[a.Digest]
+	reg.manifests["b"] = reg.blobs[b.Digest]
+	is, store := newPullingImageService(t, reg)
+	ctx := context.Background()
+	pulled, err := is.PullImage(ctx, &cri.PullImageRequest{Image: &cri.ImageSpec{Image: reg.host() + "/app:a"}})
+	require.NoError(t, err)
+
+	// Pull b up to its own layer, after finding the shared one in the
+	// store, and remove a meanwhile.
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	reg.beforeBlob = func(dgst digest.Digest) {
+		if dgst == digest.FromBytes(own) {
+			close(blocked)
+			<-unblock
+		}
+	}
+	done := make(chan error)
+	go func() {
+		_, err := is.PullImage(ctx, &cri.PullImageRequest{Image: &cri.ImageSpec{Image: reg.host() + "/app:b"}})
+		done <- err
+	}()
+	<-blocked
+	_, err = is.RemoveImage(ctx, &cri.RemoveImageRequest{Image: &cri.ImageSpec{Image: pulled.ImageRef}})
+	require.NoError(t, err)
+	assert.True(t, store.HasBlob(digest.FromBytes(shared)))
+	close(unblock)
+	require.NoError(t, <-done)
+
+	status, err := is.ImageStatus(ctx, &cri.ImageStatusRequest{Image: &cri.ImageSpec{Image: reg.host() + "/app:b"}})
+	require.NoError(t, err)
+	require.NotNil(t, status.Image)
+	_, rootfs, err := is.ResolveImage(status.Image.Id)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(rootfs, "bin/hello"))
+}
+
+// sign adds a signature of the image with digest dgst, made with key.
+func (r *testRegistry) sign(t *testing.T, key *ecdsa.PrivateKey, dgst digest.Digest) {
+	payload := imagepolicy.Payload{}
+	payload.Critical.Type = imagepolicy.SignaturePayloadType
+	payload.Critical.Image.DockerManifestDigest = dgst.String()
+	buf, err := json.Marshal(payload)
+	require.NoError(t, err)
+	hash := sha256.Sum256(buf)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+
+	layer := r.addBlob(t, "application/vnd.dev.cosign.simplesigning.v1+json", buf)
+	layer.Annotations = map[string]string{imagepolicy.SignatureAnnotation: base64.StdEncoding.EncodeToString(sig)}
+	manifest := struct {
+		MediaType string `json:"mediaType"`
+		specs.Manifest
+	}{
+		MediaType: specs.MediaTypeImageManifest,
+		Manifest: specs.Manifest{
+			Config: r.addJSON(t, "application/vnd.oci.image.config.v1+json", struct{}{}),
+			Layers: []specs.Descriptor{layer},
+		},
+	}
+	manifest.SchemaVersion = 2
+	desc := r.addJSON(t, specs.MediaTypeImageManifest, manifest)
+	r.manifests[imagepolicy.SignatureTag(dgst)] = r.blobs[desc.Digest]
+}
+
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "trusted.pub")
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	return path
+}
+
+func TestPullImageVerifiesSignatures(t *testing.T) {
+	reg := newTestRegistry(t)
+	trusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	untrusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signed := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "signed"}))
+	reg.manifests["signed"] = reg.blobs[signed.Digest]
+	reg.sign(t, trusted, signed.Digest)
+	forged := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "forged"}))
+	reg.manifests["forged"] = reg.blobs[forged.Digest]
+	reg.sign(t, untrusted, forged.Digest)
+	unsigned := reg.addImage(t, "darwin", makeLayer(t, tarEntry{name: "bin/hello", content: "unsigned"}))
+	reg.manifests["unsigned"] = reg.blobs[unsigned.Digest]
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte(fmt.Sprintf(`{
+		"default": "reject",
+		"rules": [
+			{"scope": "%s/pipeline", "require": "signed", "publicKeys": [%q]},
+			{"scope": "%s/pipeline", "namespaces": ["dev"], "require": "accept"}
+		]
+	}`, reg.host(), writePublicKey(t, trusted), reg.host())), 0644))
+	policy, err := imagepolicy.Load(policyFile)
+	require.NoError(t, err)
+	is, store := newPullingImageService(t, reg)
+	is.puller.policy = policy
+
+	pull := func(image, namespace string) error {
+		_, err := is.PullImage(context.Background(), &cri.PullImageRequest{
+			Image: &cri.ImageSpec{Image: reg.host() + image},
+			SandboxConfig: &cri.PodSandboxConfig{
+				Metadata: &cri.PodSandboxMetadata{Namespace: namespace},
+			},
+		})
+		return err
+	}
+	assert.NoError(t, pull("/pipeline/app:signed", "prod"))
+	assert.True(t, store.HasRootFS(signed.Digest))
+
+	err = pull("/pipeline/app:forged", "prod")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no valid signature")
+	}
+	err = pull("/pipeline/app:unsigned", "prod")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not signed")
+	}
+	assert.False(t, store.HasBlob(unsigned.Digest), "rejected before downloading")
+	assert.NoError(t, pull("/pipeline/app:unsigned", "dev"))
+	assert.Error(t, pull("/other/app:signed", "prod"), "rejected by default")
+}
@@ -0,0 +1,82 @@
+package imageservice
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog"
+)
+
+// pullGroup deduplicates concurrent pulls of the same reference, so that
+// one download serves all callers. A pull runs until it finishes, or until
+// every caller waiting for it has given up.
+type pullGroup struct {
+	mu    sync.Mutex
+	calls map[string]*pullCall
+}
+
+type pullCall struct {
+	done chan struct{}
+	// Result of the pull, set before done is closed.
+	id  string
+	err error
+	// Callers waiting for the pull.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newPullGroup() *pullGroup {
+	return &pullGroup{
+		calls: make(map[string]*pullCall),
+	}
+}
+
+// do runs fn for key, unless a pull of key is already running, and waits
+// for its result. Cancelling ctx only cancels fn if no other caller is
+// waiting for it.
+func (g *pullGroup) do(ctx context.Context, key string, fn func(context.Context) (string, error)) (string, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if ok {
+		klog.V(4).Infof("waiting for running pull of %s", key)
+	} else {
+		pullCtx, cancel := context.WithCancel(context.Background())
+		call = &pullCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = call
+		go func() {
+			call.id, call.err = fn(pullCtx)
+			g.mu.Lock()
+			g.forget(key, call)
+			g.mu.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.id, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			klog.V(4).Infof("cancelling pull of %s", key)
+			call.cancel()
+			// Callers arriving from now on start a new pull.
+			g.forget(key, call)
+		}
+		g.mu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+func (g *pullGroup) forget(key string, call *pullCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
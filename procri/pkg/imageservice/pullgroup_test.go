@@ -0,0 +1,74 @@
+package imageservice
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestPullGroupSharesPull(t *testing.T) {
+	g := newPullGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	pull := func(ctx context.Context) (string, error) {
+		calls++
+		close(started)
+		select {
+		case <-release:
+			return "sha256:abc", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	results := make(chan error, 2)
+	go func() {
+		_, err := g.do(cancelled, "docker.io/library/nginx:latest", pull)
+		results <- err
+	}()
+	<-started
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		id, err := g.do(context.Background(), "docker.io/library/nginx:latest", pull)
+		assert.NoError(t, err)
+		assert.Equal(t, "sha256:abc", id)
+	}()
+
+	// Wait until the second caller joined before cancelling the first.
+	for {
+		g.mu.Lock()
+		waiters := g.calls["docker.io/library/nginx:latest"].waiters
+		g.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-results)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, calls)
+}
+
+func TestPullGroupCancelsAbandonedPull(t *testing.T) {
+	g := newPullGroup()
+	aborted := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	pull := func(pullCtx context.Context) (string, error) {
+		cancel()
+		<-pullCtx.Done()
+		close(aborted)
+		return "", pullCtx.Err()
+	}
+	_, err := g.do(ctx, "docker.io/library/nginx:latest", pull)
+	assert.Equal(t, context.Canceled, err)
+	<-aborted
+}
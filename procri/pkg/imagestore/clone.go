@@ -0,0 +1,106 @@
+package imagestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog"
+)
+
+// errCloneNotSupported is returned when the platform can't clone files.
+var errCloneNotSupported = errors.New("cloning is not supported")
+
+// CloneTree copies the directory tree src to dst, which must not exist.
+// Where the filesystem supports it, e.g. APFS, the copy is a clone sharing
+// data blocks with src until either is modified, otherwise a plain copy.
+func CloneTree(src, dst string) error {
+	if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+		return fmt.Errorf("cloning %s: %s exists", src, dst)
+	}
+	err := cloneDir(src, dst)
+	if err == nil {
+		return nil
+	}
+	klog.V(4).Infof("cloning %s: %v, copying it", src, err)
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("copying %s: %v", src, err)
+	}
+	return nil
+}
+
+// copyTree copies directories, regular files and symlinks with their modes.
+// Files are cloned if the filesystem supports it.
+func copyTree(src, dst string) error {
+	dirModes := make(map[string]os.FileMode)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			// Directories stay writable until everything is copied.
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirModes[target] = mode.Perm()
+			return nil
+		case mode.IsRegular():
+			if err := copyFile(path, target, mode.Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			klog.V(4).Infof("not copying %s, mode %s", path, mode)
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for dir, perm := range dirModes {
+		if err := os.Chmod(dir, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := cloneFile(in, out); err != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+	}
+	if err := out.Chmod(perm); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,19 @@
+package imagestore
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneDir clones a whole directory tree with one clonefile(2) call, which
+// APFS supports.
+func cloneDir(src, dst string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
+
+// cloneFile is not needed, since cloneDir only fails if the filesystem can't
+// clone at all.
+func cloneFile(src, dst *os.File) error {
+	return errCloneNotSupported
+}
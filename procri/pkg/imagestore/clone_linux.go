@@ -0,0 +1,18 @@
+package imagestore
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneDir can't clone directories on Linux, trees are copied file by file.
+func cloneDir(src, dst string) error {
+	return errCloneNotSupported
+}
+
+// cloneFile makes dst a reflink of src, on filesystems supporting it, e.g.
+// Btrfs or XFS.
+func cloneFile(src, dst *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !linux
+
+package imagestore
+
+import "os"
+
+func cloneDir(src, dst string) error {
+	return errCloneNotSupported
+}
+
+func cloneFile(src, dst *os.File) error {
+	return errCloneNotSupported
+}
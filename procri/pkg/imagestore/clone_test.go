@@ -0,0 +1,37 @@
+package imagestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "bin/app"), []byte("app"), 0755))
+	require.NoError(t, os.Symlink("/bin/app", filepath.Join(src, "app")))
+	require.NoError(t, os.Mkdir(filepath.Join(src, "ro"), 0555))
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	require.NoError(t, CloneTree(src, dst))
+	info, err := os.Stat(filepath.Join(dst, "bin/app"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	link, err := os.Readlink(filepath.Join(dst, "app"))
+	require.NoError(t, err)
+	assert.Equal(t, "/bin/app", link)
+	info, err = os.Stat(filepath.Join(dst, "ro"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0555), info.Mode().Perm())
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "bin/app"), []byte("changed"), 0755))
+	buf, err := ioutil.ReadFile(filepath.Join(src, "bin/app"))
+	require.NoError(t, err)
+	assert.Equal(t, "app", string(buf), "source is unchanged")
+	assert.Error(t, CloneTree(src, dst), "destination exists")
+}
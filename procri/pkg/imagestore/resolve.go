@@ -0,0 +1,56 @@
+package imagestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinks = 255
+
+// ResolveInRoot resolves path as if root was the root directory: symlinks,
+// including absolute ones, are followed inside root and ".." never leaves it.
+// The result is a host path below root.
+func ResolveInRoot(root, path string) (string, error) {
+	remaining := filepath.Clean("/" + path)
+	resolved := "/"
+	links := 0
+	for remaining != "" && remaining != "/" {
+		remaining = strings.TrimPrefix(remaining, "/")
+		part := remaining
+		rest := ""
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			part, rest = remaining[:i], remaining[i:]
+		}
+		remaining = rest
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Nothing to resolve below a missing component.
+				return filepath.Join(root, next, remaining), nil
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("resolving %s: too many symlinks", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = filepath.Clean("/"+filepath.Join(resolved, target)) + remaining
+		resolved = "/"
+	}
+	return filepath.Join(root, resolved), nil
+}
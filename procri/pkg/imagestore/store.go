@@ -0,0 +1,210 @@
+package imagestore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"k8s.io/klog"
+)
+
+const (
+	blobsDir  = "blobs"
+	rootfsDir = "rootfs"
+	tmpDir    = "tmp"
+)
+
+// Store is a content-addressed store of image blobs, and of the root
+// filesystems unpacked from them:
+//
+//	<root>/blobs/<algorithm>/<hex>  verified blobs: manifests, configs, layers
+//	<root>/rootfs/<hex>             unpacked root filesystems, by manifest digest
+//	<root>/tmp                      partial downloads and unpacks
+type Store struct {
+	root string
+}
+
+// New opens the store at root, creating it if needed, and removes partial
+// data of interrupted pulls. Only the process owning the store, i.e. the
+// procri server, should use it.
+func New(root string) (*Store, error) {
+	s, err := Open(root)
+	if err != nil {
+		return nil, err
+	}
+	// Anything left in tmp is from an interrupted pull.
+	entries, err := ioutil.ReadDir(filepath.Join(root, tmpDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(root, tmpDir, e.Name())); err != nil {
+			klog.Warningf("removing partial image data %s: %v", e.Name(), err)
+		}
+	}
+	return s, nil
+}
+
+// Open opens the store at root, creating it if needed, without touching
+// data of pulls in progress, e.g. for offline tools.
+func Open(root string) (*Store, error) {
+	for _, dir := range []string{blobsDir, rootfsDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{root: root}, nil
+}
+
+func (s *Store) Root() string {
+	return s.root
+}
+
+// TempDir creates a directory for temporary data on the filesystem of the
+// store. The caller has to remove it.
+func (s *Store) TempDir(prefix string) (string, error) {
+	return ioutil.TempDir(filepath.Join(s.root, tmpDir), prefix)
+}
+
+func (s *Store) blobPath(dgst digest.Digest) string {
+	return filepath.Join(s.root, blobsDir, dgst.Algorithm().String(), dgst.Hex())
+}
+
+// HasBlob reports whether the blob with digest dgst is in the store.
+func (s *Store) HasBlob(dgst digest.Digest) bool {
+	if dgst.Validate() != nil {
+		return false
+	}
+	_, err := os.Stat(s.blobPath(dgst))
+	return err == nil
+}
+
+// OpenBlob opens a blob for reading.
+func (s *Store) OpenBlob(dgst digest.Digest) (*os.File, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	return os.Open(s.blobPath(dgst))
+}
+
+// ReadBlob returns the content of a small blob, e.g. a manifest.
+func (s *Store) ReadBlob(dgst digest.Digest) ([]byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(s.blobPath(dgst))
+}
+
+// WriteBlob stores the content of r as the blob with digest dgst. The content
+// is verified before it becomes visible in the store.
+func (s *Store) WriteBlob(dgst digest.Digest, r io.Reader) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	if s.HasBlob(dgst) {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Join(s.root, tmpDir), "blob-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(io.MultiWriter(f, verifier), r); err != nil {
+		return fmt.Errorf("writing blob %s: %v", dgst, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s: digest mismatch", dgst)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.blobPath(dgst)), 0755); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.blobPath(dgst))
+}
+
+// DeleteBlob removes a blob from the store.
+func (s *Store) DeleteBlob(dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	err := os.Remove(s.blobPath(dgst))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// RootFSPath returns the directory a root filesystem is unpacked to.
+func (s *Store) RootFSPath(id digest.Digest) string {
+	return filepath.Join(s.root, rootfsDir, id.Hex())
+}
+
+// HasRootFS reports whether the root filesystem id has been unpacked.
+func (s *Store) HasRootFS(id digest.Digest) bool {
+	info, err := os.Stat(s.RootFSPath(id))
+	return err == nil && info.IsDir()
+}
+
+// Unpack applies layers, in order, to a new root filesystem id. Layers are
+// read from the store, and have to be tar archives, optionally gzipped. The
+// root filesystem only becomes visible once all layers are applied, and
+// concurrent unpacks of the same id all return it.
+func (s *Store) Unpack(id digest.Digest, layers []digest.Digest) (string, error) {
+	if s.HasRootFS(id) {
+		return s.RootFSPath(id), nil
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(s.root, tmpDir), "rootfs-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+
+	for _, layer := range layers {
+		if err := s.applyLayer(tmp, layer); err != nil {
+			return "", fmt.Errorf("unpacking layer %s: %v", layer, err)
+		}
+	}
+	if err := os.Rename(tmp, s.RootFSPath(id)); err != nil {
+		// A concurrent unpack of the same layers got there first.
+		if s.HasRootFS(id) {
+			return s.RootFSPath(id), nil
+		}
+		return "", err
+	}
+	return s.RootFSPath(id), nil
+}
+
+func (s *Store) applyLayer(root string, layer digest.Digest) error {
+	f, err := s.OpenBlob(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ApplyLayer(root, f)
+}
+
+// RemoveRootFS deletes an unpacked root filesystem.
+func (s *Store) RemoveRootFS(id digest.Digest) error {
+	// Rename first, so a half-deleted tree is never mistaken for an image.
+	tmp, err := ioutil.TempDir(filepath.Join(s.root, tmpDir), "remove-")
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(tmp, "rootfs")
+	if err := os.Rename(s.RootFSPath(id), target); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp)
+		return err
+	}
+	return os.RemoveAll(tmp)
+}
@@ -0,0 +1,44 @@
+package imagestore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentUnpack(t *testing.T) {
+	s, err := New(t.TempDir())
+	require.NoError(t, err)
+	// Enough files for the unpacks to overlap.
+	entries := make([]entry, 0, 200)
+	for i := 0; i < cap(entries); i++ {
+		entries = append(entries, entry{name: fmt.Sprintf("app/%d", i)})
+	}
+	layer := makeTar(t, entries...)
+	layerDigest := digest.FromBytes(layer)
+	require.NoError(t, s.WriteBlob(layerDigest, bytes.NewReader(layer)))
+	id := digest.FromString("manifest")
+
+	var wg sync.WaitGroup
+	paths := make([]string, 8)
+	errs := make([]error, len(paths))
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = s.Unpack(id, []digest.Digest{layerDigest})
+		}(i)
+	}
+	wg.Wait()
+	for i := range paths {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, s.RootFSPath(id), paths[i])
+	}
+	assert.FileExists(t, filepath.Join(s.RootFSPath(id), "app/199"))
+}
@@ -0,0 +1,166 @@
+package imagestore
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	// Marks a directory whose content in lower layers is hidden.
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ApplyLayer extracts a layer tarball, optionally gzipped, on top of root.
+// Whiteout entries remove files from the layers below. Entries that would
+// escape root, directly or via a symlink, are rejected.
+func ApplyLayer(root string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var src io.Reader = br
+	if bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := applyEntry(root, hdr, tr); err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+}
+
+// resolve returns the path of name inside root. It fails if name is outside
+// root or if one of its parent directories is a symlink, which could point
+// outside root.
+func resolve(root, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return root, nil
+	}
+	rel := strings.TrimPrefix(clean, "/")
+	parts := strings.Split(rel, "/")
+	current := root
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("path traverses symlink %s", strings.TrimPrefix(current, root))
+		}
+	}
+	return filepath.Join(root, rel), nil
+}
+
+func applyEntry(root string, hdr *tar.Header, content io.Reader) error {
+	path, err := resolve(root, hdr.Name)
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(path)
+	dir := filepath.Dir(path)
+
+	if base == whiteoutOpaque {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+	}
+
+	if path != root {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// A directory can be updated in place, anything else replaces what was
+	// there in lower layers.
+	if info, err := os.Lstat(path); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, mode|0700); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode|0700); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, content); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		// The umask may have masked some bits.
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// The target is resolved relative to the root when the container
+		// runs, so it doesn't have to be checked here.
+		return os.Symlink(hdr.Linkname, path)
+	case tar.TypeLink:
+		target, err := resolve(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(target); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("invalid hard link target %s", hdr.Linkname)
+		}
+		return os.Link(target, path)
+	default:
+		klog.V(4).Infof("skipping unsupported layer entry %s (type %c)", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,124 @@
+package imagestore
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	name     string
+	typeflag byte
+	linkname string
+}
+
+func makeTar(t *testing.T, entries ...entry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: e.typeflag, Linkname: e.linkname}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e.name))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(e.name))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestApplyLayerRejectsEscapes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		entries []entry
+	}{
+		{
+			name:    "dot dot stays in root",
+			entries: []entry{{name: "../../escaped"}},
+		},
+		{
+			name: "write through symlinked directory",
+			entries: []entry{
+				{name: "dir", typeflag: tar.TypeSymlink, linkname: "/tmp"},
+				{name: "dir/escaped"},
+			},
+		},
+		{
+			name: "hard link through symlinked directory",
+			entries: []entry{
+				{name: "dir", typeflag: tar.TypeSymlink, linkname: "/etc"},
+				{name: "link", typeflag: tar.TypeLink, linkname: "dir/passwd"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outside := t.TempDir()
+			root := filepath.Join(outside, "root")
+			require.NoError(t, os.Mkdir(root, 0755))
+			_ = ApplyLayer(root, bytes.NewReader(makeTar(t, tc.entries...)))
+			files, err := ioutil.ReadDir(outside)
+			require.NoError(t, err)
+			assert.Len(t, files, 1, "only root is in %s", outside)
+			assertNotExist(t, "/tmp/escaped")
+			assertNotExist(t, filepath.Join(root, "link"))
+		})
+	}
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, ApplyLayer(root, bytes.NewReader(makeTar(t,
+		entry{name: "a/keep"},
+		entry{name: "a/remove"},
+		entry{name: "b/one"},
+		entry{name: "b/two"},
+	))))
+	require.NoError(t, ApplyLayer(root, bytes.NewReader(makeTar(t,
+		entry{name: "a/.wh.remove"},
+		entry{name: "b/.wh..wh..opq"},
+		entry{name: "b/three"},
+	))))
+	assert.FileExists(t, filepath.Join(root, "a/keep"))
+	assertNotExist(t, filepath.Join(root, "a/remove"))
+	assertNotExist(t, filepath.Join(root, "b/one"))
+	assertNotExist(t, filepath.Join(root, "b/two"))
+	assert.FileExists(t, filepath.Join(root, "b/three"))
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr/bin"), 0755))
+	require.NoError(t, os.Symlink("/usr/bin", filepath.Join(root, "bin")))
+	require.NoError(t, os.Symlink("../../..", filepath.Join(root, "usr/bin/up")))
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{path: "", expected: root},
+		{path: "/bin/sh", expected: filepath.Join(root, "usr/bin/sh")},
+		{path: "/../../etc/passwd", expected: filepath.Join(root, "etc/passwd")},
+		{path: "/usr/bin/up/etc", expected: filepath.Join(root, "etc")},
+	}
+	for _, tc := range testCases {
+		resolved, err := ResolveInRoot(root, tc.path)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, resolved, tc.path)
+	}
+}
+
+func assertNotExist(t *testing.T, path string) {
+	_, err := os.Lstat(path)
+	assert.True(t, os.IsNotExist(err), "%s should not exist", path)
+}
@@ -0,0 +1,42 @@
+package imagestore
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Usage returns the bytes allocated on disk for the files under root, and
+// the number of inodes they use. Hard links are only counted once.
+func Usage(root string) (uint64, uint64, error) {
+	var bytes, inodes uint64
+	seen := make(map[uint64]bool)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while walking.
+				return nil
+			}
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			bytes += uint64(info.Size())
+			inodes++
+			return nil
+		}
+		if uint64(st.Nlink) > 1 && !info.IsDir() {
+			if seen[uint64(st.Ino)] {
+				return nil
+			}
+			seen[uint64(st.Ino)] = true
+		}
+		bytes += uint64(st.Blocks) * 512
+		inodes++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return bytes, inodes, nil
+}
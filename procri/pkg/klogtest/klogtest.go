@@ -0,0 +1,50 @@
+// Package klogtest captures klog output in tests.
+package klogtest
+
+import (
+	"bytes"
+	goflag "flag"
+	"os"
+	"testing"
+
+	"k8s.io/klog"
+)
+
+// Capture runs fn with klog writing everything up to verbosity 10 into a
+// buffer, and returns the buffer. The klog flags are restored when the test
+// ends, and klog writes to stderr again.
+func Capture(t *testing.T, fn func()) string {
+	t.Helper()
+	fs := goflag.NewFlagSet("klog", goflag.ContinueOnError)
+	klog.InitFlags(fs)
+	saved := map[string]string{}
+	for _, name := range []string{"logtostderr", "alsologtostderr", "stderrthreshold", "v"} {
+		saved[name] = fs.Lookup(name).Value.String()
+	}
+	t.Cleanup(func() {
+		klog.Flush()
+		for name, value := range saved {
+			if err := fs.Set(name, value); err != nil {
+				t.Errorf("restoring klog flag %s: %v", name, err)
+			}
+		}
+		klog.SetOutput(os.Stderr)
+	})
+
+	settings := map[string]string{
+		"logtostderr":     "false",
+		"alsologtostderr": "false",
+		"stderrthreshold": "FATAL",
+		"v":               "10",
+	}
+	for name, value := range settings {
+		if err := fs.Set(name, value); err != nil {
+			t.Fatalf("setting klog flag %s: %v", name, err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	klog.SetOutput(buf)
+	fn()
+	klog.Flush()
+	return buf.String()
+}
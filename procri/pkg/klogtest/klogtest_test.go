@@ -0,0 +1,26 @@
+package klogtest
+
+import (
+	goflag "flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog"
+)
+
+func TestCaptureRestoresFlags(t *testing.T) {
+	fs := goflag.NewFlagSet("klog", goflag.ContinueOnError)
+	klog.InitFlags(fs)
+	before := fs.Lookup("v").Value.String()
+
+	t.Run("capture", func(t *testing.T) {
+		logs := Capture(t, func() {
+			klog.V(9).Info("verbose line")
+		})
+		assert.Contains(t, logs, "verbose line")
+		assert.Equal(t, "10", fs.Lookup("v").Value.String())
+	})
+
+	assert.Equal(t, before, fs.Lookup("v").Value.String())
+	assert.Equal(t, "true", fs.Lookup("logtostderr").Value.String())
+}
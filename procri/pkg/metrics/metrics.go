@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	namespace = "procri"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	rpcDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of CRI requests handled by procri.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		},
+		[]string{"service", "method"},
+	)
+	rpcErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "grpc",
+			Name:      "request_errors_total",
+			Help:      "Number of CRI requests that returned an error.",
+		},
+		[]string{"service", "method", "code"},
+	)
+
+	// ContainerLogBytes counts the bytes written to container log files.
+	ContainerLogBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "container_log_bytes_total",
+			Help:      "Bytes written to the log file of a container.",
+		},
+		[]string{"container_id", "stream"},
+	)
+	// ExecSessions counts exec sessions by type (exec_sync or exec).
+	ExecSessions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exec_sessions_total",
+			Help:      "Number of exec sessions started.",
+		},
+		[]string{"type"},
+	)
+	// ActiveExecSessions is the number of exec sessions currently running.
+	ActiveExecSessions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exec_sessions_active",
+			Help:      "Number of exec sessions currently running.",
+		},
+		[]string{"type"},
+	)
+	// PortForwardBytes counts bytes copied by port-forward sessions. The
+	// direction is "in" for client to pod and "out" for pod to client.
+	PortForwardBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "port_forward_bytes_total",
+			Help:      "Bytes copied by port-forward sessions.",
+		},
+		[]string{"direction"},
+	)
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		rpcDuration,
+		rpcErrors,
+		ContainerLogBytes,
+		ExecSessions,
+		ActiveExecSessions,
+		PortForwardBytes,
+	)
+}
+
+// MustRegister adds collectors to the procri registry.
+func MustRegister(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// Handler returns the HTTP handler serving the procri registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// DeleteContainer drops the per-container series of a removed container.
+func DeleteContainer(containerID string) {
+	for _, stream := range []string{"stdout", "stderr"} {
+		ContainerLogBytes.DeleteLabelValues(containerID, stream)
+	}
+}
+
+// splitMethodName turns "/runtime.v1alpha2.RuntimeService/Version" into
+// ("runtime.v1alpha2.RuntimeService", "Version").
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+func observe(fullMethod string, start time.Time, err error) {
+	service, method := splitMethodName(fullMethod)
+	rpcDuration.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(service, method, status.Code(err).String()).Inc()
+	}
+}
+
+// UnaryServerInterceptor records latency and errors of unary RPCs.
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+// StreamServerInterceptor records latency and errors of streaming RPCs.
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observe(info.FullMethod, start, err)
+	return err
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSplitMethodName(t *testing.T) {
+	service, method := splitMethodName("/runtime.v1alpha2.RuntimeService/Version")
+	assert.Equal(t, "runtime.v1alpha2.RuntimeService", service)
+	assert.Equal(t, "Version", method)
+	service, method = splitMethodName("Version")
+	assert.Equal(t, "unknown", service)
+	assert.Equal(t, "Version", method)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	rpcDuration.Reset()
+	rpcErrors.Reset()
+	info := &grpc.UnaryServerInfo{FullMethod: "/runtime.v1alpha2.RuntimeService/StartContainer"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	fail := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such container")
+	}
+
+	resp, err := UnaryServerInterceptor(context.Background(), nil, info, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	_, err = UnaryServerInterceptor(context.Background(), nil, info, fail)
+	assert.Error(t, err)
+
+	expected := `
+# HELP procri_grpc_request_errors_total Number of CRI requests that returned an error.
+# TYPE procri_grpc_request_errors_total counter
+procri_grpc_request_errors_total{code="NotFound",method="StartContainer",service="runtime.v1alpha2.RuntimeService"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(rpcErrors, strings.NewReader(expected), "procri_grpc_request_errors_total"))
+	assertObservations(t, "runtime.v1alpha2.RuntimeService", "StartContainer", 2)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	rpcDuration.Reset()
+	rpcErrors.Reset()
+	info := &grpc.StreamServerInfo{FullMethod: "/runtime.v1alpha2.RuntimeService/Attach"}
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		return status.Error(codes.Unavailable, "closed")
+	}
+
+	err := StreamServerInterceptor(nil, nil, info, handler)
+	assert.Error(t, err)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(rpcErrors.WithLabelValues("runtime.v1alpha2.RuntimeService", "Attach", "Unavailable")))
+	assertObservations(t, "runtime.v1alpha2.RuntimeService", "Attach", 1)
+}
+
+// assertObservations checks the number of requests the latency histogram
+// of method counted.
+func assertObservations(t *testing.T, service, method string, count uint64) {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "procri_grpc_request_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["service"] == service && labels["method"] == method {
+				assert.Equal(t, count, m.GetHistogram().GetSampleCount())
+				return
+			}
+		}
+	}
+	t.Errorf("no latency observed for %s/%s", service, method)
+}
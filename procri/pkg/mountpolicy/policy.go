@@ -0,0 +1,188 @@
+// Package mountpolicy decides where in their root containers may mount
+// volumes, based on the path and the namespace of the pod.
+package mountpolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Actions of a rule.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Policy is the mount path policy, read from a JSON file, e.g.
+//
+//	{
+//	  "default": "allow",
+//	  "rules": [
+//	    {"paths": ["/etc", "/usr", "/bin", "/sbin"], "action": "deny"},
+//	    {"paths": ["/etc/nginx"], "action": "allow"},
+//	    {"paths": ["/etc/*-exporter"], "namespaces": ["monitoring"], "action": "allow"}
+//	  ]
+//	}
+type Policy struct {
+	// Action for paths no rule applies to, "allow" or "deny". Defaults to
+	// "allow".
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule allows or denies mounts at some paths. If several rules apply to a
+// mount, the one with the longest matching path, in components, wins. Among
+// those a rule listing the namespace of the pod wins over one for all
+// namespaces, and then "deny" wins over "allow".
+type Rule struct {
+	// Absolute container paths, each also covering everything below it.
+	// Path components can be glob patterns, as in filepath.Match, e.g.
+	// "/var/run/*/token" or "/etc/*.d".
+	Paths []string `json:"paths"`
+	// Kubernetes namespaces of the pods the rule applies to. All namespaces
+	// if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// "allow" or "deny".
+	Action string `json:"action"`
+}
+
+// Default returns the policy used without a policy file, denying mounts over
+// system directories, except for the hosts and resolver files kubelet mounts.
+func Default() *Policy {
+	return &Policy{
+		Default: Allow,
+		Rules: []Rule{
+			{Paths: []string{"/etc", "/usr", "/bin", "/sbin", "/Library"}, Action: Deny},
+			{Paths: []string{"/etc/hosts", "/etc/resolv.conf"}, Action: Allow},
+		},
+	}
+}
+
+// Load reads a policy.
+func Load(path string) (*Policy, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading mount policy: %v", err)
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("parsing mount policy %s: %v", path, err)
+	}
+	switch p.Default {
+	case "":
+		p.Default = Allow
+	case Allow, Deny:
+	default:
+		return nil, fmt.Errorf("mount policy %s: invalid default %q", path, p.Default)
+	}
+	for i, rule := range p.Rules {
+		if rule.Action != Allow && rule.Action != Deny {
+			return nil, fmt.Errorf("mount policy %s: rule %d has invalid action %q", path, i, rule.Action)
+		}
+		if len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("mount policy %s: rule %d has no paths", path, i)
+		}
+		for _, pattern := range rule.Paths {
+			if !filepath.IsAbs(pattern) {
+				return nil, fmt.Errorf("mount policy %s: path %s is not absolute", path, pattern)
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("mount policy %s: path %s: %v", path, pattern, err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Check returns an error if a pod in namespace may not mount a volume at
+// containerPath.
+func (p *Policy) Check(containerPath, namespace string) error {
+	rule, pattern := p.rule(containerPath, namespace)
+	if rule == nil {
+		if p.Default == Deny {
+			return fmt.Errorf("mount at %s denied by mount policy: no rule allows it", containerPath)
+		}
+		return nil
+	}
+	if rule.Action == Deny {
+		return fmt.Errorf("mount at %s denied by mount policy for %s", containerPath, pattern)
+	}
+	return nil
+}
+
+// rule returns the rule for containerPath in namespace, and the pattern of
+// it that matches, or nil if there is none.
+func (p *Policy) rule(containerPath, namespace string) (*Rule, string) {
+	var best *Rule
+	bestPattern, bestLen := "", 0
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.Namespaces) > 0 && !contains(rule.Namespaces, namespace) {
+			continue
+		}
+		pattern, n := rule.match(containerPath)
+		if n < 0 {
+			continue
+		}
+		if best == nil || n > bestLen ||
+			n == bestLen && rule.wins(best) {
+			best, bestPattern, bestLen = rule, pattern, n
+		}
+	}
+	return best, bestPattern
+}
+
+// wins returns whether r takes precedence over other for equally long paths.
+func (r *Rule) wins(other *Rule) bool {
+	namespaced, otherNamespaced := len(r.Namespaces) > 0, len(other.Namespaces) > 0
+	if namespaced != otherNamespaced {
+		return namespaced
+	}
+	return r.Action == Deny && other.Action != Deny
+}
+
+// match returns the longest path of r matching containerPath, and its number
+// of components, or -1 if none matches.
+func (r *Rule) match(containerPath string) (string, int) {
+	parts := splitPath(containerPath)
+	best, bestLen := "", -1
+	for _, pattern := range r.Paths {
+		patternParts := splitPath(pattern)
+		if len(patternParts) > len(parts) || len(patternParts) <= bestLen {
+			continue
+		}
+		matched := true
+		for i, patternPart := range patternParts {
+			if ok, _ := filepath.Match(patternPart, parts[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			best, bestLen = pattern, len(patternParts)
+		}
+	}
+	return best, bestLen
+}
+
+func splitPath(p string) []string {
+	parts := make([]string, 0)
+	for _, part := range strings.Split(filepath.Clean("/"+p), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package mountpolicy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicy(t *testing.T, policy string) string {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(policy), 0644))
+	return path
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	p := Default()
+	assert.Error(t, p.Check("/etc/passwd", ""))
+	assert.NoError(t, p.Check("/etc/hosts", ""))
+	assert.NoError(t, p.Check("/etc/resolv.conf", ""))
+	assert.Error(t, p.Check("/usr/local/bin/foo", ""))
+	assert.Error(t, p.Check("/etc", ""))
+	assert.NoError(t, p.Check("/etcetera", ""))
+	assert.NoError(t, p.Check("/var/kubernetes/secrets/token", ""))
+	assert.NoError(t, p.Check("/foobar", ""))
+}
+
+func TestCheck(t *testing.T) {
+	p, err := Load(writePolicy(t, `{
+		"default": "deny",
+		"rules": [
+			{"paths": ["/var/run/secrets", "/data"], "action": "allow"},
+			{"paths": ["/data/private"], "action": "deny"},
+			{"paths": ["/data/private"], "namespaces": ["ops"], "action": "allow"},
+			{"paths": ["/etc/*.d"], "namespaces": ["ops"], "action": "allow"},
+			{"paths": ["/etc/*.d"], "namespaces": ["ops"], "action": "deny"},
+			{"paths": ["/config/*/app"], "action": "allow"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		path      string
+		namespace string
+		allowed   bool
+	}{
+		{path: "/var/run/secrets/kubernetes.io/serviceaccount", allowed: true},
+		{path: "/var/run", allowed: false},
+		{path: "/data", allowed: true},
+		{path: "/data/../etc", allowed: false},
+		{path: "/data/private/key", allowed: false},
+		{path: "/data/private/key", namespace: "ops", allowed: true},
+		{path: "/data/privateer", allowed: true},
+		{path: "/etc/conf.d", namespace: "ops", allowed: false},
+		{path: "/config/v1/app/settings", allowed: true},
+		{path: "/config/v1/other", allowed: false},
+	}
+	for _, tc := range testCases {
+		err := p.Check(tc.path, tc.namespace)
+		if tc.allowed {
+			assert.NoError(t, err, "%s in namespace %q", tc.path, tc.namespace)
+		} else {
+			assert.Error(t, err, "%s in namespace %q", tc.path, tc.namespace)
+		}
+	}
+}
+
+func TestLoadInvalidPolicy(t *testing.T) {
+	for _, policy := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"paths": ["/data"]}]}`,
+		`{"rules": [{"action": "allow"}]}`,
+		`{"rules": [{"paths": ["data"], "action": "allow"}]}`,
+		`{"rules": [{"paths": ["/data/[a-"], "action": "allow"}]}`,
+	} {
+		_, err := Load(writePolicy(t, policy))
+		assert.Error(t, err, policy)
+	}
+}
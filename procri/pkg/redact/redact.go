@@ -0,0 +1,247 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+const (
+	// Mask replaces redacted values.
+	Mask = "<redacted>"
+)
+
+// DefaultPatterns are the glob patterns annotation keys are matched against
+// when no patterns are configured. Matching is case-insensitive.
+var DefaultPatterns = []string{
+	"*password*",
+	"*passwd*",
+	"*secret*",
+	"*token*",
+	"*key*",
+	"*credential*",
+	"*auth*",
+	"*last-applied-configuration",
+}
+
+var (
+	mu       sync.RWMutex
+	patterns = mustCompile(DefaultPatterns)
+)
+
+var (
+	// A key, optionally quoted, assigned a value with = or :, as in
+	// password=x, token: x or "secret": "x".
+	assignmentRegexp  = regexp.MustCompile(`"?([A-Za-z0-9_.\-]+)"?(=|:[ \t]*)("[^"\n]*"|(?i:bearer[ \t]+|basic[ \t]+)?[^\s,;&"]+)`)
+	urlPasswordRegexp = regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`)
+	bearerRegexp      = regexp.MustCompile(`(?i)(bearer[ \t]+)[^\s"]+`)
+)
+
+// compile turns glob patterns into one regular expression. Unlike
+// path.Match, "*" also matches "/", which annotation keys often contain.
+func compile(globs []string) (*regexp.Regexp, error) {
+	alternatives := make([]string, 0, len(globs))
+	for _, glob := range globs {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		expr := regexp.QuoteMeta(glob)
+		expr = strings.Replace(expr, `\*`, ".*", -1)
+		expr = strings.Replace(expr, `\?`, ".", -1)
+		alternatives = append(alternatives, expr)
+	}
+	if len(alternatives) == 0 {
+		// Matches nothing.
+		return regexp.Compile(`[^\s\S]`)
+	}
+	re, err := regexp.Compile("(?i)^(" + strings.Join(alternatives, "|") + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction patterns %v: %v", globs, err)
+	}
+	return re, nil
+}
+
+func mustCompile(globs []string) *regexp.Regexp {
+	re, err := compile(globs)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// SetPatterns replaces the glob patterns used to find sensitive annotation
+// keys.
+func SetPatterns(globs []string) error {
+	re, err := compile(globs)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	patterns = re
+	return nil
+}
+
+// IsSensitiveKey reports whether key matches one of the redaction patterns.
+func IsSensitiveKey(key string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return patterns.MatchString(key)
+}
+
+// Env masks the values of a list of KEY=VALUE environment variables. All
+// values are masked, since secrets can be injected under any name.
+func Env(env []string) []string {
+	result := make([]string, 0, len(env))
+	for _, kv := range env {
+		key := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			key = kv[:i]
+		}
+		result = append(result, key+"="+Mask)
+	}
+	return result
+}
+
+// KeyValues masks the values of CRI environment variables.
+func KeyValues(envs []*cri.KeyValue) []*cri.KeyValue {
+	if envs == nil {
+		return nil
+	}
+	result := make([]*cri.KeyValue, 0, len(envs))
+	for _, kv := range envs {
+		result = append(result, &cri.KeyValue{Key: kv.GetKey(), Value: Mask})
+	}
+	return result
+}
+
+// Annotations masks the values of annotations with sensitive keys.
+func Annotations(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return nil
+	}
+	result := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if IsSensitiveKey(k) {
+			v = Mask
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// Command keeps the executable of a command line and masks its arguments,
+// which can carry secrets, e.g. in exec probes.
+func Command(cmd []string) []string {
+	if len(cmd) == 0 {
+		return cmd
+	}
+	result := make([]string, 0, len(cmd))
+	result = append(result, cmd[0])
+	for range cmd[1:] {
+		result = append(result, Mask)
+	}
+	return result
+}
+
+// Text masks what looks like a secret in free-form text, e.g. a log: values
+// assigned to sensitive keys, as in password=x or "token": "x", passwords in
+// URLs and bearer tokens. It is best effort, secrets in any other form are
+// kept.
+func Text(text string) string {
+	text = assignmentRegexp.ReplaceAllStringFunc(text, func(m string) string {
+		groups := assignmentRegexp.FindStringSubmatch(m)
+		if !IsSensitiveKey(groups[1]) {
+			return m
+		}
+		return strings.TrimSuffix(m, groups[3]) + Mask
+	})
+	text = urlPasswordRegexp.ReplaceAllString(text, "${1}"+Mask+"@")
+	return bearerRegexp.ReplaceAllString(text, "${1}"+Mask)
+}
+
+// AuthConfig masks every credential in a registry auth config. Only the
+// server address is kept.
+func AuthConfig(auth *cri.AuthConfig) *cri.AuthConfig {
+	if auth == nil {
+		return nil
+	}
+	result := &cri.AuthConfig{
+		ServerAddress: auth.ServerAddress,
+	}
+	for _, field := range []struct {
+		value string
+		dst   *string
+	}{
+		{auth.Username, &result.Username},
+		{auth.Password, &result.Password},
+		{auth.Auth, &result.Auth},
+		{auth.IdentityToken, &result.IdentityToken},
+		{auth.RegistryToken, &result.RegistryToken},
+	} {
+		if field.value != "" {
+			*field.dst = Mask
+		}
+	}
+	return result
+}
+
+// ContainerConfig returns a copy of a container config that is safe to log.
+func ContainerConfig(config *cri.ContainerConfig) *cri.ContainerConfig {
+	if config == nil {
+		return nil
+	}
+	result := *config
+	result.Command = Command(config.Command)
+	result.Args = make([]string, 0, len(config.Args))
+	for range config.Args {
+		result.Args = append(result.Args, Mask)
+	}
+	result.Envs = KeyValues(config.Envs)
+	result.Annotations = Annotations(config.Annotations)
+	return &result
+}
+
+// PodSandboxConfig returns a copy of a sandbox config that is safe to log.
+func PodSandboxConfig(config *cri.PodSandboxConfig) *cri.PodSandboxConfig {
+	if config == nil {
+		return nil
+	}
+	result := *config
+	result.Annotations = Annotations(config.Annotations)
+	return &result
+}
+
+// Request returns a copy of a CRI request that is safe to log. Requests
+// without sensitive fields are returned as they are.
+func Request(req interface{}) interface{} {
+	switch r := req.(type) {
+	case *cri.RunPodSandboxRequest:
+		c := *r
+		c.Config = PodSandboxConfig(r.Config)
+		return &c
+	case *cri.CreateContainerRequest:
+		c := *r
+		c.Config = ContainerConfig(r.Config)
+		c.SandboxConfig = PodSandboxConfig(r.SandboxConfig)
+		return &c
+	case *cri.PullImageRequest:
+		c := *r
+		c.Auth = AuthConfig(r.Auth)
+		c.SandboxConfig = PodSandboxConfig(r.SandboxConfig)
+		return &c
+	case *cri.ExecSyncRequest:
+		c := *r
+		c.Cmd = Command(r.Cmd)
+		return &c
+	case *cri.ExecRequest:
+		c := *r
+		c.Cmd = Command(r.Cmd)
+		return &c
+	}
+	return req
+}
@@ -0,0 +1,130 @@
+package redact
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+const secret = "hunter2"
+
+func TestIsSensitiveKey(t *testing.T) {
+	testCases := []struct {
+		key    string
+		result bool
+	}{
+		{"DB_PASSWORD", true},
+		{"example.com/api-token", true},
+		{"AWS_SECRET_ACCESS_KEY", true},
+		{"kubectl.kubernetes.io/last-applied-configuration", true},
+		{"io.kubernetes.container.restartCount", false},
+		{"app", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			assert.Equal(t, tc.result, IsSensitiveKey(tc.key))
+		})
+	}
+}
+
+func TestSetPatterns(t *testing.T) {
+	defer func() {
+		assert.NoError(t, SetPatterns(DefaultPatterns))
+	}()
+
+	assert.NoError(t, SetPatterns([]string{"example.com/*", " "}))
+	assert.True(t, IsSensitiveKey("EXAMPLE.com/anything"))
+	assert.False(t, IsSensitiveKey("DB_PASSWORD"))
+
+	assert.NoError(t, SetPatterns(nil))
+	assert.False(t, IsSensitiveKey("DB_PASSWORD"))
+}
+
+func TestEnv(t *testing.T) {
+	env := Env([]string{"PATH=/usr/bin", "DB_PASSWORD=" + secret, "EMPTY=", "NOVALUE"})
+	assert.Equal(t, []string{"PATH=" + Mask, "DB_PASSWORD=" + Mask, "EMPTY=" + Mask, "NOVALUE=" + Mask}, env)
+}
+
+func TestCommand(t *testing.T) {
+	assert.Equal(t, []string{"sh", Mask, Mask}, Command([]string{"sh", "-c", "echo " + secret}))
+	assert.Empty(t, Command(nil))
+}
+
+func TestText(t *testing.T) {
+	testCases := []struct {
+		text     string
+		redacted string
+	}{
+		{"login password=" + secret + " user=admin", "login password=" + Mask + " user=admin"},
+		{`{"token": "` + secret + `", "name": "app"}`, `{"token": ` + Mask + `, "name": "app"}`},
+		{"AWS_SECRET_ACCESS_KEY: " + secret + "\nnext", "AWS_SECRET_ACCESS_KEY: " + Mask + "\nnext"},
+		{"pulling https://user:" + secret + "@registry.example.com/v2/", "pulling https://user:" + Mask + "@registry.example.com/v2/"},
+		{"Authorization: Bearer " + secret, "Authorization: " + Mask},
+		{"sending Bearer " + secret, "sending Bearer " + Mask},
+		{"I1019 12:00:00.000000 1 server.go:42] method=Version code=OK", "I1019 12:00:00.000000 1 server.go:42] method=Version code=OK"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.redacted, Text(tc.text))
+	}
+}
+
+func TestAuthConfig(t *testing.T) {
+	auth := AuthConfig(&cri.AuthConfig{
+		Username:      "user",
+		Password:      secret,
+		Auth:          secret,
+		ServerAddress: "registry.example.com",
+		RegistryToken: secret,
+	})
+	assert.Equal(t, "registry.example.com", auth.ServerAddress)
+	assert.Equal(t, Mask, auth.Password)
+	assert.Equal(t, Mask, auth.Username)
+	assert.Equal(t, "", auth.IdentityToken)
+	assert.Nil(t, AuthConfig(nil))
+}
+
+func TestRequestsHaveNoSecrets(t *testing.T) {
+	annotations := map[string]string{
+		"example.com/token": secret,
+		"kubectl.kubernetes.io/last-applied-configuration": `{"env":"` + secret + `"}`,
+	}
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata:    &cri.PodSandboxMetadata{Name: "pod", Namespace: "default"},
+		Annotations: annotations,
+	}
+	requests := []interface{}{
+		&cri.RunPodSandboxRequest{Config: sandboxConfig},
+		&cri.CreateContainerRequest{
+			Config: &cri.ContainerConfig{
+				Metadata:    &cri.ContainerMetadata{Name: "app"},
+				Command:     []string{"app", "--password=" + secret},
+				Args:        []string{secret},
+				Envs:        []*cri.KeyValue{{Key: "ANYTHING", Value: secret}},
+				Annotations: annotations,
+			},
+			SandboxConfig: sandboxConfig,
+		},
+		&cri.PullImageRequest{
+			Image:         &cri.ImageSpec{Image: "registry.example.com/app:v1"},
+			Auth:          &cri.AuthConfig{Username: "user", Password: secret, IdentityToken: secret},
+			SandboxConfig: sandboxConfig,
+		},
+		&cri.ExecSyncRequest{ContainerId: "c1", Cmd: []string{"sh", "-c", "echo " + secret}},
+		&cri.ExecRequest{ContainerId: "c1", Cmd: []string{"login", secret}},
+	}
+
+	for _, req := range requests {
+		t.Run(fmt.Sprintf("%T", req), func(t *testing.T) {
+			for _, format := range []string{"%v", "%+v", "%#v"} {
+				out := fmt.Sprintf(format, Request(req))
+				assert.False(t, strings.Contains(out, secret), "secret in %s", out)
+			}
+			// The original request is left unchanged.
+			assert.True(t, strings.Contains(fmt.Sprintf("%+v", req), secret))
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+
+	"github.com/elotl/procri/pkg/tracing"
+)
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+
+	// Manifests are small, anything bigger than this is rejected.
+	maxManifestSize = 4 << 20
+
+	requestTimeout = 30 * time.Second
+)
+
+// ErrNotFound is returned when a manifest or blob does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Client talks to OCI distribution (Docker registry v2) registries.
+type Client struct {
+	client   *http.Client
+	insecure map[string]bool
+}
+
+// NewClient creates a registry client. Registries in insecureRegistries, e.g.
+// "localhost:5000", are accessed via plain HTTP.
+func NewClient(insecureRegistries []string) *Client {
+	insecure := make(map[string]bool)
+	for _, r := range insecureRegistries {
+		insecure[r] = true
+	}
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				TLSHandshakeTimeout:   requestTimeout,
+				ResponseHeaderTimeout: requestTimeout,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		insecure: insecure,
+	}
+}
+
+// Repository is a repository on a registry, e.g. "library/nginx" on
+// "registry-1.docker.io".
+type Repository struct {
+	client *Client
+	base   string
+	name   string
+	auth   *cri.AuthConfig
+	// Authorization header value, obtained after the first challenge.
+	authorization string
+}
+
+// Repository returns the repository of an image reference, using auth for
+// authentication if it is not nil.
+func (c *Client) Repository(named reference.Named, auth *cri.AuthConfig) *Repository {
+	host := reference.Domain(named)
+	if host == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+	scheme := "https"
+	if c.insecure[host] {
+		scheme = "http"
+	}
+	return &Repository{
+		client: c,
+		base:   fmt.Sprintf("%s://%s/v2/%s", scheme, host, reference.Path(named)),
+		name:   reference.Path(named),
+		auth:   auth,
+	}
+}
+
+// Manifest fetches the manifest or index reference points to, which is a tag
+// or a digest. The content is verified against the digest if reference is
+// one.
+func (r *Repository) Manifest(ctx context.Context, ref string) ([]byte, string, digest.Digest, error) {
+	req, err := http.NewRequest(http.MethodGet, r.base+"/manifests/"+ref, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		specs.MediaTypeImageIndex,
+		specs.MediaTypeImageManifest,
+		MediaTypeDockerManifestList,
+		MediaTypeDockerManifest,
+	}, ", "))
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("reading manifest %s: %v", ref, err)
+	}
+	if len(buf) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("manifest %s is larger than %d bytes", ref, maxManifestSize)
+	}
+
+	dgst := digest.FromBytes(buf)
+	if expected, err := digest.Parse(ref); err == nil {
+		if err := verifyBytes(expected, buf); err != nil {
+			return nil, "", "", fmt.Errorf("manifest %s: %v", ref, err)
+		}
+		dgst = expected
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	if mediaType == "" || mediaType == "application/json" {
+		// Fall back to the mediaType field of the manifest itself.
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		_ = json.Unmarshal(buf, &versioned)
+		mediaType = versioned.MediaType
+	}
+	return buf, mediaType, dgst, nil
+}
+
+// Blob opens the blob with digest dgst. The caller has to verify the content.
+func (r *Repository) Blob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, r.base+"/blobs/"+dgst.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func verifyBytes(expected digest.Digest, buf []byte) error {
+	if err := expected.Validate(); err != nil {
+		return err
+	}
+	verifier := expected.Verifier()
+	_, _ = verifier.Write(buf)
+	if !verifier.Verified() {
+		return fmt.Errorf("digest mismatch, expected %s", expected)
+	}
+	return nil
+}
+
+// do sends a request, authenticating and retrying once if the registry asks
+// for it, also when a token obtained before has expired. Responses other than
+// 200 are turned into errors.
+func (r *Repository) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+	if r.authorization != "" {
+		req.Header.Set("Authorization", r.authorization)
+	}
+	resp, err := r.client.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		if r.authorization != "" {
+			klog.V(4).Infof("%s rejected the authorization, authenticating again", r.base)
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		drain(resp)
+		r.authorization, err = r.authenticate(ctx, challenge)
+		if err != nil {
+			return nil, fmt.Errorf("authenticating to %s: %v", r.base, err)
+		}
+		retry := req.Clone(ctx)
+		retry.Header.Set("Authorization", r.authorization)
+		resp, err = r.client.client.Do(retry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		drain(resp)
+		return nil, fmt.Errorf("GET %s: %w", req.URL.Redacted(), ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer drain(resp)
+		return nil, fmt.Errorf("GET %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return resp, nil
+}
+
+func drain(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+// basicCredentials returns the user name and password from auth, decoding
+// the base64 "user:password" Auth field if they are not set directly.
+func basicCredentials(auth *cri.AuthConfig) (string, string) {
+	if auth == nil {
+		return "", ""
+	}
+	if auth.Username != "" || auth.Password != "" {
+		return auth.Username, auth.Password
+	}
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err == nil {
+			if parts := strings.SplitN(string(decoded), ":", 2); len(parts) == 2 {
+				return parts[0], parts[1]
+			}
+		}
+	}
+	return "", ""
+}
+
+// authenticate answers a WWW-Authenticate challenge and returns the value of
+// the Authorization header to use.
+func (r *Repository) authenticate(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		user, password := basicCredentials(r.auth)
+		if user == "" && password == "" {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)), nil
+	case "bearer":
+		if r.auth != nil && r.auth.RegistryToken != "" {
+			return "Bearer " + r.auth.RegistryToken, nil
+		}
+		token, err := r.fetchToken(ctx, params)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+}
+
+// fetchToken gets a bearer token from the token server named in a challenge,
+// as described in the Docker registry token authentication specification.
+func (r *Repository) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+	realmURL, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %v", realm, err)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", r.name)
+	}
+
+	var req *http.Request
+	if r.auth != nil && r.auth.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", r.auth.IdentityToken)
+		form.Set("service", params["service"])
+		form.Set("scope", scope)
+		form.Set("client_id", "procri")
+		req, err = http.NewRequest(http.MethodPost, realmURL.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realmURL.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", scope)
+		realmURL.RawQuery = query.Encode()
+		req, err = http.NewRequest(http.MethodGet, realmURL.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if user, password := basicCredentials(r.auth); user != "" || password != "" {
+			req.SetBasicAuth(user, password)
+		}
+	}
+
+	resp, err := r.client.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token server %s returned %s", realmURL.Host, resp.Status)
+	}
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("decoding token response: %v", err)
+	}
+	if tokenResp.Token == "" {
+		tokenResp.Token = tokenResp.AccessToken
+	}
+	if tokenResp.Token == "" {
+		return "", fmt.Errorf("token server %s returned no token", realmURL.Host)
+	}
+	klog.V(5).Infof("got registry token from %s for %s", realmURL.Host, scope)
+	return tokenResp.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header value, e.g.
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var sb strings.Builder
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				sb.WriteByte(rest[j])
+			}
+			value = sb.String()
+			if j < len(rest) {
+				j++
+			}
+			rest = rest[j:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// fakeRegistry serves manifests and blobs of the repository "app" at their
+// paths, with the content type in types. If token is set, requests need it
+// as bearer token, handed out by /token.
+type fakeRegistry struct {
+	*httptest.Server
+	content map[string][]byte
+	types   map[string]string
+	token   string
+	// Checks the requests to /token, e.g. for credentials, if set.
+	checkTokenRequest func(*http.Request) bool
+
+	tokenRequests int
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		content: make(map[string][]byte),
+		types:   make(map[string]string),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.tokenRequests++
+		if r.checkTokenRequest != nil && !r.checkTokenRequest(req) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": %q}`, r.token)
+		return
+	}
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	buf, ok := r.content[req.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if mediaType := r.types[req.URL.Path]; mediaType != "" {
+		w.Header().Set("Content-Type", mediaType)
+	}
+	_, _ = w.Write(buf)
+}
+
+func (r *fakeRegistry) repository(t *testing.T, auth *cri.AuthConfig) *Repository {
+	host := strings.TrimPrefix(r.URL, "http://")
+	named, err := reference.ParseNormalizedNamed(host + "/app")
+	require.NoError(t, err)
+	return NewClient([]string{host}).Repository(named, auth)
+}
+
+func TestTokenChallenge(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.content["/v2/app/manifests/v1"] = []byte(`{}`)
+	reg.token = "token-1"
+	reg.checkTokenRequest = func(req *http.Request) bool {
+		user, password, _ := req.BasicAuth()
+		return user == "robot" && password == "hunter2" &&
+			req.URL.Query().Get("service") == "fake" &&
+			req.URL.Query().Get("scope") == "repository:app:pull"
+	}
+	ctx := context.Background()
+
+	// The credentials are sent to the token server, and the token is kept.
+	repo := reg.repository(t, &cri.AuthConfig{Auth: "cm9ib3Q6aHVudGVyMg=="})
+	for i := 0; i < 2; i++ {
+		_, _, _, err := repo.Manifest(ctx, "v1")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, reg.tokenRequests)
+
+	// Expired tokens are renewed.
+	reg.token = "token-2"
+	_, _, _, err := repo.Manifest(ctx, "v1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, reg.tokenRequests)
+
+	_, _, _, err = reg.repository(t, &cri.AuthConfig{Username: "robot", Password: "wrong"}).Manifest(ctx, "v1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "token server")
+
+	// Identity tokens are exchanged with a POST.
+	reg.checkTokenRequest = func(req *http.Request) bool {
+		return req.Method == http.MethodPost && req.FormValue("grant_type") == "refresh_token" &&
+			req.FormValue("refresh_token") == "identity"
+	}
+	_, _, _, err = reg.repository(t, &cri.AuthConfig{IdentityToken: "identity"}).Manifest(ctx, "v1")
+	require.NoError(t, err)
+}
+
+func TestManifest(t *testing.T) {
+	reg := newFakeRegistry(t)
+	index := []byte(`{"schemaVersion": 2, "mediaType": "` + MediaTypeDockerManifestList + `", "manifests": []}`)
+	indexDigest := digest.FromBytes(index)
+	reg.content["/v2/app/manifests/list"] = index
+	reg.types["/v2/app/manifests/list"] = MediaTypeDockerManifestList + "; charset=utf-8"
+	reg.content["/v2/app/manifests/"+indexDigest.String()] = index
+	reg.types["/v2/app/manifests/"+indexDigest.String()] = MediaTypeDockerManifestList
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "` + specs.MediaTypeImageManifest + `"}`)
+	reg.content["/v2/app/manifests/untyped"] = manifest
+	reg.types["/v2/app/manifests/untyped"] = "application/json"
+	wrong := digest.FromString("other")
+	reg.content["/v2/app/manifests/"+wrong.String()] = manifest
+	reg.content["/v2/app/manifests/huge"] = make([]byte, maxManifestSize+1)
+	repo := reg.repository(t, nil)
+	ctx := context.Background()
+
+	testCases := []struct {
+		ref       string
+		mediaType string
+		digest    digest.Digest
+		err       string
+	}{
+		{ref: "list", mediaType: MediaTypeDockerManifestList, digest: indexDigest},
+		{ref: indexDigest.String(), mediaType: MediaTypeDockerManifestList, digest: indexDigest},
+		{ref: "untyped", mediaType: specs.MediaTypeImageManifest, digest: digest.FromBytes(manifest)},
+		{ref: wrong.String(), err: "digest mismatch"},
+		{ref: "huge", err: "larger than"},
+		{ref: "missing", err: "not found"},
+	}
+	for _, tc := range testCases {
+		buf, mediaType, dgst, err := repo.Manifest(ctx, tc.ref)
+		if tc.err != "" {
+			if assert.Error(t, err, tc.ref) {
+				assert.Contains(t, err.Error(), tc.err, tc.ref)
+			}
+			continue
+		}
+		assert.NoError(t, err, tc.ref)
+		assert.Equal(t, tc.mediaType, mediaType, tc.ref)
+		assert.Equal(t, tc.digest, dgst, tc.ref)
+		assert.Equal(t, tc.digest, digest.FromBytes(buf), tc.ref)
+	}
+
+	// The manifest list can be decoded, for the caller to select one.
+	buf, _, _, err := repo.Manifest(ctx, "list")
+	require.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(buf, &specs.Index{}))
+}
+
+func TestBlob(t *testing.T) {
+	reg := newFakeRegistry(t)
+	blob := []byte("layer")
+	dgst := digest.FromBytes(blob)
+	reg.content["/v2/app/blobs/"+dgst.String()] = blob
+	repo := reg.repository(t, nil)
+	ctx := context.Background()
+
+	body, err := repo.Blob(ctx, dgst)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(body)
+	body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, blob, buf)
+
+	_, err = repo.Blob(ctx, digest.FromString("missing"))
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestParseChallenge(t *testing.T) {
+	testCases := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			header: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`,
+			scheme: "Bearer",
+			params: map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io"},
+		},
+		{
+			header: `Bearer realm="https://r/token", scope="repository:a,b:pull",service=r`,
+			scheme: "Bearer",
+			params: map[string]string{"realm": "https://r/token", "scope": "repository:a,b:pull", "service": "r"},
+		},
+		{
+			header: `Basic realm="quoted \"name\""`,
+			scheme: "Basic",
+			params: map[string]string{"realm": `quoted "name"`},
+		},
+		{header: "Basic", scheme: "Basic", params: map[string]string{}},
+	}
+	for _, tc := range testCases {
+		scheme, params := parseChallenge(tc.header)
+		assert.Equal(t, tc.scheme, scheme, tc.header)
+		assert.Equal(t, tc.params, params, tc.header)
+	}
+}
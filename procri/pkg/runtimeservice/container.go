@@ -11,6 +11,10 @@ import (
 	"time"
 
 	"github.com/creack/pty"
+	"github.com/elotl/procri/pkg/imagestore"
+	"github.com/elotl/procri/pkg/metrics"
+	"github.com/elotl/procri/pkg/redact"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/xid"
 	"golang.org/x/net/context"
 	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
@@ -23,54 +27,33 @@ const (
 	defaultPath     = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 )
 
-var (
-	containerPathAllowList    = []string{}
-	containerPathDisallowList = []string{
-		"/etc",
-		"/usr",
-		"/bin",
-		"/sbin",
-		"/Library",
-	}
-)
-
 type Container struct {
-	ID          string             `json:"id"`
-	PodID       string             `json:"podID"`
-	Name        string             `json:"name"`
-	Attempt     uint32             `json:"attempt"`
-	Args        []string           `json:"args"`
-	Command     []string           `json:"command"`
-	Env         []string           `json:"env"`
-	WorkingDir  string             `json:"workingDir"`
-	LogPath     string             `json:"logPath"`
-	Pid         int                `json:"pid"`
-	CreatedAt   int64              `json:"createdAt"`
-	StartedAt   int64              `json:"startedAt"`
-	FinishedAt  int64              `json:"finishedAt"`
-	ExitCode    int32              `json:"exitCode"`
-	Image       string             `json:"image"`
-	State       cri.ContainerState `json:"state"`
-	Labels      map[string]string  `json:"labels"`
-	Annotations map[string]string  `json:"annotations"`
-}
-
-func isPathAllowed(containerPath string) bool {
-	// Check if this container path is explicitly allowed.
-	for _, allowedPath := range containerPathAllowList {
-		if isInsidePath(containerPath, allowedPath) {
-			return true
-		}
-	}
-
-	// Check if this container path is explicitly disallowed.
-	for _, disallowedPath := range containerPathDisallowList {
-		if isInsidePath(containerPath, disallowedPath) {
-			return false
-		}
-	}
-
-	return true
+	ID         string   `json:"id"`
+	PodID      string   `json:"podID"`
+	Name       string   `json:"name"`
+	Attempt    uint32   `json:"attempt"`
+	Args       []string `json:"args"`
+	Command    []string `json:"command"`
+	Env        []string `json:"env"`
+	WorkingDir string   `json:"workingDir"`
+	LogPath    string   `json:"logPath"`
+	Pid        int      `json:"pid"`
+	CreatedAt  int64    `json:"createdAt"`
+	StartedAt  int64    `json:"startedAt"`
+	FinishedAt int64    `json:"finishedAt"`
+	ExitCode   int32    `json:"exitCode"`
+	Image      string   `json:"image"`
+	ImageRef   string   `json:"imageRef,omitempty"`
+	RootFS     string   `json:"rootfs,omitempty"`
+	User       string   `json:"user,omitempty"`
+	StopSignal string   `json:"stopSignal,omitempty"`
+	Mounts     []Mount  `json:"mounts,omitempty"`
+	// ReadOnlyUnenforced is why the read-only volumes or root filesystem
+	// of the container are not enforced, if they aren't.
+	ReadOnlyUnenforced string             `json:"readOnlyUnenforced,omitempty"`
+	State              cri.ContainerState `json:"state"`
+	Labels             map[string]string  `json:"labels"`
+	Annotations        map[string]string  `json:"annotations"`
 }
 
 func makeContainerKey(key string) string {
@@ -141,64 +124,101 @@ func (rs *RuntimeService) listContainers() []*Container {
 	return list
 }
 
-func makeEnvList(envs []*cri.KeyValue) []string {
-	hostname, err := os.Hostname()
-	if err != nil {
-		klog.Warningf("Hostname(): %v", err)
-	}
+// containerDir returns the directory holding the data of a container that
+// lives outside of the data store, e.g. its root filesystem.
+func (rs *RuntimeService) containerDir(podID, cid string) string {
+	return filepath.Join(rs.podsDir, podID, "containers", cid)
+}
 
-	defaultEnvMap := make(map[string]string)
-	defaultEnvMap["HOSTNAME"] = hostname
-	defaultEnvMap["TERM"] = "xterm"
-	defaultEnvMap["HOME"] = "/"
-	defaultEnvMap["PATH"] = defaultPath
+// removeContainerDir deletes the directory of a container and the links of its
+// volumes. RootFS is left alone, containers of older versions of procri run in
+// the image root.
+func (rs *RuntimeService) removeContainerDir(cnt *Container) {
+	unlinkHostPaths(cnt, rs.hostRoot)
+	removeMounts(cnt)
+	dir := rs.containerDir(cnt.PodID, cnt.ID)
+	// Read-only roots and volumes have to be made writable to be removed.
+	makeRemovable(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		klog.Warningf("removing directory of container %s: %v", cnt.ID, err)
+	}
+}
 
+// makeEnvList returns the environment variables of a container config in
+// NAME=value form.
+func makeEnvList(envs []*cri.KeyValue) []string {
 	ret := make([]string, 0, len(envs))
-
 	for _, kv := range envs {
-		delete(defaultEnvMap, kv.Key)
 		ret = append(ret, fmt.Sprintf("%s=%s", kv.Key, kv.Value))
 	}
-
-	for k, v := range defaultEnvMap {
-		ret = append(ret, fmt.Sprintf("%s=%s", k, v))
-	}
-
-	klog.V(5).Infof("created env %v", ret)
 	return ret
 }
 
-//
-// Implementation of container calls in cri.Runtimeservice.
-//
-
-func symlinkToContainerPath(hostPath, containerPath string) error {
-	if !isPathAllowed(containerPath) {
-		klog.Warningf("mount %s->%s is not allowed", hostPath, containerPath)
-		return nil
+// defaultEnv returns the variables containers get unless their image or
+// config sets them: the hostname of the pod, a PATH, and the home directory,
+// name and temporary directory of the user processes run as.
+func (rs *RuntimeService) defaultEnv(pod *Sandbox, cnt *Container) []string {
+	env := []string{
+		"HOSTNAME=" + pod.hostname(),
+		"TERM=xterm",
+		"PATH=" + defaultPath,
+	}
+	home := "/"
+	if usr := lookupRunUser(cnt.User); usr != nil {
+		if usr.HomeDir != "" {
+			home = usr.HomeDir
+		}
+		env = append(env, "USER="+usr.Username)
 	}
+	env = append(env, "HOME="+home, "TMPDIR="+rs.podTmpDir(pod.ID))
+	return env
+}
 
-	// This will symlink any volume mount from its host path to the path
-	// where the pod expects it to be. Note: this will overwrite files or
-	// empty directories at the host path (but not host path directories
-	// that are not empty).
-	if err := os.Remove(containerPath); err != nil {
-		return err
+// resolveEntrypoint finds the executable of a container in the root the
+// image is unpacked to. Names without a slash are looked up in the
+// directories of PATH inside the root first, then on the host, so images can
+// use host tools like sh.
+func resolveEntrypoint(root, name string, env []string) (string, error) {
+	if strings.Contains(name, "/") {
+		path, err := imagestore.ResolveInRoot(root, name)
+		if err != nil {
+			return "", err
+		}
+		if !isExecutable(path) {
+			return "", fmt.Errorf("%s not found in image or not executable", name)
+		}
+		return path, nil
 	}
-	if err := os.MkdirAll(filepath.Dir(containerPath), 0755); err != nil {
-		return err
+
+	searchPath := defaultPath
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			searchPath = strings.TrimPrefix(kv, "PATH=")
+		}
 	}
-	if err := os.Symlink(hostPath, containerPath); err != nil {
-		return err
+	for _, dir := range filepath.SplitList(searchPath) {
+		if dir == "" {
+			continue
+		}
+		path, err := imagestore.ResolveInRoot(root, filepath.Join(dir, name))
+		if err == nil && isExecutable(path) {
+			return path, nil
+		}
 	}
-	klog.V(3).Infof("symlinked volume mount %s->%s", hostPath, containerPath)
-	return nil
+	return exec.LookPath(name)
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
 }
 
+//
+// Implementation of container calls in cri.Runtimeservice.
+//
+
 // CreateContainer creates a new container in specified PodSandbox
 func (rs *RuntimeService) CreateContainer(ctx context.Context, req *cri.CreateContainerRequest) (*cri.CreateContainerResponse, error) {
-	klog.V(4).Infof("CreateContainer config %+v", req.Config)
-
 	// Required parameters.
 	if req.Config == nil {
 		klog.Errorf("CreateContainer: nil config")
@@ -221,17 +241,7 @@ func (rs *RuntimeService) CreateContainer(ctx context.Context, req *cri.CreateCo
 	klog.V(2).Infof("CreateContainer %s", name)
 
 	cid := xid.New().String()
-
-	for _, m := range req.Config.Mounts {
-		klog.V(5).Infof("CreateContainer %s %s -> %s", cid, m.HostPath, m.ContainerPath)
-		if m.HostPath == m.ContainerPath {
-			continue
-		}
-		err := symlinkToContainerPath(m.HostPath, m.ContainerPath)
-		if err != nil {
-			return nil, SymlinkError(err.Error())
-		}
-	}
+	klog.V(5).Infof("CreateContainer %s config %+v", cid, redact.ContainerConfig(req.Config))
 
 	sandboxMetadata := req.SandboxConfig.Metadata
 	podID := makePodID(sandboxMetadata.Namespace, sandboxMetadata.Name)
@@ -249,6 +259,48 @@ func (rs *RuntimeService) CreateContainer(ctx context.Context, req *cri.CreateCo
 		return nil, InvalidParameterError(err.Error())
 	}
 
+	for _, m := range req.Config.Mounts {
+		if err := rs.mountPolicy.Check(m.ContainerPath, sandboxMetadata.Namespace); err != nil {
+			klog.Errorf("CreateContainer %s: %v", cid, err)
+			return nil, InvalidParameterError(err.Error())
+		}
+	}
+
+	imageRef, rootfs := req.Config.Image.Image, ""
+	var imageConfig *specs.ImageConfig
+	if rs.images != nil {
+		var err error
+		imageRef, rootfs, err = rs.images.ResolveImage(req.Config.Image.Image)
+		if err == nil {
+			imageConfig, err = rs.images.ImageConfig(imageRef)
+		}
+		if err != nil {
+			klog.Errorf("CreateContainer %s: %v", cid, err)
+			return nil, InvalidParameterError(err.Error())
+		}
+	}
+	if rootfs != "" {
+		// Each container writes to its own copy of the image root.
+		clone := filepath.Join(rs.containerDir(podID, cid), "rootfs")
+		if err := os.MkdirAll(filepath.Dir(clone), 0755); err != nil {
+			klog.Errorf("CreateContainer %s: %v", cid, err)
+			return nil, err
+		}
+		if err := imagestore.CloneTree(rootfs, clone); err != nil {
+			klog.Errorf("CreateContainer %s: cloning root filesystem: %v", cid, err)
+			_ = os.RemoveAll(rs.containerDir(podID, cid))
+			return nil, fmt.Errorf("container %s root filesystem: %v", cid, err)
+		}
+		rootfs = clone
+	}
+
+	// Pods of older versions of procri have none of their files yet.
+	if err := rs.setUpPod(pod); err != nil {
+		klog.Errorf("CreateContainer %s: %v", cid, err)
+		_ = os.RemoveAll(rs.containerDir(podID, cid))
+		return nil, err
+	}
+
 	pod.Containers = append(pod.Containers, cid)
 
 	logPath := ""
@@ -263,6 +315,8 @@ func (rs *RuntimeService) CreateContainer(ctx context.Context, req *cri.CreateCo
 		Name:        req.Config.Metadata.Name,
 		Attempt:     req.Config.Metadata.Attempt,
 		Image:       req.Config.Image.Image,
+		ImageRef:    imageRef,
+		RootFS:      rootfs,
 		Args:        req.Config.Args,
 		Command:     req.Config.Command,
 		WorkingDir:  req.Config.WorkingDir,
@@ -272,6 +326,43 @@ func (rs *RuntimeService) CreateContainer(ctx context.Context, req *cri.CreateCo
 		Labels:      req.Config.Labels,
 		Annotations: req.Config.Annotations,
 	}
+	applyImageConfig(&container, req.Config, imageConfig)
+	if setsUser(req.Config) {
+		container.User = runAsUser(req.Config)
+	}
+	// Permissions are still removed, but can't be relied on.
+	if reason := unenforcedReadOnly(&container, req.Config); reason != "" {
+		klog.Warningf("CreateContainer %s: read-only volumes and root filesystem are not enforced: %s", cid, reason)
+		container.ReadOnlyUnenforced = reason
+	}
+	container.Env = mergeEnv(rs.defaultEnv(pod, &container), container.Env)
+
+	root := rs.containerRoot(&container)
+	mounts, err := setUpMounts(cid, rs.containerDir(podID, cid), root, req.Config.Mounts)
+	container.Mounts = mounts
+	if err == nil {
+		err = rs.linkPodFiles(pod, root, &container)
+	}
+	if err == nil && req.Config.GetLinux().GetSecurityContext().GetReadonlyRootfs() {
+		// Only the volumes, being symlinks, stay writable.
+		err = makeReadOnly(root)
+	}
+	if err == nil {
+		err = setUpKubeconfig(rs.containerDir(podID, cid), sandboxMetadata.Namespace, &container)
+	}
+	if err != nil {
+		klog.Errorf("CreateContainer %s: %v", cid, err)
+		rs.removeContainerDir(&container)
+		return nil, SymlinkError(err.Error())
+	}
+	container.Env = mergeEnv(container.Env, []string{rootEnv + "=" + root})
+	for _, path := range linkHostPaths(&container, rs.hostRoot) {
+		if path == serviceAccountPath {
+			klog.Warningf("CreateContainer %s: %s is taken, in-cluster clients of the container read what is there, e.g. the service account of another pod", cid, path)
+		}
+	}
+	klog.V(5).Infof("CreateContainer %s env %v", cid, redact.Env(container.Env))
+
 	rs.putContainer(cid, &container)
 
 	rs.putSandbox(podID, pod)
@@ -320,8 +411,6 @@ func (rs *RuntimeService) trackContainerProcess(containerID string, cmd *exec.Cm
 
 // StartContainer starts the container.
 func (rs *RuntimeService) StartContainer(ctx context.Context, req *cri.StartContainerRequest) (*cri.StartContainerResponse, error) {
-	klog.V(4).Infof("StartContainer request %+v", req)
-
 	cid := req.ContainerId
 	container := rs.getContainer(cid)
 	if container == nil {
@@ -344,10 +433,34 @@ func (rs *RuntimeService) StartContainer(ctx context.Context, req *cri.StartCont
 	}
 	klog.V(5).Infof("StartContainer %s LogPath: %s", cid, container.LogPath)
 
+	dir := container.WorkingDir
+	if container.RootFS != "" {
+		entrypoint, err := resolveEntrypoint(container.RootFS, commandArgs[0], container.Env)
+		if err != nil {
+			klog.Errorf("StartContainer %s: %v", cid, err)
+			return nil, fmt.Errorf("container %s start failed: %s", cid, err)
+		}
+		commandArgs = append([]string{entrypoint}, commandArgs[1:]...)
+		dir, err = imagestore.ResolveInRoot(container.RootFS, container.WorkingDir)
+		if err != nil {
+			klog.Errorf("StartContainer %s: %v", cid, err)
+			return nil, fmt.Errorf("container %s start failed: %s", cid, err)
+		}
+	}
+
+	credential, err := userCredential(container.User)
+	if err != nil {
+		klog.Errorf("StartContainer %s: %v", cid, err)
+		return nil, fmt.Errorf("container %s start failed: %s", cid, err)
+	}
+
 	// Don't use Setpgid, it will fail since pty sets the new process as a session leader.
 	cmd := exec.Command(commandArgs[0], commandArgs[1:]...)
 	cmd.Env = container.Env
-	cmd.Dir = container.WorkingDir
+	cmd.Dir = dir
+	if credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -367,7 +480,7 @@ func (rs *RuntimeService) StartContainer(ctx context.Context, req *cri.StartCont
 		return nil, fmt.Errorf("container %s start failed: %s", cid, err)
 	}
 
-	lp, err := NewLogPipe(stdout, stderr, container.LogPath)
+	lp, err := NewLogPipe(cid, stdout, stderr, container.LogPath)
 	if err != nil {
 		klog.Errorf("StartContainer %s: NewLogPipe %v", cid, err)
 		return nil, fmt.Errorf("container %s start failed: %s", cid, err)
@@ -415,7 +528,15 @@ func (rs *RuntimeService) terminateContainer(ctx context.Context, container *Con
 		pidToKill = -pgID
 	}
 
-	err = syscall.Kill(pidToKill, syscall.SIGTERM)
+	stopSignal := syscall.SIGTERM
+	if container.StopSignal != "" {
+		stopSignal, err = parseSignal(container.StopSignal)
+		if err != nil {
+			klog.Warningf("container %s stop signal: %v, using SIGTERM", cid, err)
+			stopSignal = syscall.SIGTERM
+		}
+	}
+	err = syscall.Kill(pidToKill, stopSignal)
 	if err != nil {
 		klog.Warningf("trying to gracefully stop container %s process %d: %v", cid, pidToKill, err)
 		_ = syscall.Kill(pidToKill, syscall.SIGKILL)
@@ -424,6 +545,7 @@ func (rs *RuntimeService) terminateContainer(ctx context.Context, container *Con
 
 	tick := time.NewTicker(500 * time.Millisecond)
 	defer tick.Stop()
+	deadline := time.After(time.Duration(timeout) * time.Second)
 
 	for {
 		select {
@@ -437,7 +559,7 @@ func (rs *RuntimeService) terminateContainer(ctx context.Context, container *Con
 				klog.V(5).Infof("exit code for container %s process %d: %d", cid, container.Pid, container.ExitCode)
 				return nil
 			}
-		case <-time.After(time.Duration(timeout) * time.Second):
+		case <-deadline:
 			klog.Warningf("timeout waiting for container %s process %d", cid, container.Pid)
 			_ = proc.Signal(syscall.SIGKILL)
 			return nil
@@ -454,8 +576,6 @@ func (rs *RuntimeService) terminateContainer(ctx context.Context, container *Con
 // This call is idempotent, and must not return an error if the container has
 // already been stopped.
 func (rs *RuntimeService) StopContainer(ctx context.Context, req *cri.StopContainerRequest) (*cri.StopContainerResponse, error) {
-	klog.V(4).Infof("StopContainer request %+v", req)
-
 	cid := req.ContainerId
 	container := rs.getContainer(cid)
 	if container == nil {
@@ -478,8 +598,6 @@ func (rs *RuntimeService) StopContainer(ctx context.Context, req *cri.StopContai
 // This call is idempotent, and must not return an error if the container has
 // already been removed.
 func (rs *RuntimeService) RemoveContainer(ctx context.Context, req *cri.RemoveContainerRequest) (*cri.RemoveContainerResponse, error) {
-	klog.V(4).Infof("RemoveContainer request %+v", req)
-
 	cid := req.ContainerId
 	container := rs.getContainer(cid)
 	if container == nil {
@@ -507,11 +625,36 @@ func (rs *RuntimeService) RemoveContainer(ctx context.Context, req *cri.RemoveCo
 		return nil, err
 	}
 	rs.deleteContainer(cid)
+	rs.removeContainerDir(container)
+	metrics.DeleteContainer(cid)
 
 	klog.V(2).Infof("RemoveContainer %s success", req.ContainerId)
 	return &cri.RemoveContainerResponse{}, nil
 }
 
+// imageRef returns the ID of the image the container was created from.
+// Containers of older versions of procri only have the image name.
+func (cnt *Container) imageRef() string {
+	if cnt.ImageRef != "" {
+		return cnt.ImageRef
+	}
+	return cnt.Image
+}
+
+// ImagesInUse returns the images containers were created from.
+func (rs *RuntimeService) ImagesInUse() []string {
+	seen := make(map[string]bool)
+	images := make([]string, 0)
+	for _, cnt := range rs.listContainers() {
+		image := cnt.imageRef()
+		if !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
 func containerToCRIContainer(cnt *Container) *cri.Container {
 	return &cri.Container{
 		Id:           cnt.ID,
@@ -527,20 +670,17 @@ func containerToCRIContainer(cnt *Container) *cri.Container {
 		Image: &cri.ImageSpec{
 			Image: cnt.Image,
 		},
-		ImageRef: cnt.Image,
+		ImageRef: cnt.imageRef(),
 	}
 }
 
 // ListContainers lists all containers by filters.
 func (rs *RuntimeService) ListContainers(ctx context.Context, req *cri.ListContainersRequest) (*cri.ListContainersResponse, error) {
-	klog.V(4).Infof("ListContainers request %+v", req)
-
 	filteredContainers := filterContainers(rs.listContainers(), req.Filter)
 	result := make([]*cri.Container, 0, len(filteredContainers))
 	for _, cnt := range filteredContainers {
 		result = append(result, containerToCRIContainer(cnt))
 	}
-	klog.V(4).Infof("ListContainers request %v: containers %v (%d)", req, result, len(result))
 	return &cri.ListContainersResponse{
 		Containers: result,
 	}, nil
@@ -549,8 +689,6 @@ func (rs *RuntimeService) ListContainers(ctx context.Context, req *cri.ListConta
 // ContainerStatus returns status of the container. If the container is not
 // present, returns an error.
 func (rs *RuntimeService) ContainerStatus(ctx context.Context, req *cri.ContainerStatusRequest) (*cri.ContainerStatusResponse, error) {
-	klog.V(4).Infof("ContainerStatus request %+v", req)
-
 	cid := req.ContainerId
 	container := rs.getContainer(cid)
 	if container == nil {
@@ -573,40 +711,34 @@ func (rs *RuntimeService) ContainerStatus(ctx context.Context, req *cri.Containe
 			Image: &cri.ImageSpec{
 				Image: container.Image,
 			},
-			ImageRef:    container.Image,
+			ImageRef:    container.imageRef(),
 			Reason:      "",
 			Message:     "",
 			Labels:      container.Labels,
 			Annotations: container.Annotations,
-			Mounts:      make([]*cri.Mount, 0),
+			Mounts:      mountsToCRIMounts(container.Mounts),
 			LogPath:     container.LogPath,
 		},
 		Info: make(map[string]string),
 	}
+	if req.Verbose && container.ReadOnlyUnenforced != "" {
+		resp.Info["readOnlyUnenforced"] = container.ReadOnlyUnenforced
+	}
 
-	klog.V(4).Infof("ContainerStatus %s: %+v", cid, resp)
 	return &resp, nil
 }
 
 // UpdateContainerResources updates ContainerConfig of the container.
 func (rs *RuntimeService) UpdateContainerResources(ctx context.Context, req *cri.UpdateContainerResourcesRequest) (*cri.UpdateContainerResourcesResponse, error) {
-	klog.V(4).Infof("UpdateContainerResources %+v", req)
-
 	// TODO: check if resource spec has changed.
 	klog.V(4).Infof("UpdateContainerResources %s resource spec %#v",
 		req.ContainerId, req.Linux)
 
-	klog.V(4).Infof("UpdateContainerResources for %s succeeded", req.ContainerId)
 	return &cri.UpdateContainerResourcesResponse{}, nil
 }
 
 func (rs *RuntimeService) ReopenContainerLog(ctx context.Context, req *cri.ReopenContainerLogRequest) (*cri.ReopenContainerLogResponse, error) {
-	klog.V(4).Infof("ReopenContainerLog %+v", req)
-
 	// TODO: supporting this is non-trivial if the container process is running.
-
-	klog.Errorf("ReopenContainerLog %+v: not supported", req)
-
 	return nil, fmt.Errorf("ReopenContainerLog is not supported")
 }
 
@@ -1,59 +1,854 @@
 package runtimeservice
 
 import (
-	"sort"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/peterbourgon/diskv"
+	"github.com/rs/xid"
+	"golang.org/x/net/context"
 	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
 
+	"github.com/elotl/procri/pkg/klogtest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestIsPathAllowed(t *testing.T) {
+func TestResolveEntrypoint(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "opt/app/bin"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "opt/app/bin/server"), []byte("#!/bin/sh\n"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "opt/app/bin/data"), []byte("data"), 0644))
+	assert.NoError(t, os.Symlink("/opt/app/bin/server", filepath.Join(root, "opt/app/bin/link")))
+	hostSh, err := exec.LookPath("sh")
+	assert.NoError(t, err)
+
 	testCases := []struct {
-		p      string
-		result bool
+		name     string
+		env      []string
+		expected string
+		err      bool
 	}{
+		{name: "/opt/app/bin/server", expected: filepath.Join(root, "opt/app/bin/server")},
+		{name: "/opt/app/bin/link", expected: filepath.Join(root, "opt/app/bin/server")},
+		{name: "server", env: []string{"PATH=/usr/bin:/opt/app/bin"}, expected: filepath.Join(root, "opt/app/bin/server")},
+		{name: "sh", expected: hostSh},
+		{name: "/opt/app/bin/data", err: true},
+		{name: "/opt/app/bin/missing", err: true},
+		{name: "server", err: true},
+	}
+	for _, tc := range testCases {
+		path, err := resolveEntrypoint(root, tc.name, tc.env)
+		if tc.err {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, path, tc.name)
+	}
+}
+
+// configImageResolver resolves every image to a host image with config.
+type configImageResolver struct {
+	config *specs.ImageConfig
+}
+
+func (r configImageResolver) ResolveImage(image string) (string, string, error) {
+	return "sha256:" + strings.Repeat("c", 64), "", nil
+}
+
+func (r configImageResolver) ImageConfig(image string) (*specs.ImageConfig, error) {
+	return r.config, nil
+}
+
+func TestContainerEnv(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	rs.images = configImageResolver{&specs.ImageConfig{
+		Env: []string{"PATH=/image/bin", "TERM=vt100", "FROM_IMAGE=1"},
+	}}
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "web-0", Namespace: "default", Uid: "uid"},
+		Hostname: "web-0",
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+	resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_web-0",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+			Envs: []*cri.KeyValue{
+				{Key: "TERM", Value: "dumb"},
+				{Key: "MY_ENV", Value: "dummy"},
+				{Key: "PROCRI_ROOT", Value: "/elsewhere"},
+			},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.NoError(t, err)
+	cnt := rs.getContainer(resp.ContainerId)
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	// Defaults lose to the image, which loses to the pod, and procri
+	// decides where the root is.
+	env := make(map[string]string)
+	for _, kv := range cnt.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	assert.Equal(t, map[string]string{
+		"HOSTNAME":    "web-0",
+		"PATH":        "/image/bin",
+		"TERM":        "dumb",
+		"FROM_IMAGE":  "1",
+		"MY_ENV":      "dummy",
+		"USER":        current.Username,
+		"HOME":        current.HomeDir,
+		"TMPDIR":      filepath.Join(rs.podsDir, "default_web-0", "tmp"),
+		"PROCRI_ROOT": rs.containerRoot(cnt),
+	}, env)
+	info, err := os.Stat(env["TMPDIR"])
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.ModeDir|os.ModeSticky|0777, info.Mode())
+	}
+	assertFileContent(t, filepath.Join(rs.containerRoot(cnt), "etc", "hosts"),
+		"# Kubernetes-managed hosts file (procri).\n127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n127.0.0.1\tweb-0\n")
+}
+
+func TestPodHostsMount(t *testing.T) {
+	// Kubelet mounts its hosts file, with the HostAliases of the pod.
+	hosts := filepath.Join(t.TempDir(), "etc-hosts")
+	assert.NoError(t, ioutil.WriteFile(hosts, []byte("# Entries added by HostAliases.\n10.0.0.1\tdb\n"), 0644))
+	rs := newTestRuntimeService(t)
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+	resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_pod",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+			Mounts:   []*cri.Mount{{ContainerPath: "/etc/hosts", HostPath: hosts}},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.NoError(t, err)
+	cnt := rs.getContainer(resp.ContainerId)
+	assertFileContent(t, filepath.Join(rs.containerRoot(cnt), "etc", "hosts"), "# Entries added by HostAliases.\n10.0.0.1\tdb\n")
+}
+
+func newTestRuntimeService(t *testing.T) *RuntimeService {
+	dataStore := diskv.New(diskv.Options{BasePath: t.TempDir()})
+	rs, err := NewRuntimeService(nil, "127.0.0.1", dataStore, t.TempDir(), "v0.0.1", nil)
+	assert.NoError(t, err)
+	rs.hostRoot = t.TempDir()
+	return rs
+}
+
+func TestSecretsAreNotLogged(t *testing.T) {
+	secret := "hunter2-" + xid.New().String()
+	rs := newTestRuntimeService(t)
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+		Annotations: map[string]string{
+			"kubectl.kubernetes.io/last-applied-configuration": `{"value":"` + secret + `"}`,
+		},
+	}
+
+	logs := klogtest.Capture(t, func() {
+		_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+		assert.NoError(t, err)
+		_, err = rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+			PodSandboxId: "default_pod",
+			Config: &cri.ContainerConfig{
+				Metadata: &cri.ContainerMetadata{Name: "app"},
+				Image:    &cri.ImageSpec{Image: "app:latest"},
+				Command:  []string{"/bin/sh", "-c", "echo " + secret},
+				Envs: []*cri.KeyValue{
+					{Key: "DB_PASSWORD", Value: secret},
+					{Key: "INNOCENT_NAME", Value: secret},
+				},
+				Annotations: map[string]string{"example.com/token": secret},
+			},
+			SandboxConfig: sandboxConfig,
+		})
+		assert.NoError(t, err)
+		resp, err := rs.ExecSync(ctx, &cri.ExecSyncRequest{
+			ContainerId: "c1",
+			Cmd:         []string{"sh", "-c", "echo " + secret + "; exit 3"},
+		})
+		assert.Error(t, err)
+		assert.Contains(t, string(resp.Stdout), secret)
+	})
+
+	assert.Contains(t, logs, "CreateContainer")
+	assert.Contains(t, logs, "ExecSync")
+	assert.NotContains(t, logs, secret)
+}
+
+type fakeImageResolver map[string]string
+
+func (f fakeImageResolver) ResolveImage(image string) (string, string, error) {
+	id, ok := f[image]
+	if !ok {
+		return "", "", fmt.Errorf("image %s not found", image)
+	}
+	return id, "", nil
+}
+
+func (f fakeImageResolver) ImageConfig(image string) (*specs.ImageConfig, error) {
+	return nil, nil
+}
+
+// rootFSImageResolver resolves every image to the same unpacked root.
+type rootFSImageResolver string
+
+func (r rootFSImageResolver) ResolveImage(image string) (string, string, error) {
+	return "sha256:" + strings.Repeat("b", 64), string(r), nil
+}
+
+func (r rootFSImageResolver) ImageConfig(image string) (*specs.ImageConfig, error) {
+	return &specs.ImageConfig{WorkingDir: "/app"}, nil
+}
+
+func TestContainerRootFS(t *testing.T) {
+	image := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(image, "app"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(image, "app", "data"), []byte("image"), 0644))
+
+	rs := newTestRuntimeService(t)
+	rs.images = rootFSImageResolver(image)
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+
+	createContainer := func() string {
+		resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+			PodSandboxId: "default_pod",
+			Config: &cri.ContainerConfig{
+				Metadata: &cri.ContainerMetadata{Name: "app"},
+				Image:    &cri.ImageSpec{Image: "app:latest"},
+				Command:  []string{"/bin/app"},
+			},
+			SandboxConfig: sandboxConfig,
+		})
+		assert.NoError(t, err)
+		return resp.ContainerId
+	}
+	cid := createContainer()
+	other := createContainer()
+
+	// The container runs in, and writes to, its own copy of the image.
+	cnt := rs.getContainer(cid)
+	assert.Equal(t, filepath.Join(rs.containerDir("default_pod", cid), "rootfs"), cnt.RootFS)
+	assert.Equal(t, "/app", cnt.WorkingDir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(cnt.RootFS, "app", "data"), []byte("container"), 0644))
+	assertFileContent(t, filepath.Join(image, "app", "data"), "image")
+	assertFileContent(t, filepath.Join(rs.getContainer(other).RootFS, "app", "data"), "image")
+
+	stats, err := rs.ContainerStats(ctx, &cri.ContainerStatsRequest{ContainerId: cid})
+	assert.NoError(t, err)
+	assert.Equal(t, rs.containerDir("default_pod", cid), stats.Stats.WritableLayer.FsId.Mountpoint)
+	assert.NotZero(t, stats.Stats.WritableLayer.UsedBytes.Value)
+	assert.NotZero(t, stats.Stats.WritableLayer.InodesUsed.Value)
+
+	_, err = rs.RemoveContainer(ctx, &cri.RemoveContainerRequest{ContainerId: cid})
+	assert.NoError(t, err)
+	_, err = os.Stat(rs.containerDir("default_pod", cid))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(image)
+	assert.NoError(t, err)
+
+	// The copy is removed if the container can't be created.
+	hosts := filepath.Join(rs.podsDir, "default_pod", "hosts")
+	assert.NoError(t, os.Remove(hosts))
+	assert.NoError(t, os.Mkdir(hosts, 0755))
+	_, err = rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_pod",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/app"},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.Error(t, err)
+	entries, err := ioutil.ReadDir(filepath.Join(rs.podsDir, "default_pod", "containers"))
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, other, entries[0].Name())
+	}
+	assert.NoError(t, os.Remove(hosts))
+
+	_, err = rs.RemovePodSandbox(ctx, &cri.RemovePodSandboxRequest{PodSandboxId: "default_pod"})
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(rs.podsDir, "default_pod"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func assertFileContent(t *testing.T, path, content string) {
+	buf, err := ioutil.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, content, string(buf))
+	}
+}
+
+func TestContainerReportsImageID(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	id := "sha256:" + strings.Repeat("a", 64)
+	rs.images = fakeImageResolver{"app:latest": id}
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+
+	createContainer := func(image string) (*cri.CreateContainerResponse, error) {
+		return rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+			PodSandboxId: "default_pod",
+			Config: &cri.ContainerConfig{
+				Metadata: &cri.ContainerMetadata{Name: "app"},
+				Image:    &cri.ImageSpec{Image: image},
+				Command:  []string{"/bin/true"},
+			},
+			SandboxConfig: sandboxConfig,
+		})
+	}
+	_, err = createContainer("missing:latest")
+	assert.Error(t, err)
+
+	resp, err := createContainer("app:latest")
+	assert.NoError(t, err)
+	status, err := rs.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: resp.ContainerId})
+	assert.NoError(t, err)
+	assert.Equal(t, "app:latest", status.Status.Image.Image)
+	assert.Equal(t, id, status.Status.ImageRef)
+	list, err := rs.ListContainers(ctx, &cri.ListContainersRequest{Filter: &cri.ContainerFilter{}})
+	assert.NoError(t, err)
+	if assert.Len(t, list.Containers, 1) {
+		assert.Equal(t, id, list.Containers[0].ImageRef)
+	}
+}
+
+func TestContainerMounts(t *testing.T) {
+	volume := t.TempDir()
+	// A real file at the container path has to survive the mount.
+	existing := filepath.Join(t.TempDir(), "existing")
+	assert.NoError(t, ioutil.WriteFile(existing, []byte("host"), 0644))
+
+	rs := newTestRuntimeService(t)
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+	mounts := []*cri.Mount{
+		{ContainerPath: existing, HostPath: volume},
+		{ContainerPath: "/var/run/secrets/token", HostPath: volume, Readonly: true},
+	}
+	resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_pod",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+			Mounts:   mounts,
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.NoError(t, err)
+	cid := resp.ContainerId
+
+	assertFileContent(t, existing, "host")
+	cnt := rs.getContainer(cid)
+	root := rs.containerRoot(cnt)
+	assert.Contains(t, cnt.Env, "PROCRI_ROOT="+root)
+	target, err := os.Readlink(filepath.Join(root, existing))
+	assert.NoError(t, err)
+	assert.Equal(t, volume, target)
+	// Read-only volumes link to a copy.
+	target, err = os.Readlink(filepath.Join(root, "/var/run/secrets/token"))
+	assert.NoError(t, err)
+	assert.Equal(t, cnt.Mounts[1].Copy, target)
+	status, err := rs.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: cid})
+	assert.NoError(t, err)
+	assert.Equal(t, mounts, status.Status.Mounts)
+
+	_, err = rs.RemoveContainer(ctx, &cri.RemoveContainerRequest{ContainerId: cid})
+	assert.NoError(t, err)
+	_, err = os.Lstat(filepath.Join(root, "var", "run", "secrets", "token"))
+	assert.True(t, os.IsNotExist(err))
+	assertFileContent(t, existing, "host")
+	_, err = os.Stat(volume)
+	assert.NoError(t, err)
+
+	// Mounts denied by the policy fail the container.
+	_, err = rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_pod",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+			Mounts:   []*cri.Mount{{ContainerPath: "/etc/config", HostPath: volume}},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "denied by mount policy")
+}
+
+func TestHostImageVolumesOnHost(t *testing.T) {
+	volume := t.TempDir()
+	otherVolume := t.TempDir()
+	rs := newTestRuntimeService(t)
+	// A real file at the container path is never replaced.
+	existing := filepath.Join(rs.hostRoot, "app", "config")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(existing), 0755))
+	assert.NoError(t, ioutil.WriteFile(existing, []byte("host"), 0644))
+
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+	createContainer := func(mounts []*cri.Mount) *Container {
+		resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+			PodSandboxId: "default_pod",
+			Config: &cri.ContainerConfig{
+				Metadata: &cri.ContainerMetadata{Name: "app"},
+				Image:    &cri.ImageSpec{Image: "app:latest"},
+				Command:  []string{"/bin/true"},
+				Mounts:   mounts,
+			},
+			SandboxConfig: sandboxConfig,
+		})
+		assert.NoError(t, err)
+		return rs.getContainer(resp.ContainerId)
+	}
+	cnt := createContainer([]*cri.Mount{
+		{ContainerPath: "/data", HostPath: volume},
+		{ContainerPath: "/secrets", HostPath: volume, Readonly: true},
+		{ContainerPath: "/app/config", HostPath: volume},
+	})
+	target, err := os.Readlink(filepath.Join(rs.hostRoot, "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, volume, target)
+	target, err = os.Readlink(filepath.Join(rs.hostRoot, "secrets"))
+	assert.NoError(t, err)
+	assert.Equal(t, cnt.Mounts[1].Copy, target)
+	assertFileContent(t, existing, "host")
+	target, err = os.Readlink(filepath.Join(rs.containerRoot(cnt), "app", "config"))
+	assert.NoError(t, err)
+	assert.Equal(t, volume, target)
+
+	// The path stays with the first container until it is removed.
+	other := createContainer([]*cri.Mount{{ContainerPath: "/data", HostPath: otherVolume}})
+	target, err = os.Readlink(filepath.Join(rs.hostRoot, "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, volume, target)
+	_, err = rs.RemoveContainer(ctx, &cri.RemoveContainerRequest{ContainerId: cnt.ID})
+	assert.NoError(t, err)
+	_, err = os.Lstat(filepath.Join(rs.hostRoot, "secrets"))
+	assert.True(t, os.IsNotExist(err))
+	assertFileContent(t, existing, "host")
+	rs.refreshVolumes()
+	target, err = os.Readlink(filepath.Join(rs.hostRoot, "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, otherVolume, target)
+
+	_, err = rs.RemoveContainer(ctx, &cri.RemoveContainerRequest{ContainerId: other.ID})
+	assert.NoError(t, err)
+	_, err = os.Lstat(filepath.Join(rs.hostRoot, "data"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReadOnlyMountsAndRootFS(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	configVolume := t.TempDir()
+	dataVolume := t.TempDir()
+	// Let the unprivileged user of tryWrite get to the files.
+	assert.NoError(t, os.Chmod(filepath.Dir(rs.podsDir), 0755))
+	assert.NoError(t, os.Chmod(rs.podsDir, 0755))
+	assert.NoError(t, os.Chmod(configVolume, 0777))
+	assert.NoError(t, os.Chmod(dataVolume, 0777))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(configVolume, "config"), []byte("config"), 0666))
+
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+	resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_pod",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+			Mounts: []*cri.Mount{
+				{ContainerPath: "/config", HostPath: configVolume, Readonly: true},
+				{ContainerPath: "/data", HostPath: dataVolume},
+			},
+			Linux: &cri.LinuxContainerConfig{
+				SecurityContext: &cri.LinuxContainerSecurityContext{ReadonlyRootfs: true},
+			},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.NoError(t, err)
+	cid := resp.ContainerId
+	root := rs.containerRoot(rs.getContainer(cid))
+
+	assert.Error(t, tryWrite(filepath.Join(root, "config", "config")))
+	assert.Error(t, tryWrite(filepath.Join(root, "config", "new")))
+	assert.Error(t, tryWrite(filepath.Join(root, "new")))
+	info, err := os.Stat(root)
+	if assert.NoError(t, err) {
+		assert.Zero(t, info.Mode().Perm()&0222)
+	}
+	assert.NoError(t, tryWrite(filepath.Join(root, "data", "new")))
+	assertFileContent(t, filepath.Join(configVolume, "config"), "config")
+	assertFileContent(t, filepath.Join(dataVolume, "new"), "changed\n")
+
+	_, err = rs.RemoveContainer(ctx, &cri.RemoveContainerRequest{ContainerId: cid})
+	assert.NoError(t, err)
+	_, err = os.Stat(rs.containerDir("default_pod", cid))
+	assert.True(t, os.IsNotExist(err))
+	assertFileContent(t, filepath.Join(configVolume, "config"), "config")
+}
+
+func TestReadOnlyUnenforced(t *testing.T) {
+	runAs := func(uid int64, readOnlyRootfs bool) *cri.LinuxContainerConfig {
+		return &cri.LinuxContainerConfig{
+			SecurityContext: &cri.LinuxContainerSecurityContext{RunAsUser: &cri.Int64Value{Value: uid}, ReadonlyRootfs: readOnlyRootfs},
+		}
+	}
+	testCases := []struct {
+		name       string
+		rootfs     bool
+		mounts     []*cri.Mount
+		linux      *cri.LinuxContainerConfig
+		unenforced string
+	}{
+		{
+			name:       "read-only volume as the user of procri",
+			mounts:     []*cri.Mount{{ContainerPath: "/config", Readonly: true}},
+			unenforced: fmt.Sprintf("processes run as uid %d", os.Getuid()),
+		},
+		{
+			name:       "read-only volume as root",
+			mounts:     []*cri.Mount{{ContainerPath: "/config", Readonly: true}},
+			linux:      runAs(0, false),
+			unenforced: "processes run as uid 0",
+		},
+		{
+			name:       "read-only root filesystem as root",
+			rootfs:     true,
+			linux:      runAs(0, true),
+			unenforced: "processes run as uid 0",
+		},
 		{
-			p:      "/etc/hosts",
-			result: false,
+			name:       "read-only root filesystem of a host image",
+			linux:      runAs(65534, true),
+			unenforced: "processes of host image app:latest write to the host filesystem",
 		},
 		{
-			p:      "/usr/local/bin/foo",
-			result: false,
+			name:   "read-only root filesystem as another user",
+			rootfs: true,
+			linux:  runAs(65534, true),
 		},
 		{
-			p:      "/var/kubernetes/secrets/token",
-			result: true,
+			name:   "service account token of kubelet",
+			mounts: []*cri.Mount{{ContainerPath: serviceAccountPath, Readonly: true}},
 		},
 		{
-			p:      "/foobar",
-			result: true,
+			name:   "writable volume as root",
+			mounts: []*cri.Mount{{ContainerPath: "/data"}},
+			linux:  runAs(0, false),
 		},
 	}
-
 	for _, tc := range testCases {
-		t.Run(tc.p, func(t *testing.T) {
-			result := isPathAllowed(tc.p)
-			assert.Equal(t, tc.result, result)
+		t.Run(tc.name, func(t *testing.T) {
+			rs := newTestRuntimeService(t)
+			if tc.rootfs {
+				rs.images = rootFSImageResolver(t.TempDir())
+			}
+			for _, m := range tc.mounts {
+				m.HostPath = t.TempDir()
+				if m.ContainerPath == serviceAccountPath {
+					m.HostPath = filepath.Join(m.HostPath, "pods/uid/volumes/kubernetes.io~projected/kube-api-access")
+					assert.NoError(t, os.MkdirAll(m.HostPath, 0755))
+				}
+			}
+			ctx := context.Background()
+			sandboxConfig := &cri.PodSandboxConfig{
+				Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+			}
+			_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+			assert.NoError(t, err)
+			var resp *cri.CreateContainerResponse
+			logs := klogtest.Capture(t, func() {
+				resp, err = rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+					PodSandboxId: "default_pod",
+					Config: &cri.ContainerConfig{
+						Metadata: &cri.ContainerMetadata{Name: "app"},
+						Image:    &cri.ImageSpec{Image: "app:latest"},
+						Command:  []string{"/bin/true"},
+						Mounts:   tc.mounts,
+						Linux:    tc.linux,
+					},
+					SandboxConfig: sandboxConfig,
+				})
+			})
+			require.NoError(t, err)
+			status, err := rs.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: resp.ContainerId, Verbose: true})
+			require.NoError(t, err)
+			if tc.unenforced == "" {
+				assert.NotContains(t, logs, "not enforced")
+				assert.NotContains(t, status.Info, "readOnlyUnenforced")
+				return
+			}
+			assert.Contains(t, logs, "read-only volumes and root filesystem are not enforced: "+tc.unenforced)
+			assert.Contains(t, status.Info["readOnlyUnenforced"], tc.unenforced)
 		})
 	}
 }
 
-func TestMakeEnvList(t *testing.T) {
-	envs := []*cri.KeyValue{
-		{
-			Key:   "MY_ENV",
-			Value: "dummy",
-		},
-	}
-	envStrings := makeEnvList(envs)
-	assert.Len(t, envStrings, 5)
-	sort.Strings(envStrings)
-	assert.True(t, strings.HasPrefix(envStrings[0], "HOME="))
-	assert.True(t, strings.HasPrefix(envStrings[1], "HOSTNAME="))
-	assert.Equal(t, "MY_ENV=dummy", envStrings[2])
-	assert.True(t, strings.HasPrefix(envStrings[3], "PATH="))
-	assert.True(t, strings.HasPrefix(envStrings[4], "TERM="))
+// tryWrite writes to path as an unprivileged user, since permissions don't
+// stop root.
+func tryWrite(path string) error {
+	cmd := exec.Command("sh", "-c", `echo changed > "$1"`, "sh", path)
+	if os.Geteuid() == 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: 65534, Gid: 65534},
+		}
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// writeAtomicVolume writes files to dir the way kubelet updates secret and
+// projected volumes.
+func TestServiceAccountOnHost(t *testing.T) {
+	image := t.TempDir()
+	rs := newTestRuntimeService(t)
+	rs.images = rootFSImageResolver(image)
+	ctx := context.Background()
+	for _, pod := range []string{"pod", "other"} {
+		_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: &cri.PodSandboxConfig{
+			Metadata: &cri.PodSandboxMetadata{Name: pod, Namespace: "default", Uid: pod},
+		}})
+		assert.NoError(t, err)
+	}
+	createContainer := func(pod, volume string) (string, string) {
+		sandboxConfig := &cri.PodSandboxConfig{
+			Metadata: &cri.PodSandboxMetadata{Name: pod, Namespace: "default", Uid: pod},
+		}
+		var cid string
+		logs := klogtest.Capture(t, func() {
+			resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+				PodSandboxId: "default_" + pod,
+				Config: &cri.ContainerConfig{
+					Metadata: &cri.ContainerMetadata{Name: "app"},
+					Image:    &cri.ImageSpec{Image: "app:latest"},
+					Command:  []string{"/bin/app"},
+					Mounts: []*cri.Mount{
+						{ContainerPath: serviceAccountPath, HostPath: volume, Readonly: true},
+						{ContainerPath: "/data", HostPath: volume},
+					},
+				},
+				SandboxConfig: sandboxConfig,
+			})
+			assert.NoError(t, err)
+			cid = resp.ContainerId
+		})
+		return cid, logs
+	}
+	volume, otherVolume := t.TempDir(), t.TempDir()
+	writeAtomicVolume(t, volume, "1", map[string]string{"token": "token1"})
+	writeAtomicVolume(t, otherVolume, "1", map[string]string{"token": "other"})
+	hostToken := filepath.Join(rs.hostRoot, serviceAccountPath, "token")
+
+	// Containers with a root get the service account, and only it.
+	cid, logs := createContainer("pod", volume)
+	assert.NotContains(t, logs, "is taken")
+	assertFileContent(t, hostToken, "token1")
+	_, err := os.Lstat(filepath.Join(rs.hostRoot, "data"))
+	assert.True(t, os.IsNotExist(err))
+	// Containers of the same pod share it.
+	sibling, logs := createContainer("pod", volume)
+	assert.NotContains(t, logs, "is taken")
+
+	// Other pods can't have it while the pod holds it.
+	_, logs = createContainer("other", otherVolume)
+	assert.Contains(t, logs, serviceAccountPath+" is taken")
+	assertFileContent(t, hostToken, "token1")
+	for _, id := range []string{cid, sibling} {
+		_, err = rs.RemoveContainer(ctx, &cri.RemoveContainerRequest{ContainerId: id})
+		assert.NoError(t, err)
+	}
+	rs.refreshVolumes()
+	assertFileContent(t, hostToken, "other")
+}
+
+func writeAtomicVolume(t *testing.T, dir, version string, files map[string]string) {
+	data := "..2021_01_01_" + version
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, data), 0755))
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, data, name), []byte(content), 0644))
+		_ = os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name))
+	}
+	old, _ := os.Readlink(filepath.Join(dir, "..data"))
+	assert.NoError(t, os.Symlink(data, filepath.Join(dir, "..data_tmp")))
+	assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	if old != "" {
+		assert.NoError(t, os.RemoveAll(filepath.Join(dir, old)))
+	}
+}
+
+func TestServiceAccountVolume(t *testing.T) {
+	volume := t.TempDir()
+	writeAtomicVolume(t, volume, "1", map[string]string{"token": "token1", "ca.crt": "ca", "namespace": "default"})
+
+	rs := newTestRuntimeService(t)
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+	resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_pod",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+			Envs: []*cri.KeyValue{
+				{Key: "KUBERNETES_SERVICE_HOST", Value: "10.96.0.1"},
+				{Key: "KUBERNETES_SERVICE_PORT", Value: "443"},
+			},
+			Mounts: []*cri.Mount{
+				{ContainerPath: "/var/run/secrets/kubernetes.io/serviceaccount", HostPath: volume, Readonly: true},
+			},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.NoError(t, err)
+	cnt := rs.getContainer(resp.ContainerId)
+	token := filepath.Join(rs.containerRoot(cnt), "var/run/secrets/kubernetes.io/serviceaccount/token")
+	assertFileContent(t, token, "token1")
+
+	kubeconfigPath := filepath.Join(rs.containerDir("default_pod", cnt.ID), "kubeconfig")
+	assert.Contains(t, cnt.Env, "KUBECONFIG="+kubeconfigPath)
+	buf, err := ioutil.ReadFile(kubeconfigPath)
+	assert.NoError(t, err)
+	config := kubeconfig{}
+	assert.NoError(t, json.Unmarshal(buf, &config))
+	assert.Equal(t, "https://10.96.0.1:443", config.Clusters[0].Cluster["server"])
+	assert.Equal(t, "default", config.Contexts[0].Context["namespace"])
+	assertFileContent(t, config.Users[0].User["tokenFile"], "token1")
+
+	// In-cluster clients read it at its absolute path.
+	hostToken := filepath.Join(rs.hostRoot, serviceAccountPath, "token")
+	assertFileContent(t, hostToken, "token1")
+
+	// Rotated tokens and new keys show up without restarting the container.
+	writeAtomicVolume(t, volume, "2", map[string]string{"token": "token2", "ca.crt": "ca", "namespace": "default", "extra": "extra"})
+	rs.refreshVolumes()
+	assertFileContent(t, token, "token2")
+	assertFileContent(t, hostToken, "token2")
+	assertFileContent(t, config.Users[0].User["tokenFile"], "token2")
+	assertFileContent(t, filepath.Join(filepath.Dir(token), "extra"), "extra")
+	_, err = os.Stat(filepath.Join(cnt.Mounts[0].Copy, "..2021_01_01_1"))
+	assert.True(t, os.IsNotExist(err))
+	info, err := os.Stat(token)
+	if assert.NoError(t, err) {
+		assert.Zero(t, info.Mode().Perm()&0222)
+	}
+	info, err = os.Stat(cnt.Mounts[0].Copy)
+	if assert.NoError(t, err) {
+		assert.Zero(t, info.Mode().Perm()&0222)
+	}
+}
+
+type fakeDNSForwarder struct {
+	servers []string
+}
+
+func (f *fakeDNSForwarder) Domain() string {
+	return "cluster.local"
+}
+
+func (f *fakeDNSForwarder) SetServers(servers []string) {
+	f.servers = servers
+}
+
+func TestPodDNSConfig(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	forwarder := &fakeDNSForwarder{}
+	rs.SetDNSForwarder(forwarder)
+	ctx := context.Background()
+	sandboxConfig := &cri.PodSandboxConfig{
+		Metadata: &cri.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+		DnsConfig: &cri.DNSConfig{
+			Servers:  []string{"10.96.0.10"},
+			Searches: []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"},
+			Options:  []string{"ndots:5"},
+		},
+	}
+	_, err := rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: sandboxConfig})
+	assert.NoError(t, err)
+	// Pods with their own DNS servers don't change the cluster DNS servers.
+	_, err = rs.RunPodSandbox(ctx, &cri.RunPodSandboxRequest{Config: &cri.PodSandboxConfig{
+		Metadata:  &cri.PodSandboxMetadata{Name: "custom", Namespace: "default", Uid: "uid2"},
+		DnsConfig: &cri.DNSConfig{Servers: []string{"1.1.1.1"}, Searches: []string{"example.com"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.96.0.10"}, forwarder.servers)
+
+	resp, err := rs.CreateContainer(ctx, &cri.CreateContainerRequest{
+		PodSandboxId: "default_pod",
+		Config: &cri.ContainerConfig{
+			Metadata: &cri.ContainerMetadata{Name: "app"},
+			Image:    &cri.ImageSpec{Image: "app:latest"},
+			Command:  []string{"/bin/true"},
+		},
+		SandboxConfig: sandboxConfig,
+	})
+	assert.NoError(t, err)
+	cnt := rs.getContainer(resp.ContainerId)
+	assertFileContent(t, filepath.Join(rs.containerRoot(cnt), "etc", "resolv.conf"),
+		"nameserver 10.96.0.10\nsearch default.svc.cluster.local svc.cluster.local cluster.local\noptions ndots:5\n")
+	assert.Contains(t, cnt.Env, "LOCALDOMAIN=default.svc.cluster.local svc.cluster.local cluster.local")
+	assert.Contains(t, cnt.Env, "RES_OPTIONS=ndots:5")
+
+	_, err = rs.RemovePodSandbox(ctx, &cri.RemovePodSandboxRequest{PodSandboxId: "default_pod"})
+	assert.NoError(t, err)
+	assert.Empty(t, forwarder.servers)
 }
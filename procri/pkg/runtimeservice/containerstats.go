@@ -2,8 +2,10 @@ package runtimeservice
 
 import (
 	"fmt"
+	"os"
 	"time"
 
+	"github.com/elotl/procri/pkg/imagestore"
 	"golang.org/x/net/context"
 	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
 	"k8s.io/klog"
@@ -17,7 +19,6 @@ import (
 // exist, the call returns an error.
 func (rs *RuntimeService) ContainerStats(ctx context.Context, req *cri.ContainerStatsRequest) (*cri.ContainerStatsResponse, error) {
 	cid := req.ContainerId
-	klog.V(2).Infof("ContainerStats %s", cid)
 
 	cnt := rs.getContainer(cid)
 	if cnt == nil {
@@ -26,6 +27,14 @@ func (rs *RuntimeService) ContainerStats(ctx context.Context, req *cri.Container
 		return nil, err
 	}
 
+	// The writable layer is the directory of the container, holding its copy
+	// of the image root. Containers of host images have none.
+	dir := rs.containerDir(cnt.PodID, cid)
+	usedBytes, inodesUsed, err := imagestore.Usage(dir)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Warningf("ContainerStats %s: disk usage of %s: %v", cid, dir, err)
+	}
+
 	timestamp := time.Now().UnixNano()
 	stats := &cri.ContainerStats{
 		Attributes: &cri.ContainerAttributes{
@@ -55,13 +64,13 @@ func (rs *RuntimeService) ContainerStats(ctx context.Context, req *cri.Container
 		WritableLayer: &cri.FilesystemUsage{
 			Timestamp: timestamp,
 			FsId: &cri.FilesystemIdentifier{
-				Mountpoint: "/", // TODO
+				Mountpoint: dir,
 			},
 			UsedBytes: &cri.UInt64Value{
-				Value: uint64(0), // TODO
+				Value: usedBytes,
 			},
 			InodesUsed: &cri.UInt64Value{
-				Value: uint64(0), // TODO
+				Value: inodesUsed,
 			},
 		},
 	}
@@ -70,14 +79,11 @@ func (rs *RuntimeService) ContainerStats(ctx context.Context, req *cri.Container
 		Stats: stats,
 	}
 
-	klog.V(2).Infof("ContainerStats %s: success", req.ContainerId)
 	return resp, nil
 }
 
 // ListContainerStats returns stats of all running containers.
 func (rs *RuntimeService) ListContainerStats(ctx context.Context, req *cri.ListContainerStatsRequest) (*cri.ListContainerStatsResponse, error) {
-	klog.V(2).Infof("ListContainerStats %+v", req)
-
 	lcr := &cri.ListContainersRequest{}
 	if req.Filter != nil {
 		lcr.Filter = &cri.ContainerFilter{
@@ -107,6 +113,5 @@ func (rs *RuntimeService) ListContainerStats(ctx context.Context, req *cri.ListC
 		lcsr.Stats = append(lcsr.Stats, stats.Stats)
 	}
 
-	klog.V(2).Infof("ListContainerStats %+v: %d containers", req, len(lcsr.Stats))
 	return lcsr, nil
 }
@@ -0,0 +1,96 @@
+package runtimeservice
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/elotl/procri/pkg/dns"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// DNSForwarder forwards queries for the cluster domain to the DNS servers of
+// the cluster.
+type DNSForwarder interface {
+	// Domain returns the cluster domain, e.g. "cluster.local".
+	Domain() string
+	// SetServers sets the DNS servers of the cluster.
+	SetServers(servers []string)
+}
+
+// SetDNSForwarder sets the forwarder to keep up to date with the DNS servers
+// of pods using cluster DNS.
+func (rs *RuntimeService) SetDNSForwarder(forwarder DNSForwarder) {
+	rs.dns = forwarder
+	rs.updateDNSServers()
+}
+
+func (rs *RuntimeService) updateDNSServers() {
+	if rs.dns == nil {
+		return
+	}
+	servers := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pod := range rs.listSandboxes() {
+		if !usesClusterDNS(pod.DNSConfig, rs.dns.Domain()) {
+			continue
+		}
+		for _, server := range pod.DNSConfig.Servers {
+			if !seen[server] {
+				seen[server] = true
+				servers = append(servers, server)
+			}
+		}
+	}
+	rs.dns.SetServers(servers)
+}
+
+// usesClusterDNS reports whether config is the one kubelet gives pods with
+// the ClusterFirst DNS policy, searching the cluster domain. Only their
+// servers are cluster DNS servers.
+func usesClusterDNS(config *cri.DNSConfig, domain string) bool {
+	for _, search := range config.GetSearches() {
+		search = strings.Trim(search, ".")
+		if search == domain || strings.HasSuffix(search, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *RuntimeService) podResolvConf(podID string) string {
+	return filepath.Join(rs.podsDir, podID, "resolv.conf")
+}
+
+// writeResolvConf writes the resolver configuration of a pod. Processes find
+// it at etc/resolv.conf under their root; the resolver of the host never reads
+// it, see dns.Stub.
+func (rs *RuntimeService) writeResolvConf(pod *Sandbox) error {
+	config := pod.DNSConfig
+	path := rs.podResolvConf(pod.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	content := dns.ResolvConf(config.Servers, config.Searches, config.Options)
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+// dnsEnv passes the search domains and options of the pod to resolvers
+// reading LOCALDOMAIN and RES_OPTIONS. The resolver of macOS doesn't, only
+// processes resolving names with a resolver of their own do.
+func dnsEnv(pod *Sandbox) []string {
+	if pod.DNSConfig == nil {
+		return nil
+	}
+	env := make([]string, 0, 2)
+	if len(pod.DNSConfig.Searches) > 0 {
+		env = append(env, "LOCALDOMAIN="+strings.Join(pod.DNSConfig.Searches, " "))
+	}
+	if len(pod.DNSConfig.Options) > 0 {
+		env = append(env, "RES_OPTIONS="+strings.Join(pod.DNSConfig.Options, " "))
+	}
+	return env
+}
@@ -0,0 +1,124 @@
+package runtimeservice
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+const (
+	// Key in the data store marking drain mode, so it survives restarts,
+	// e.g. when the host reboots for maintenance.
+	drainKey = "draining"
+
+	reasonDraining = "Draining"
+)
+
+// DrainStatus tells whether the runtime service is draining, and what runs.
+type DrainStatus struct {
+	Draining   bool `json:"draining"`
+	Sandboxes  int  `json:"sandboxes"`
+	Containers int  `json:"containers"`
+}
+
+func (rs *RuntimeService) isDraining() bool {
+	return rs.dataStore.Has(drainKey)
+}
+
+// Drain puts the runtime service into drain mode, for maintenance of the
+// host: new sandboxes are refused, the runtime is reported not ready, and all
+// sandboxes are stopped. Containers still running after timeout are killed.
+// Drain returns once all container processes have exited, or ctx is done.
+func (rs *RuntimeService) Drain(ctx context.Context, timeout time.Duration) error {
+	// RunPodSandbox stores sandboxes holding portsMu, so none is run after
+	// this.
+	rs.portsMu.Lock()
+	err := rs.dataStore.Write(drainKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	rs.portsMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("entering drain mode: %v", err)
+	}
+	klog.Infof("draining, stopping all pods within %v", timeout)
+
+	var pids []int
+	for _, cnt := range rs.listContainers() {
+		if cnt.State == cri.ContainerState_CONTAINER_RUNNING && cnt.Pid != 0 {
+			pids = append(pids, cnt.Pid)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(rs.listSandboxes()))
+	for _, pod := range rs.listSandboxes() {
+		if pod.State != cri.PodSandboxState_SANDBOX_READY {
+			continue
+		}
+		wg.Add(1)
+		go func(pod *Sandbox) {
+			defer wg.Done()
+			if err := rs.terminateSandboxContainers(ctx, pod, deadline); err != nil {
+				errs <- fmt.Errorf("stopping pod %s: %v", pod.ID, err)
+			}
+			rs.releaseHostPorts(pod.ID)
+		}(pod)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		return err
+	}
+
+	// Killed processes may take a moment to go away.
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		running := 0
+		for _, pid := range pids {
+			if syscall.Kill(pid, 0) == nil {
+				running++
+			}
+		}
+		if running == 0 {
+			klog.Infof("drained, all pods are stopped")
+			return nil
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d processes to exit: %v", running, ctx.Err())
+		}
+	}
+}
+
+// Undrain leaves drain mode, so sandboxes can be run again.
+func (rs *RuntimeService) Undrain() error {
+	if err := rs.dataStore.Erase(drainKey); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("leaving drain mode: %v", err)
+	}
+	klog.Infof("left drain mode")
+	return nil
+}
+
+// DrainStatus returns whether the runtime service is draining, and the number
+// of ready sandboxes and running containers.
+func (rs *RuntimeService) DrainStatus() DrainStatus {
+	status := DrainStatus{Draining: rs.isDraining()}
+	for _, pod := range rs.listSandboxes() {
+		if pod.State == cri.PodSandboxState_SANDBOX_READY {
+			status.Sandboxes++
+		}
+	}
+	for _, cnt := range rs.listContainers() {
+		if cnt.State == cri.ContainerState_CONTAINER_RUNNING {
+			status.Containers++
+		}
+	}
+	return status
+}
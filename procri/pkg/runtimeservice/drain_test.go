@@ -0,0 +1,51 @@
+package runtimeservice
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/diskv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func TestDrain(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	ctx := context.Background()
+	require.NoError(t, runSandboxWithPorts(rs, "web"))
+
+	// A process ignoring SIGTERM has to be killed.
+	cmd := exec.Command("/bin/sh", "-c", "trap '' TERM; while true; do sleep 1; done")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	require.NoError(t, cmd.Start())
+	go func() { _ = cmd.Wait() }()
+	pod := rs.getSandbox("default_web")
+	pod.Containers = []string{"app"}
+	rs.putSandbox(pod.ID, pod)
+	rs.putContainer("app", &Container{ID: "app", PodID: pod.ID, Pid: cmd.Process.Pid, State: cri.ContainerState_CONTAINER_RUNNING})
+	assert.Equal(t, DrainStatus{Sandboxes: 1, Containers: 1}, rs.DrainStatus())
+
+	require.NoError(t, rs.Drain(ctx, time.Second))
+	assert.Error(t, syscall.Kill(cmd.Process.Pid, 0))
+	assert.Equal(t, DrainStatus{Draining: true}, rs.DrainStatus())
+	assert.Equal(t, cri.PodSandboxState_SANDBOX_NOTREADY, rs.getSandbox("default_web").State)
+
+	err := runSandboxWithPorts(rs, "other")
+	assert.EqualError(t, err, "PodSandbox default_other refused: procri is draining for maintenance")
+	c := conditions(t, rs)
+	assert.False(t, c[cri.RuntimeReady].Status)
+	assert.Equal(t, reasonDraining, c[cri.RuntimeReady].Reason)
+
+	// Drain mode survives restarts.
+	restarted, err := NewRuntimeService(nil, "127.0.0.1", diskv.New(diskv.Options{BasePath: rs.dataStore.BasePath}), rs.podsDir, "v0.0.1", nil)
+	require.NoError(t, err)
+	assert.True(t, restarted.DrainStatus().Draining)
+
+	require.NoError(t, rs.Undrain())
+	assert.NoError(t, runSandboxWithPorts(rs, "other"))
+	assert.True(t, conditions(t, rs)[cri.RuntimeReady].Status)
+}
@@ -0,0 +1,162 @@
+package runtimeservice
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/elotl/procri/pkg/hostport"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+// Processes of pods share the network of the host, so a host port is
+// reserved by the sandbox declaring it. A process listening on the container
+// port is reachable on the host port only via the host port proxy, if the
+// ports differ.
+
+// EnableHostPortProxy forwards the host ports of sandboxes to their
+// container ports, including those of sandboxes already running.
+func (rs *RuntimeService) EnableHostPortProxy() {
+	rs.portsMu.Lock()
+	defer rs.portsMu.Unlock()
+	rs.proxies = make(map[string][]io.Closer)
+	for _, pod := range rs.listSandboxes() {
+		if pod.State != cri.PodSandboxState_SANDBOX_READY {
+			continue
+		}
+		if err := rs.startProxies(pod); err != nil {
+			klog.Warningf("forwarding host ports of pod %s: %v", pod.ID, err)
+		}
+	}
+}
+
+// reserveHostPorts returns an error if a host port of pod is reserved by
+// another ready sandbox. Must be called with portsMu held.
+func (rs *RuntimeService) reserveHostPorts(pod *Sandbox) error {
+	for i, mapping := range pod.PortMappings {
+		if mapping.HostPort <= 0 {
+			continue
+		}
+		for _, other := range pod.PortMappings[:i] {
+			if portsConflict(mapping, other) {
+				return fmt.Errorf("host port %s is declared twice by pod %s", formatHostPort(mapping), pod.ID)
+			}
+		}
+		for _, other := range rs.listSandboxes() {
+			if other.ID == pod.ID || other.State != cri.PodSandboxState_SANDBOX_READY {
+				continue
+			}
+			for _, reserved := range other.PortMappings {
+				if portsConflict(mapping, reserved) {
+					return hostPortError(mapping, other.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hostPortError(mapping *cri.PortMapping, podID string) error {
+	return fmt.Errorf("host port %s is already reserved by pod %s", formatHostPort(mapping), podID)
+}
+
+func formatHostPort(mapping *cri.PortMapping) string {
+	port := fmt.Sprintf("%d/%s", mapping.HostPort, protocolName(mapping.Protocol))
+	if !isWildcardIP(mapping.HostIp) {
+		port = net.JoinHostPort(mapping.HostIp, port)
+	}
+	return port
+}
+
+// portsConflict reports whether a and b bind the same host port. An empty or
+// unspecified host IP binds all addresses.
+func portsConflict(a, b *cri.PortMapping) bool {
+	if a.HostPort <= 0 || a.HostPort != b.HostPort || a.Protocol != b.Protocol {
+		return false
+	}
+	if isWildcardIP(a.HostIp) || isWildcardIP(b.HostIp) {
+		return true
+	}
+	return net.ParseIP(a.HostIp).Equal(net.ParseIP(b.HostIp))
+}
+
+func isWildcardIP(ip string) bool {
+	return ip == "" || net.ParseIP(ip).IsUnspecified()
+}
+
+func protocolName(protocol cri.Protocol) string {
+	return strings.ToLower(protocol.String())
+}
+
+// startProxies forwards the host ports of pod to its container ports. Must
+// be called with portsMu held.
+func (rs *RuntimeService) startProxies(pod *Sandbox) error {
+	if rs.proxies == nil {
+		return nil
+	}
+	var proxies []io.Closer
+	for _, mapping := range pod.PortMappings {
+		if mapping.HostPort <= 0 || mapping.HostPort == mapping.ContainerPort {
+			continue
+		}
+		if mapping.Protocol == cri.Protocol_SCTP {
+			klog.Warningf("pod %s: not forwarding host port %s, SCTP is not supported", pod.ID, formatHostPort(mapping))
+			continue
+		}
+		host := net.JoinHostPort(mapping.HostIp, strconv.Itoa(int(mapping.HostPort)))
+		target := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(mapping.ContainerPort)))
+		proxy, err := hostport.Listen(protocolName(mapping.Protocol), host, target)
+		if err != nil {
+			closeAll(proxies)
+			return fmt.Errorf("forwarding host port %s: %v", formatHostPort(mapping), err)
+		}
+		proxies = append(proxies, proxy)
+	}
+	if len(proxies) > 0 {
+		rs.proxies[pod.ID] = proxies
+	}
+	return nil
+}
+
+// releaseHostPorts stops forwarding the host ports of the sandbox podID.
+// Reservations are released by the sandbox leaving the ready state.
+func (rs *RuntimeService) releaseHostPorts(podID string) {
+	rs.portsMu.Lock()
+	defer rs.portsMu.Unlock()
+	closeAll(rs.proxies[podID])
+	delete(rs.proxies, podID)
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			klog.Warningf("closing host port proxy: %v", err)
+		}
+	}
+}
+
+// PortProtocol returns "udp" if the sandbox podSandboxID declares port as a
+// UDP container port, and no TCP port with that number, or "tcp". It tells
+// port-forward which protocol to forward.
+func (rs *RuntimeService) PortProtocol(podSandboxID string, port int32) string {
+	pod := rs.getSandbox(podSandboxID)
+	if pod == nil {
+		return "tcp"
+	}
+	protocol := "tcp"
+	for _, mapping := range pod.PortMappings {
+		if mapping.ContainerPort != port {
+			continue
+		}
+		switch mapping.Protocol {
+		case cri.Protocol_TCP:
+			return "tcp"
+		case cri.Protocol_UDP:
+			protocol = "udp"
+		}
+	}
+	return protocol
+}
@@ -0,0 +1,95 @@
+package runtimeservice
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func runSandboxWithPorts(rs *RuntimeService, name string, mappings ...*cri.PortMapping) error {
+	_, err := rs.RunPodSandbox(context.Background(), &cri.RunPodSandboxRequest{Config: &cri.PodSandboxConfig{
+		Metadata:     &cri.PodSandboxMetadata{Name: name, Namespace: "default", Uid: name},
+		PortMappings: mappings,
+	}})
+	return err
+}
+
+func TestHostPortConflicts(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	ctx := context.Background()
+	require.NoError(t, runSandboxWithPorts(rs, "web",
+		&cri.PortMapping{Protocol: cri.Protocol_TCP, ContainerPort: 8080, HostPort: 8080},
+		&cri.PortMapping{Protocol: cri.Protocol_UDP, ContainerPort: 53, HostPort: 5353, HostIp: "127.0.0.1"},
+	))
+
+	err := runSandboxWithPorts(rs, "other", &cri.PortMapping{Protocol: cri.Protocol_TCP, ContainerPort: 80, HostPort: 8080, HostIp: "10.0.0.1"})
+	assert.EqualError(t, err, "host port 10.0.0.1:8080/tcp is already reserved by pod default_web")
+	assert.Nil(t, rs.getSandbox("default_other"))
+	err = runSandboxWithPorts(rs, "other", &cri.PortMapping{Protocol: cri.Protocol_UDP, ContainerPort: 53, HostPort: 5353})
+	assert.EqualError(t, err, "host port 5353/udp is already reserved by pod default_web")
+	err = runSandboxWithPorts(rs, "twice",
+		&cri.PortMapping{Protocol: cri.Protocol_TCP, ContainerPort: 80, HostPort: 9090},
+		&cri.PortMapping{Protocol: cri.Protocol_TCP, ContainerPort: 81, HostPort: 9090},
+	)
+	assert.EqualError(t, err, "host port 9090/tcp is declared twice by pod default_twice")
+
+	// Other protocols, host IPs and ports don't conflict.
+	assert.NoError(t, runSandboxWithPorts(rs, "udp", &cri.PortMapping{Protocol: cri.Protocol_UDP, ContainerPort: 8080, HostPort: 8080}))
+	assert.NoError(t, runSandboxWithPorts(rs, "ip", &cri.PortMapping{Protocol: cri.Protocol_UDP, ContainerPort: 53, HostPort: 5353, HostIp: "10.0.0.1"}))
+	assert.NoError(t, runSandboxWithPorts(rs, "port", &cri.PortMapping{Protocol: cri.Protocol_TCP, ContainerPort: 8080, HostPort: 8081}))
+
+	assert.Equal(t, "udp", rs.PortProtocol("default_web", 53))
+	assert.Equal(t, "tcp", rs.PortProtocol("default_web", 8080))
+	assert.Equal(t, "tcp", rs.PortProtocol("default_web", 9999))
+
+	// Stopping the sandbox releases its host ports.
+	_, err = rs.StopPodSandbox(ctx, &cri.StopPodSandboxRequest{PodSandboxId: "default_web"})
+	require.NoError(t, err)
+	assert.NoError(t, runSandboxWithPorts(rs, "other", &cri.PortMapping{Protocol: cri.Protocol_TCP, ContainerPort: 80, HostPort: 8080}))
+}
+
+func TestHostPortProxy(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello\n"))
+			conn.Close()
+		}
+	}()
+	containerPort := backend.Addr().(*net.TCPAddr).Port
+	// Find a free host port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	hostPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	host := net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort))
+
+	rs := newTestRuntimeService(t)
+	rs.EnableHostPortProxy()
+	require.NoError(t, runSandboxWithPorts(rs, "web", &cri.PortMapping{
+		Protocol: cri.Protocol_TCP, ContainerPort: int32(containerPort), HostPort: int32(hostPort), HostIp: "127.0.0.1",
+	}))
+	conn, err := net.Dial("tcp", host)
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", reply)
+
+	_, err = rs.RemovePodSandbox(context.Background(), &cri.RemovePodSandboxRequest{PodSandboxId: "default_web"})
+	require.NoError(t, err)
+	_, err = net.Dial("tcp", host)
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package runtimeservice
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// applyImageConfig fills in what the container config leaves out from the
+// image config, following the rules of Docker and Kubernetes:
+//
+//   - a command replaces the image entrypoint, and the image cmd is dropped;
+//   - args replace the image cmd;
+//   - environment variables of the container win over those of the image;
+//   - the working directory defaults to the one of the image;
+//   - the user of the image only applies if the pod sets none.
+func applyImageConfig(cnt *Container, config *cri.ContainerConfig, image *specs.ImageConfig) {
+	if image == nil {
+		return
+	}
+	if len(cnt.Command) == 0 {
+		cnt.Command = image.Entrypoint
+		if len(cnt.Args) == 0 {
+			cnt.Args = image.Cmd
+		}
+	}
+	cnt.Env = mergeEnv(image.Env, cnt.Env)
+	if cnt.WorkingDir == "" {
+		cnt.WorkingDir = image.WorkingDir
+	}
+	if !setsUser(config) {
+		cnt.User = image.User
+	}
+	cnt.StopSignal = image.StopSignal
+}
+
+func setsUser(config *cri.ContainerConfig) bool {
+	sc := config.GetLinux().GetSecurityContext()
+	return sc.GetRunAsUser() != nil || sc.GetRunAsUsername() != ""
+}
+
+// runAsUser returns the user the security context of config sets, in the
+// user[:group] form of image users.
+func runAsUser(config *cri.ContainerConfig) string {
+	sc := config.GetLinux().GetSecurityContext()
+	u := sc.GetRunAsUsername()
+	if u == "" && sc.GetRunAsUser() != nil {
+		u = strconv.FormatInt(sc.GetRunAsUser().Value, 10)
+	}
+	if u != "" && sc.GetRunAsGroup() != nil {
+		u += ":" + strconv.FormatInt(sc.GetRunAsGroup().Value, 10)
+	}
+	return u
+}
+
+// mergeEnv returns the variables of base, overridden or followed by those of
+// overrides, all of them in NAME=value form.
+func mergeEnv(base, overrides []string) []string {
+	env := make([]string, 0, len(base)+len(overrides))
+	index := make(map[string]int)
+	for _, list := range [][]string{base, overrides} {
+		for _, kv := range list {
+			name := strings.SplitN(kv, "=", 2)[0]
+			if i, ok := index[name]; ok {
+				env[i] = kv
+				continue
+			}
+			index[name] = len(env)
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// parseSignal parses a stop signal of an image config, e.g. "SIGINT", "INT"
+// or "2".
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || unix.SignalName(syscall.Signal(n)) == "" {
+			return 0, fmt.Errorf("invalid signal %s", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("invalid signal %s", s)
+	}
+	return sig, nil
+}
+
+// userCredential returns the credential to run processes of the image user
+// u, "name", "uid", "name:group" or "uid:gid", with. Users and groups are
+// looked up on the host. It is nil if processes run as the user procri runs
+// as, which is the only choice unless procri runs as root.
+func userCredential(u string) (*syscall.Credential, error) {
+	if u == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(u, ":", 2)
+	uid, gid, err := lookupUser(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 2 {
+		gid, err = lookupGroup(parts[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if uid == uint32(os.Getuid()) && (len(parts) == 1 || gid == uint32(os.Getgid())) {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("user %s is not the user procri runs as, uid %d", u, os.Getuid())
+	}
+	return &syscall.Credential{Uid: uid, Gid: gid}, nil
+}
+
+// lookupRunUser returns the account of the user processes of a container with
+// image user u run as, nil if it is unknown.
+func lookupRunUser(u string) *user.User {
+	var usr *user.User
+	var err error
+	name := strings.SplitN(u, ":", 2)[0]
+	switch {
+	case name == "":
+		usr, err = user.Current()
+	case strings.Trim(name, "0123456789") == "":
+		usr, err = user.LookupId(name)
+	default:
+		usr, err = user.Lookup(name)
+	}
+	if err != nil {
+		return nil
+	}
+	return usr
+}
+
+func lookupUser(name string) (uint32, uint32, error) {
+	var usr *user.User
+	var err error
+	if uid, numErr := strconv.ParseUint(name, 10, 32); numErr == nil {
+		usr, err = user.LookupId(name)
+		if err != nil {
+			// Like Docker, unknown uids run with group 0.
+			return uint32(uid), 0, nil
+		}
+	} else {
+		usr, err = user.Lookup(name)
+		if err != nil {
+			return 0, 0, fmt.Errorf("image user: %v", err)
+		}
+	}
+	uid, err := strconv.ParseUint(usr.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("image user %s: %v", name, err)
+	}
+	gid, err := strconv.ParseUint(usr.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("image user %s: %v", name, err)
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("image group: %v", err)
+	}
+	gid, err := strconv.ParseUint(group.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("image group %s: %v", name, err)
+	}
+	return uint32(gid), nil
+}
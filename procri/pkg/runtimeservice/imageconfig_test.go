@@ -0,0 +1,102 @@
+package runtimeservice
+
+import (
+	"syscall"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func TestApplyImageConfig(t *testing.T) {
+	image := &specs.ImageConfig{
+		Entrypoint: []string{"/bin/app"},
+		Cmd:        []string{"serve"},
+		Env:        []string{"PATH=/app/bin", "MODE=image"},
+		WorkingDir: "/app",
+		User:       "app",
+		StopSignal: "SIGINT",
+	}
+	runAsRoot := &cri.LinuxContainerConfig{
+		SecurityContext: &cri.LinuxContainerSecurityContext{RunAsUser: &cri.Int64Value{Value: 0}},
+	}
+	testCases := []struct {
+		name     string
+		config   cri.ContainerConfig
+		cnt      Container
+		expected Container
+	}{
+		{
+			name: "image defaults",
+			expected: Container{
+				Command:    []string{"/bin/app"},
+				Args:       []string{"serve"},
+				Env:        []string{"PATH=/app/bin", "MODE=image"},
+				WorkingDir: "/app",
+				User:       "app",
+				StopSignal: "SIGINT",
+			},
+		},
+		{
+			name: "args replace cmd",
+			cnt:  Container{Args: []string{"migrate"}},
+			expected: Container{
+				Command:    []string{"/bin/app"},
+				Args:       []string{"migrate"},
+				Env:        []string{"PATH=/app/bin", "MODE=image"},
+				WorkingDir: "/app",
+				User:       "app",
+				StopSignal: "SIGINT",
+			},
+		},
+		{
+			name:   "command drops cmd, pod settings win",
+			config: cri.ContainerConfig{Linux: runAsRoot},
+			cnt: Container{
+				Command:    []string{"/bin/sh"},
+				Env:        []string{"MODE=pod", "DEBUG=1"},
+				WorkingDir: "/tmp",
+			},
+			expected: Container{
+				Command:    []string{"/bin/sh"},
+				Env:        []string{"PATH=/app/bin", "MODE=pod", "DEBUG=1"},
+				WorkingDir: "/tmp",
+				StopSignal: "SIGINT",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		applyImageConfig(&tc.cnt, &tc.config, image)
+		assert.Equal(t, tc.expected, tc.cnt, tc.name)
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	testCases := []struct {
+		sc   *cri.LinuxContainerSecurityContext
+		user string
+	}{
+		{&cri.LinuxContainerSecurityContext{}, ""},
+		{&cri.LinuxContainerSecurityContext{RunAsUser: &cri.Int64Value{Value: 1000}}, "1000"},
+		{&cri.LinuxContainerSecurityContext{RunAsUsername: "app", RunAsUser: &cri.Int64Value{Value: 1000}}, "app"},
+		{&cri.LinuxContainerSecurityContext{RunAsUser: &cri.Int64Value{Value: 1000}, RunAsGroup: &cri.Int64Value{Value: 20}}, "1000:20"},
+		{&cri.LinuxContainerSecurityContext{RunAsGroup: &cri.Int64Value{Value: 20}}, ""},
+	}
+	for _, tc := range testCases {
+		config := &cri.ContainerConfig{Linux: &cri.LinuxContainerConfig{SecurityContext: tc.sc}}
+		assert.Equal(t, tc.user, runAsUser(config), "%+v", tc.sc)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, s := range []string{"SIGINT", "int", "2"} {
+		sig, err := parseSignal(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, syscall.SIGINT, sig, s)
+	}
+	for _, s := range []string{"", "SIGNOPE", "0", "1000"} {
+		_, err := parseSignal(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/elotl/procri/pkg/metrics"
 	"k8s.io/klog"
 )
 
@@ -16,23 +17,25 @@ const (
 )
 
 type LogPipe struct {
-	stdout io.ReadCloser
-	stderr io.ReadCloser
-	log    io.WriteCloser
-	wg     *sync.WaitGroup
+	containerID string
+	stdout      io.ReadCloser
+	stderr      io.ReadCloser
+	log         io.WriteCloser
+	wg          *sync.WaitGroup
 }
 
-func NewLogPipe(stdout, stderr io.ReadCloser, logPath string) (*LogPipe, error) {
+func NewLogPipe(containerID string, stdout, stderr io.ReadCloser, logPath string) (*LogPipe, error) {
 	logFile, err := os.Create(logPath)
 	if err != nil {
 		return nil, err
 	}
 
 	return &LogPipe{
-		stdout: stdout,
-		stderr: stderr,
-		log:    logFile,
-		wg:     &sync.WaitGroup{},
+		containerID: containerID,
+		stdout:      stdout,
+		stderr:      stderr,
+		log:         logFile,
+		wg:          &sync.WaitGroup{},
 	}, nil
 }
 
@@ -40,13 +43,13 @@ func (lp *LogPipe) Start() {
 	lp.wg.Add(1)
 	go func() {
 		defer lp.wg.Done()
-		pipeOutputToLogFile(lp.stdout, "stdout", lp.log)
+		pipeOutputToLogFile(lp.containerID, lp.stdout, "stdout", lp.log)
 	}()
 
 	lp.wg.Add(1)
 	go func() {
 		defer lp.wg.Done()
-		pipeOutputToLogFile(lp.stderr, "stderr", lp.log)
+		pipeOutputToLogFile(lp.containerID, lp.stderr, "stderr", lp.log)
 	}()
 }
 
@@ -54,7 +57,8 @@ func (lp *LogPipe) Wait() {
 	lp.wg.Wait()
 }
 
-func pipeOutputToLogFile(stream io.ReadCloser, streamType string, logFile io.Writer) {
+func pipeOutputToLogFile(containerID string, stream io.ReadCloser, streamType string, logFile io.Writer) {
+	logBytes := metrics.ContainerLogBytes.WithLabelValues(containerID, streamType)
 	reader := bufio.NewReader(stream)
 	for {
 		line, err := reader.ReadString('\n')
@@ -67,6 +71,7 @@ func pipeOutputToLogFile(stream io.ReadCloser, streamType string, logFile io.Wri
 			break
 		}
 		timestamp := time.Now().Format(RFC3339NanoLenient)
-		fmt.Fprintf(logFile, "%s %s F %s", timestamp, streamType, line)
+		n, _ := fmt.Fprintf(logFile, "%s %s F %s", timestamp, streamType, line)
+		logBytes.Add(float64(n))
 	}
 }
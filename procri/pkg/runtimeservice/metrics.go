@@ -0,0 +1,87 @@
+package runtimeservice
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+var (
+	sandboxesDesc = prometheus.NewDesc(
+		"procri_sandboxes",
+		"Number of pod sandboxes per state.",
+		[]string{"state"}, nil,
+	)
+	containersDesc = prometheus.NewDesc(
+		"procri_containers",
+		"Number of containers per state.",
+		[]string{"state"}, nil,
+	)
+	containerCPUDesc = prometheus.NewDesc(
+		"procri_container_cpu_seconds_total",
+		"Cumulative CPU time consumed by the process tree of a running container.",
+		[]string{"container_id", "pod_id"}, nil,
+	)
+	containerMemoryDesc = prometheus.NewDesc(
+		"procri_container_memory_rss_bytes",
+		"Resident memory of the process tree of a running container.",
+		[]string{"container_id", "pod_id"}, nil,
+	)
+)
+
+// stateCollector exposes the sandboxes and containers known to a
+// RuntimeService. The values are computed on every scrape.
+type stateCollector struct {
+	rs *RuntimeService
+}
+
+// NewStateCollector returns a Prometheus collector for the sandbox and
+// container state of rs.
+func NewStateCollector(rs *RuntimeService) prometheus.Collector {
+	return &stateCollector{rs: rs}
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sandboxesDesc
+	ch <- containersDesc
+	ch <- containerCPUDesc
+	ch <- containerMemoryDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	sandboxStates := make(map[cri.PodSandboxState]int)
+	for _, pod := range c.rs.listSandboxes() {
+		sandboxStates[pod.State]++
+	}
+	for value, name := range cri.PodSandboxState_name {
+		state := cri.PodSandboxState(value)
+		ch <- prometheus.MustNewConstMetric(sandboxesDesc, prometheus.GaugeValue, float64(sandboxStates[state]), name)
+	}
+
+	containers := c.rs.listContainers()
+	containerStates := make(map[cri.ContainerState]int)
+	for _, cnt := range containers {
+		containerStates[cnt.State]++
+	}
+	for value, name := range cri.ContainerState_name {
+		state := cri.ContainerState(value)
+		ch <- prometheus.MustNewConstMetric(containersDesc, prometheus.GaugeValue, float64(containerStates[state]), name)
+	}
+
+	if containerStates[cri.ContainerState_CONTAINER_RUNNING] == 0 {
+		return
+	}
+	procs, err := listProcesses()
+	if err != nil {
+		klog.Warningf("collecting container process metrics: %v", err)
+		return
+	}
+	for _, cnt := range containers {
+		if cnt.State != cri.ContainerState_CONTAINER_RUNNING || cnt.Pid == 0 {
+			continue
+		}
+		cpu, rss := processTreeUsage(procs, cnt.Pid)
+		ch <- prometheus.MustNewConstMetric(containerCPUDesc, prometheus.CounterValue, cpu.Seconds(), cnt.ID, cnt.PodID)
+		ch <- prometheus.MustNewConstMetric(containerMemoryDesc, prometheus.GaugeValue, float64(rss), cnt.ID, cnt.PodID)
+	}
+}
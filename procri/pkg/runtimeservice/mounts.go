@@ -0,0 +1,316 @@
+package runtimeservice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/elotl/procri/pkg/imagestore"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+// rootEnv is the variable telling processes where their root, and so the
+// volumes mounted into it, is on the host.
+const rootEnv = "PROCRI_ROOT"
+
+// Mount is a volume of a container. Processes run on the host filesystem, so
+// volumes are symlinks from the container path inside the root of the
+// container to the host path. Read-only volumes link to a copy of the host
+// path without write permissions instead, so the workload can't change what
+// other pods see. Volumes of host images, whose processes don't use their
+// root, and the service account are also linked at the container path on the
+// host, see linkHostPaths.
+type Mount struct {
+	ContainerPath string `json:"containerPath"`
+	HostPath      string `json:"hostPath"`
+	Readonly      bool   `json:"readonly,omitempty"`
+	// Link is the host path of the symlink.
+	Link string `json:"link,omitempty"`
+	// Copy is the read-only copy of the host path the link points to.
+	Copy string `json:"copy,omitempty"`
+}
+
+// target returns what the links of the volume point to.
+func (m Mount) target() string {
+	if m.Copy != "" {
+		return m.Copy
+	}
+	return m.HostPath
+}
+
+// containerRoot returns the root of a container: the copy of its image, or
+// for host images an otherwise empty directory holding its volumes.
+func (rs *RuntimeService) containerRoot(cnt *Container) string {
+	if cnt.RootFS != "" {
+		return cnt.RootFS
+	}
+	return filepath.Join(rs.containerDir(cnt.PodID, cnt.ID), "root")
+}
+
+// setUpMounts links the volumes of a container into its root, copying
+// read-only ones into dir, the directory of the container. The mount policy
+// has to be checked before.
+func setUpMounts(cid, dir, root string, mounts []*cri.Mount) ([]Mount, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	result := make([]Mount, 0, len(mounts))
+	for i, m := range mounts {
+		klog.V(5).Infof("CreateContainer %s %s -> %s", cid, m.HostPath, m.ContainerPath)
+		mount := Mount{
+			ContainerPath: m.ContainerPath,
+			HostPath:      m.HostPath,
+			Readonly:      m.Readonly,
+		}
+		target := m.HostPath
+		if m.Readonly {
+			copy, err := readOnlyCopy(m.HostPath, filepath.Join(dir, "volumes", strconv.Itoa(i)))
+			if err != nil {
+				return result, fmt.Errorf("read-only volume %s: %v", m.ContainerPath, err)
+			}
+			mount.Copy, target = copy, copy
+		}
+		link, err := linkMount(root, target, m.ContainerPath)
+		if err != nil {
+			return result, err
+		}
+		mount.Link = link
+		result = append(result, mount)
+		klog.V(3).Infof("symlinked volume mount %s->%s", target, link)
+	}
+	return result, nil
+}
+
+// readOnlyCopy copies the volume at hostPath to dst, and removes the write
+// permissions of the copy.
+func readOnlyCopy(hostPath, dst string) (string, error) {
+	// Volumes of kubelet are often symlinks, copy what they point to.
+	src, err := filepath.EvalSymlinks(hostPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := imagestore.CloneTree(src, dst); err != nil {
+		return "", err
+	}
+	if err := makeReadOnly(dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// Volume plugins of kubelet whose volumes are private to the pod and
+// refreshed by kubelet, so a container writing to its copy only affects
+// itself.
+var kubeletVolumePlugins = []string{
+	"kubernetes.io~secret",
+	"kubernetes.io~configmap",
+	"kubernetes.io~projected",
+	"kubernetes.io~downward-api",
+}
+
+func isKubeletVolume(hostPath string) bool {
+	for _, plugin := range kubeletVolumePlugins {
+		if strings.Contains(hostPath, "/volumes/"+plugin+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unenforcedReadOnly returns why the read-only volumes or root filesystem
+// config asks for are not enforced for cnt, or "" if they are. Both rely on
+// file permissions, which stop neither root nor the user procri runs as, who
+// owns the copies and can make them writable again, and processes of host
+// images don't use their root. Secret, ConfigMap, projected and downward API
+// volumes of kubelet are left out.
+func unenforcedReadOnly(cnt *Container, config *cri.ContainerConfig) string {
+	readOnlyRootfs := config.GetLinux().GetSecurityContext().GetReadonlyRootfs()
+	readOnlyMounts := false
+	for _, m := range config.Mounts {
+		readOnlyMounts = readOnlyMounts || (m.Readonly && !isKubeletVolume(m.HostPath))
+	}
+	if !readOnlyRootfs && !readOnlyMounts {
+		return ""
+	}
+	if readOnlyRootfs && cnt.RootFS == "" {
+		return fmt.Sprintf("processes of host image %s write to the host filesystem", cnt.Image)
+	}
+	uid := uint32(os.Getuid())
+	if cnt.User != "" {
+		var err error
+		if uid, _, err = lookupUser(strings.SplitN(cnt.User, ":", 2)[0]); err != nil {
+			return err.Error()
+		}
+	}
+	if uid == 0 || uid == uint32(os.Geteuid()) {
+		return fmt.Sprintf("processes run as uid %d, root or the user procri runs as; set runAsUser to another user", uid)
+	}
+	return ""
+}
+
+// makeReadOnly removes the write permissions of the files and directories
+// under root. Symlinks, and so writable volumes, are not followed.
+func makeReadOnly(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 || info.Mode().Perm()&0222 == 0 {
+			return nil
+		}
+		return os.Chmod(path, info.Mode().Perm()&^0222)
+	})
+}
+
+// makeRemovable gives the owner write permissions on the directories under
+// root, so they can be removed.
+func makeRemovable(root string) {
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || info.Mode().Perm()&0200 != 0 {
+			return nil
+		}
+		if err := os.Chmod(path, info.Mode().Perm()|0200); err != nil {
+			klog.Warningf("making %s writable: %v", path, err)
+		}
+		return nil
+	})
+}
+
+func linkMount(root, hostPath, containerPath string) (string, error) {
+	if !filepath.IsAbs(containerPath) {
+		return "", fmt.Errorf("mount path %s is not absolute", containerPath)
+	}
+	// Symlinks of the image are followed inside the root, so the link never
+	// ends up outside of it.
+	dir, err := imagestore.ResolveInRoot(root, filepath.Dir(containerPath))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	link := filepath.Join(dir, filepath.Base(containerPath))
+	// Like a mount, the volume hides what the image has at its path. This
+	// is the private copy of the container, the image itself is untouched.
+	if err := os.RemoveAll(link); err != nil {
+		return "", err
+	}
+	if err := os.Symlink(hostPath, link); err != nil {
+		return "", err
+	}
+	return link, nil
+}
+
+// hostLinkTarget returns what volume m of cnt is linked to at its container
+// path on the host, or "" if it isn't. Processes of host images open their
+// volumes at the absolute paths, as they did before containers had a root.
+// In-cluster clients of all containers read the service account at its
+// absolute path; it links to the volume of kubelet, so the containers of a
+// pod share the link and see the tokens kubelet rotates.
+func hostLinkTarget(cnt *Container, m Mount) string {
+	switch {
+	case m.HostPath == m.ContainerPath:
+		return ""
+	case filepath.Clean(m.ContainerPath) == serviceAccountPath:
+		return m.HostPath
+	case cnt.RootFS == "":
+		return m.target()
+	}
+	return ""
+}
+
+// linkHostPaths links the volumes of cnt at their container paths under
+// hostRoot, where nothing else is, and returns the container paths it
+// couldn't link. Existing files are never replaced, and a path already linked
+// by another container stays with it; the volume is linked once that
+// container is removed, by refreshVolumes. Volumes are always reachable under
+// the root of the container.
+func linkHostPaths(cnt *Container, hostRoot string) []string {
+	var unlinked []string
+	for _, m := range cnt.Mounts {
+		target := hostLinkTarget(cnt, m)
+		if target == "" {
+			continue
+		}
+		if err := linkHostPath(filepath.Join(hostRoot, m.ContainerPath), target); err != nil {
+			klog.V(2).Infof("volume %s of container %s is not linked on the host: %v", m.ContainerPath, cnt.ID, err)
+			unlinked = append(unlinked, filepath.Clean(m.ContainerPath))
+		}
+	}
+	return unlinked
+}
+
+// linkHostPath symlinks path to target, unless path exists. Only dangling
+// links, e.g. left behind by a crash, are replaced.
+func linkHostPath(path, target string) error {
+	if existing, err := os.Readlink(path); err == nil {
+		if existing == target {
+			return nil
+		}
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s links to %s", path, existing)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	} else if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s exists", path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+// unlinkHostPaths deletes the links linkHostPaths made for cnt.
+func unlinkHostPaths(cnt *Container, hostRoot string) {
+	for _, m := range cnt.Mounts {
+		target := hostLinkTarget(cnt, m)
+		if target == "" {
+			continue
+		}
+		path := filepath.Join(hostRoot, m.ContainerPath)
+		if existing, err := os.Readlink(path); err != nil || existing != target {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			klog.Warningf("removing host link %s of container %s: %v", path, cnt.ID, err)
+		}
+	}
+}
+
+// removeMounts deletes the links of the volumes of a container.
+func removeMounts(cnt *Container) {
+	for _, m := range cnt.Mounts {
+		if m.Link == "" {
+			continue
+		}
+		info, err := os.Lstat(m.Link)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err := os.Remove(m.Link); err != nil {
+			klog.Warningf("removing mount %s of container %s: %v", m.Link, cnt.ID, err)
+		}
+	}
+}
+
+func mountsToCRIMounts(mounts []Mount) []*cri.Mount {
+	result := make([]*cri.Mount, 0, len(mounts))
+	for _, m := range mounts {
+		result = append(result, &cri.Mount{
+			ContainerPath: m.ContainerPath,
+			HostPath:      m.HostPath,
+			Readonly:      m.Readonly,
+		})
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package runtimeservice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+const hostsPath = "/etc/hosts"
+
+func (rs *RuntimeService) podHosts(podID string) string {
+	return filepath.Join(rs.podsDir, podID, "hosts")
+}
+
+func (rs *RuntimeService) podTmpDir(podID string) string {
+	return filepath.Join(rs.podsDir, podID, "tmp")
+}
+
+// hostname returns the hostname of the pod, its name unless kubelet set one.
+func (pod *Sandbox) hostname() string {
+	if pod.Hostname != "" {
+		return pod.Hostname
+	}
+	return pod.Name
+}
+
+// setUpPod creates the files shared by the containers of a pod: its hosts
+// file, resolver configuration and temporary directory.
+func (rs *RuntimeService) setUpPod(pod *Sandbox) error {
+	tmp := rs.podTmpDir(pod.ID)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	// Like /tmp, writable by any user processes of the pod run as.
+	if err := os.Chmod(tmp, 0777|os.ModeSticky); err != nil {
+		return err
+	}
+	hosts := fmt.Sprintf("# Kubernetes-managed hosts file (procri).\n127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n%s\t%s\n",
+		rs.ipAddress, pod.hostname())
+	if err := ioutil.WriteFile(rs.podHosts(pod.ID), []byte(hosts), 0644); err != nil {
+		return err
+	}
+	if pod.DNSConfig != nil {
+		if err := rs.writeResolvConf(pod); err != nil {
+			return fmt.Errorf("writing resolv.conf: %v", err)
+		}
+	}
+	return nil
+}
+
+// linkPodFiles links the hosts file and the resolver configuration of the pod
+// into the root of a container, unless it mounts its own, like the hosts file
+// of kubelet with the HostAliases of the pod, and adds the variables for the
+// DNS configuration the container doesn't set.
+func (rs *RuntimeService) linkPodFiles(pod *Sandbox, root string, cnt *Container) error {
+	files := map[string]string{hostsPath: rs.podHosts(pod.ID)}
+	if pod.DNSConfig != nil {
+		files[resolvConfPath] = rs.podResolvConf(pod.ID)
+	}
+	for _, m := range cnt.Mounts {
+		delete(files, filepath.Clean(m.ContainerPath))
+	}
+	for containerPath, hostPath := range files {
+		if _, err := linkMount(root, hostPath, containerPath); err != nil {
+			return err
+		}
+		klog.V(3).Infof("linked %s of pod %s into container %s", strings.TrimPrefix(containerPath, "/etc/"), pod.ID, cnt.ID)
+	}
+	cnt.Env = mergeEnv(dnsEnv(pod), cnt.Env)
+	return nil
+}
@@ -3,6 +3,7 @@ package runtimeservice
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -30,8 +31,13 @@ type Sandbox struct {
 	Labels       map[string]string
 	Annotations  map[string]string
 	Containers   []string
+	DNSConfig    *cri.DNSConfig     `json:",omitempty"`
+	PortMappings []*cri.PortMapping `json:",omitempty"`
 }
 
+// Containers of a stopped sandbox are killed if they don't exit within this.
+const podStopTimeout = 30 * time.Second
+
 //
 // Implementation of podsandbox calls in cri.Runtimeservice.
 //
@@ -112,8 +118,6 @@ func (rs *RuntimeService) listSandboxes() []*Sandbox {
 // RunPodSandbox creates and starts a pod-level sandbox. Runtimes must ensure
 // the sandbox is in the ready state on success.
 func (rs *RuntimeService) RunPodSandbox(ctx context.Context, req *cri.RunPodSandboxRequest) (*cri.RunPodSandboxResponse, error) {
-	klog.V(4).Infof("RunPodSandbox request %+v", req)
-
 	if req.Config == nil || req.Config.Metadata == nil {
 		err := fmt.Errorf("PodSandbox missing configuration in %#v", req)
 		klog.Errorf("%v", err)
@@ -139,9 +143,38 @@ func (rs *RuntimeService) RunPodSandbox(ctx context.Context, req *cri.RunPodSand
 		Labels:       req.Config.Labels,
 		Annotations:  req.Config.Annotations,
 		CreatedAt:    time.Now().UnixNano(),
+		DNSConfig:    req.Config.DnsConfig,
+		PortMappings: req.Config.PortMappings,
 	}
 
+	// Host ports are reserved by storing the sandbox, so no other sandbox
+	// may be stored in between.
+	rs.portsMu.Lock()
+	if rs.isDraining() {
+		rs.portsMu.Unlock()
+		err := fmt.Errorf("PodSandbox %s refused: procri is draining for maintenance", podID)
+		klog.Warningf("%v", err)
+		return nil, err
+	}
+	if err := rs.reserveHostPorts(&sandbox); err != nil {
+		rs.portsMu.Unlock()
+		klog.Errorf("RunPodSandbox %s: %v", podID, err)
+		return nil, err
+	}
+	if err := rs.setUpPod(&sandbox); err != nil {
+		rs.portsMu.Unlock()
+		klog.Errorf("RunPodSandbox %s: %v", podID, err)
+		return nil, err
+	}
+	if err := rs.startProxies(&sandbox); err != nil {
+		rs.portsMu.Unlock()
+		_ = os.RemoveAll(filepath.Join(rs.podsDir, podID))
+		klog.Errorf("RunPodSandbox %s: %v", podID, err)
+		return nil, err
+	}
 	rs.putSandbox(podID, &sandbox)
+	rs.portsMu.Unlock()
+	rs.updateDNSServers()
 
 	resp := cri.RunPodSandboxResponse{
 		PodSandboxId: podID,
@@ -151,7 +184,9 @@ func (rs *RuntimeService) RunPodSandbox(ctx context.Context, req *cri.RunPodSand
 	return &resp, nil
 }
 
-func (rs *RuntimeService) terminateSandboxContainers(ctx context.Context, pod *Sandbox, force bool) error {
+// terminateSandboxContainers stops and removes the containers of pod, killing
+// those still running at deadline.
+func (rs *RuntimeService) terminateSandboxContainers(ctx context.Context, pod *Sandbox, deadline time.Time) error {
 	podID := pod.ID
 
 	containers := make([]string, len(pod.Containers))
@@ -160,8 +195,9 @@ func (rs *RuntimeService) terminateSandboxContainers(ctx context.Context, pod *S
 	for i, cntID := range containers {
 		cnt := rs.getContainer(cntID)
 		if cnt != nil {
-			timeout := int64(30)
-			if force {
+			// Rounded up, so containers get at least what is left.
+			timeout := int64((time.Until(deadline) + time.Second - 1) / time.Second)
+			if timeout < 0 {
 				timeout = 0
 			}
 
@@ -171,6 +207,7 @@ func (rs *RuntimeService) terminateSandboxContainers(ctx context.Context, pod *S
 				return err
 			}
 			rs.deleteContainer(cntID)
+			rs.removeContainerDir(cnt)
 		}
 
 		pod.Containers = containers[i+1:]
@@ -189,11 +226,16 @@ func (rs *RuntimeService) removeSandbox(ctx context.Context, podID string) error
 		return nil
 	}
 
-	if err := rs.terminateSandboxContainers(ctx, pod, true); err != nil {
+	if err := rs.terminateSandboxContainers(ctx, pod, time.Now()); err != nil {
 		return err
 	}
 
+	rs.releaseHostPorts(podID)
 	rs.deleteSandbox(podID)
+	if err := os.RemoveAll(filepath.Join(rs.podsDir, podID)); err != nil {
+		klog.Warningf("removing directory of pod %s: %v", podID, err)
+	}
+	rs.updateDNSServers()
 
 	return nil
 }
@@ -208,8 +250,6 @@ func (rs *RuntimeService) removeSandbox(ctx context.Context, podID string) error
 // reclaim resources eagerly, as soon as a sandbox is not needed. Hence,
 // multiple StopPodSandbox calls are expected.
 func (rs *RuntimeService) StopPodSandbox(ctx context.Context, req *cri.StopPodSandboxRequest) (*cri.StopPodSandboxResponse, error) {
-	klog.V(4).Infof("StopPodSandbox request %+v", req)
-
 	resp := cri.StopPodSandboxResponse{}
 
 	pod := rs.getSandbox(req.PodSandboxId)
@@ -219,12 +259,12 @@ func (rs *RuntimeService) StopPodSandbox(ctx context.Context, req *cri.StopPodSa
 		return &resp, nil
 	}
 
-	if err := rs.terminateSandboxContainers(ctx, pod, false); err != nil {
+	if err := rs.terminateSandboxContainers(ctx, pod, time.Now().Add(podStopTimeout)); err != nil {
 		klog.Errorf("StopPodSandbox terminateSandboxContainers err: %v", err)
 		return nil, err
 	}
+	rs.releaseHostPorts(pod.ID)
 
-	klog.V(4).Infof("StopPodSandbox for %s succeeded", req.PodSandboxId)
 	return &resp, nil
 }
 
@@ -233,8 +273,6 @@ func (rs *RuntimeService) StopPodSandbox(ctx context.Context, req *cri.StopPodSa
 // This call is idempotent, and must not return an error if the sandbox has
 // already been removed.
 func (rs *RuntimeService) RemovePodSandbox(ctx context.Context, req *cri.RemovePodSandboxRequest) (*cri.RemovePodSandboxResponse, error) {
-	klog.V(4).Infof("RemovePodSandbox request %+v", req)
-
 	err := rs.removeSandbox(ctx, req.PodSandboxId)
 	if err != nil {
 		klog.Errorf("RemovePodSandbox error: %v", err)
@@ -243,15 +281,12 @@ func (rs *RuntimeService) RemovePodSandbox(ctx context.Context, req *cri.RemoveP
 
 	resp := cri.RemovePodSandboxResponse{}
 
-	klog.V(4).Infof("RemovePodSandbox for %s succeeded", req.PodSandboxId)
 	return &resp, nil
 }
 
 // PodSandboxStatus returns the status of the PodSandbox. If the PodSandbox is not
 // present, returns an error.
 func (rs *RuntimeService) PodSandboxStatus(ctx context.Context, req *cri.PodSandboxStatusRequest) (*cri.PodSandboxStatusResponse, error) {
-	klog.V(4).Infof("PodSandboxStatus request %+v", req)
-
 	podID := req.PodSandboxId
 
 	pod := rs.getSandbox(podID)
@@ -281,7 +316,6 @@ func (rs *RuntimeService) PodSandboxStatus(ctx context.Context, req *cri.PodSand
 		Info: make(map[string]string),
 	}
 
-	klog.V(4).Infof("PodSandboxStatus for %s: %v", podID, resp.Status.State)
 	return &resp, nil
 }
 
@@ -344,8 +378,6 @@ func filterPodsByState(state *cri.PodSandboxStateValue, pods []*Sandbox) []*Sand
 
 // ListPodSandbox returns a list of PodSandboxes.
 func (rs *RuntimeService) ListPodSandbox(ctx context.Context, req *cri.ListPodSandboxRequest) (*cri.ListPodSandboxResponse, error) {
-	klog.V(4).Infof("ListPodSandbox request %+v", req)
-
 	pods := rs.listSandboxes()
 	if req.Filter != nil {
 		pods = filterPodsByName(req.Filter.Id, pods)
@@ -354,7 +386,6 @@ func (rs *RuntimeService) ListPodSandbox(ctx context.Context, req *cri.ListPodSa
 	}
 
 	items := make([]*cri.PodSandbox, 0)
-	names := make([]string, 0)
 	for _, pod := range pods {
 		sb := &cri.PodSandbox{
 			Id: pod.ID,
@@ -370,13 +401,11 @@ func (rs *RuntimeService) ListPodSandbox(ctx context.Context, req *cri.ListPodSa
 			Annotations: pod.Annotations,
 		}
 		items = append(items, sb)
-		names = append(names, sb.Metadata.Name)
 	}
 
 	resp := cri.ListPodSandboxResponse{
 		Items: items,
 	}
 
-	klog.V(4).Infof("ListPodSandbox request %v found %v", req, names)
 	return &resp, nil
 }
@@ -0,0 +1,125 @@
+package runtimeservice
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type processInfo struct {
+	Pid     int
+	Ppid    int
+	RSS     uint64 // Resident set size in bytes.
+	CPUTime time.Duration
+}
+
+// listProcesses returns a snapshot of all processes on the host. It uses ps,
+// since that works the same way on macOS and Linux, and does not need cgo.
+func listProcesses() ([]processInfo, error) {
+	out, err := exec.Command("ps", "-A", "-o", "pid=,ppid=,rss=,time=").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing processes: %v", err)
+	}
+	return parseProcessList(out), nil
+}
+
+func parseProcessList(out []byte) []processInfo {
+	procs := make([]processInfo, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		rss, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		cpu, err := parseCPUTime(fields[3])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, processInfo{
+			Pid:     pid,
+			Ppid:    ppid,
+			RSS:     rss * 1024,
+			CPUTime: cpu,
+		})
+	}
+	return procs
+}
+
+// parseCPUTime parses the cumulative CPU time printed by ps. This is
+// "[[dd-]hh:]mm:ss" on Linux and "mm:ss.ss" on macOS.
+func parseCPUTime(s string) (time.Duration, error) {
+	var days int64
+	if i := strings.Index(s, "-"); i >= 0 {
+		d, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU time %q", s)
+		}
+		days = d
+		s = s[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid CPU time %q", s)
+	}
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CPU time %q", s)
+	}
+	total := time.Duration(seconds * float64(time.Second))
+	multiplier := time.Minute
+	for i := len(parts) - 2; i >= 0; i-- {
+		v, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU time %q", s)
+		}
+		total += time.Duration(v) * multiplier
+		multiplier *= 60
+	}
+	return total + time.Duration(days)*24*time.Hour, nil
+}
+
+// processTreeUsage sums the CPU time and resident memory of pid and all its
+// descendants.
+func processTreeUsage(procs []processInfo, pid int) (time.Duration, uint64) {
+	children := make(map[int][]int)
+	byPid := make(map[int]processInfo)
+	for _, p := range procs {
+		children[p.Ppid] = append(children[p.Ppid], p.Pid)
+		byPid[p.Pid] = p
+	}
+
+	var cpu time.Duration
+	var rss uint64
+	visited := make(map[int]bool)
+	queue := []int{pid}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		if p, ok := byPid[current]; ok {
+			cpu += p.CPUTime
+			rss += p.RSS
+		}
+		queue = append(queue, children[current]...)
+	}
+	return cpu, rss
+}
@@ -0,0 +1,81 @@
+package runtimeservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCPUTime(t *testing.T) {
+	testCases := []struct {
+		s      string
+		result time.Duration
+		fail   bool
+	}{
+		{
+			s:      "0:00.05",
+			result: 50 * time.Millisecond,
+		},
+		{
+			s:      "125:01.50",
+			result: 125*time.Minute + 1500*time.Millisecond,
+		},
+		{
+			s:      "00:00:03",
+			result: 3 * time.Second,
+		},
+		{
+			s:      "01:02:03",
+			result: time.Hour + 2*time.Minute + 3*time.Second,
+		},
+		{
+			s:      "2-01:00:00",
+			result: 49 * time.Hour,
+		},
+		{
+			s:    "foo",
+			fail: true,
+		},
+		{
+			s:    "1:2:3:4",
+			fail: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			result, err := parseCPUTime(tc.s)
+			if tc.fail {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.result, result)
+		})
+	}
+}
+
+func TestProcessTreeUsage(t *testing.T) {
+	out := []byte(`    1     0  1000   0:10.00
+  100     1   100   0:01.00
+  101   100   200   0:02.00
+  102   101   300   0:03.00
+  200     1   400   0:04.00
+  bad line
+`)
+	procs := parseProcessList(out)
+	assert.Len(t, procs, 5)
+
+	cpu, rss := processTreeUsage(procs, 100)
+	assert.Equal(t, 6*time.Second, cpu)
+	assert.Equal(t, uint64(600*1024), rss)
+
+	cpu, rss = processTreeUsage(procs, 200)
+	assert.Equal(t, 4*time.Second, cpu)
+	assert.Equal(t, uint64(400*1024), rss)
+
+	cpu, rss = processTreeUsage(procs, 999)
+	assert.Equal(t, time.Duration(0), cpu)
+	assert.Equal(t, uint64(0), rss)
+}
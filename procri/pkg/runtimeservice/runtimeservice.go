@@ -2,14 +2,17 @@ package runtimeservice
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/elotl/procri/pkg/mountpolicy"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/peterbourgon/diskv"
 	"golang.org/x/net/context"
 	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
-	"k8s.io/klog"
 	k8sstreaming "k8s.io/kubernetes/pkg/kubelet/server/streaming"
 )
 
@@ -25,18 +28,47 @@ func SymlinkError(what string) error {
 	return fmt.Errorf("Symlink for container failed: %s", what)
 }
 
+// ImageResolver finds the image a container is created from.
+type ImageResolver interface {
+	// ResolveImage returns the ID of image and its unpacked root, which is
+	// an empty string if the image runs binaries from the host.
+	ResolveImage(image string) (string, string, error)
+	// ImageConfig returns the entrypoint, environment and other execution
+	// parameters of image, or nil if it has none.
+	ImageConfig(image string) (*specs.ImageConfig, error)
+}
+
 type RuntimeService struct {
 	streamingServer k8sstreaming.Server
 	dataStore       *diskv.Diskv
+	podsDir         string
 	ipAddress       string
 	runtimeVersion  string
+	images          ImageResolver
+	mountPolicy     *mountpolicy.Policy
+	dns             DNSForwarder
+	// hostRoot is where volumes are linked at their container paths on the
+	// host, "/" but for tests.
+	hostRoot string
+
+	// portsMu serializes reserving host ports and guards proxies, the host
+	// port proxies of sandboxes, nil if the proxy is disabled.
+	portsMu sync.Mutex
+	proxies map[string][]io.Closer
+
+	// conditionsMu guards conditionReasons, the last reported reason of each
+	// runtime condition, empty while it is true.
+	conditionsMu     sync.Mutex
+	conditionReasons map[string]string
 }
 
 func NewRuntimeService(
 	streamingServer k8sstreaming.Server,
 	ipAddress string,
 	dataStore *diskv.Diskv,
+	podsDir string,
 	runtimeVersion string,
+	images ImageResolver,
 ) (*RuntimeService, error) {
 	err := os.MkdirAll(filepath.Join(dataStore.BasePath, sandboxSubdir), 0755)
 	if err != nil {
@@ -46,14 +78,28 @@ func NewRuntimeService(
 	if err != nil {
 		return nil, err
 	}
+	err = os.MkdirAll(podsDir, 0755)
+	if err != nil {
+		return nil, err
+	}
 	return &RuntimeService{
 		streamingServer: streamingServer,
 		ipAddress:       ipAddress,
 		dataStore:       dataStore,
+		podsDir:         podsDir,
 		runtimeVersion:  runtimeVersion,
+		images:          images,
+		mountPolicy:     mountpolicy.Default(),
+		hostRoot:        "/",
 	}, nil
 }
 
+// SetMountPolicy sets the policy deciding where containers may mount volumes,
+// instead of the default one.
+func (rs *RuntimeService) SetMountPolicy(policy *mountpolicy.Policy) {
+	rs.mountPolicy = policy
+}
+
 func convertToSemVer(buildVersion string) string {
 	// buildVersion is either legit semver tag
 	// or output of git describe --dirty (e.g. v0.0.1-12-gf102854-dirty)
@@ -66,8 +112,6 @@ func convertToSemVer(buildVersion string) string {
 
 // Version returns the runtime name, runtime version and runtime API version.
 func (rs *RuntimeService) Version(ctx context.Context, req *cri.VersionRequest) (*cri.VersionResponse, error) {
-	klog.V(4).Infof("Version request %+v", req)
-
 	resp := cri.VersionResponse{
 		Version:     req.Version, // Version of the kubelet runtime API.
 		RuntimeName: "procri",    // Name of the container runtime.
@@ -76,44 +120,32 @@ func (rs *RuntimeService) Version(ctx context.Context, req *cri.VersionRequest)
 		RuntimeApiVersion: "0.0.0",
 	}
 
-	klog.V(4).Infof("Version request %v: %v", req, resp)
 	return &resp, nil
 }
 
 // Status returns the status of the runtime.
 func (rs *RuntimeService) Status(ctx context.Context, req *cri.StatusRequest) (*cri.StatusResponse, error) {
-	klog.V(4).Infof("Status request %+v", req)
-
-	runtimeCondition := cri.RuntimeCondition{
-		Type:   cri.RuntimeReady,
-		Status: true,
-	}
-	networkCondition := cri.RuntimeCondition{
-		Type:   cri.NetworkReady,
-		Status: true,
-	}
 	status := &cri.RuntimeStatus{
 		Conditions: []*cri.RuntimeCondition{
-			&runtimeCondition,
-			&networkCondition,
+			rs.runtimeCondition(),
+			rs.networkCondition(),
 		},
 	}
+	for _, c := range status.Conditions {
+		rs.logCondition(c)
+	}
 	resp := cri.StatusResponse{
 		Status: status,
 	}
 
-	klog.V(4).Infof("Status request %v: %v", req, resp)
 	return &resp, nil
 }
 
 // UpdateRuntimeConfig updates runtime configuration if specified
 func (rs *RuntimeService) UpdateRuntimeConfig(ctx context.Context, req *cri.UpdateRuntimeConfigRequest) (*cri.UpdateRuntimeConfigResponse, error) {
-	klog.V(4).Infof("UpdateRuntimeConfig request %+v", req)
-
 	// CIDR to use for pod IP addresses.
 	// req.RuntimeConfig.NetworkConfig.PodCidr
 	resp := cri.UpdateRuntimeConfigResponse{}
 
-	klog.V(4).Infof("UpdateRuntimeConfig request %v: %v", req, resp)
 	return &resp, nil
 }
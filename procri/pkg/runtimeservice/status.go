@@ -0,0 +1,116 @@
+package runtimeservice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+// Reasons of the runtime conditions reported by Status.
+const (
+	reasonDataStoreNotWritable = "DataStoreNotWritable"
+	reasonStreamingServerDown  = "StreamingServerDown"
+	reasonHostAddressMissing   = "HostAddressMissing"
+	reasonDNSNotServing        = "DNSNotServing"
+)
+
+// HealthChecker is implemented by parts of procri the runtime service uses,
+// e.g. the streaming server and the DNS forwarder, that can tell whether they
+// work.
+type HealthChecker interface {
+	// Check returns an error if it doesn't work.
+	Check() error
+}
+
+// runtimeCondition returns the RuntimeReady condition: procri is not
+// draining, the data store and the directory of pods are writable, and the
+// streaming server accepts connections.
+func (rs *RuntimeService) runtimeCondition() *cri.RuntimeCondition {
+	if rs.isDraining() {
+		return notReady(cri.RuntimeReady, reasonDraining, fmt.Errorf("procri is draining for maintenance"))
+	}
+	for _, dir := range []string{rs.dataStore.BasePath, rs.podsDir} {
+		if err := checkWritable(dir); err != nil {
+			return notReady(cri.RuntimeReady, reasonDataStoreNotWritable, err)
+		}
+	}
+	if checker, ok := rs.streamingServer.(HealthChecker); ok {
+		if err := checker.Check(); err != nil {
+			return notReady(cri.RuntimeReady, reasonStreamingServerDown, err)
+		}
+	}
+	return &cri.RuntimeCondition{Type: cri.RuntimeReady, Status: true}
+}
+
+// networkCondition returns the NetworkReady condition: pods get the address
+// of the host, which has to be on one of its interfaces, and the DNS stub
+// resolver, if any, answers.
+func (rs *RuntimeService) networkCondition() *cri.RuntimeCondition {
+	if err := checkHostAddress(rs.ipAddress); err != nil {
+		return notReady(cri.NetworkReady, reasonHostAddressMissing, err)
+	}
+	if checker, ok := rs.dns.(HealthChecker); ok {
+		if err := checker.Check(); err != nil {
+			return notReady(cri.NetworkReady, reasonDNSNotServing, err)
+		}
+	}
+	return &cri.RuntimeCondition{Type: cri.NetworkReady, Status: true}
+}
+
+func notReady(condition, reason string, err error) *cri.RuntimeCondition {
+	return &cri.RuntimeCondition{
+		Type:    condition,
+		Status:  false,
+		Reason:  reason,
+		Message: err.Error(),
+	}
+}
+
+// logCondition logs when a condition changes, not on every Status poll of
+// kubelet. Conditions are assumed to start out true.
+func (rs *RuntimeService) logCondition(c *cri.RuntimeCondition) {
+	rs.conditionsMu.Lock()
+	defer rs.conditionsMu.Unlock()
+	if rs.conditionReasons == nil {
+		rs.conditionReasons = make(map[string]string)
+	}
+	if rs.conditionReasons[c.Type] == c.Reason {
+		return
+	}
+	rs.conditionReasons[c.Type] = c.Reason
+	if c.Status {
+		klog.Infof("%s is true", c.Type)
+	} else {
+		klog.Warningf("%s is false: %s: %s", c.Type, c.Reason, c.Message)
+	}
+}
+
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".procri-status-")
+	if err != nil {
+		return fmt.Errorf("data store is not writable: %v", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkHostAddress(ipAddress string) error {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return fmt.Errorf("invalid host address %q", ipAddress)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("listing host addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no host interface has address %s", ipAddress)
+}
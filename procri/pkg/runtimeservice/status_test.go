@@ -0,0 +1,76 @@
+package runtimeservice
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/elotl/procri/pkg/klogtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+type fakeChecker struct {
+	fakeDNSForwarder
+	err error
+}
+
+func (f *fakeChecker) Check() error {
+	return f.err
+}
+
+func conditions(t *testing.T, rs *RuntimeService) map[string]*cri.RuntimeCondition {
+	resp, err := rs.Status(context.Background(), &cri.StatusRequest{})
+	require.NoError(t, err)
+	result := make(map[string]*cri.RuntimeCondition)
+	for _, c := range resp.Status.Conditions {
+		result[c.Type] = c
+	}
+	return result
+}
+
+func TestStatus(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	c := conditions(t, rs)
+	assert.True(t, c[cri.RuntimeReady].Status)
+	assert.True(t, c[cri.NetworkReady].Status)
+
+	dns := &fakeChecker{err: fmt.Errorf("DNS stub resolver is not serving")}
+	rs.SetDNSForwarder(dns)
+	c = conditions(t, rs)
+	assert.False(t, c[cri.NetworkReady].Status)
+	assert.Equal(t, reasonDNSNotServing, c[cri.NetworkReady].Reason)
+	assert.Equal(t, "DNS stub resolver is not serving", c[cri.NetworkReady].Message)
+	dns.err = nil
+
+	rs.ipAddress = "192.0.2.1"
+	c = conditions(t, rs)
+	assert.False(t, c[cri.NetworkReady].Status)
+	assert.Equal(t, reasonHostAddressMissing, c[cri.NetworkReady].Reason)
+	assert.True(t, c[cri.RuntimeReady].Status)
+
+	// Root can write anywhere, so the data store is made a file.
+	require.NoError(t, os.RemoveAll(rs.podsDir))
+	require.NoError(t, ioutil.WriteFile(rs.podsDir, nil, 0644))
+	c = conditions(t, rs)
+	assert.False(t, c[cri.RuntimeReady].Status)
+	assert.Equal(t, reasonDataStoreNotWritable, c[cri.RuntimeReady].Reason)
+}
+
+func TestStatusLogsConditionChanges(t *testing.T) {
+	rs := newTestRuntimeService(t)
+	dns := &fakeChecker{err: fmt.Errorf("DNS stub resolver is not answering")}
+	rs.SetDNSForwarder(dns)
+	poll := func() string {
+		return klogtest.Capture(t, func() { conditions(t, rs) })
+	}
+
+	assert.Contains(t, poll(), "NetworkReady is false: DNSNotServing")
+	assert.Empty(t, poll())
+	dns.err = nil
+	assert.Contains(t, poll(), "NetworkReady is true")
+	assert.Empty(t, poll())
+}
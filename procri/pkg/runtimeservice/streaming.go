@@ -6,6 +6,8 @@ import (
 	"os/exec"
 	"time"
 
+	"github.com/elotl/procri/pkg/metrics"
+	"github.com/elotl/procri/pkg/redact"
 	"golang.org/x/net/context"
 
 	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
@@ -23,10 +25,13 @@ const (
 // ExecSync runs a command in a container synchronously.
 func (rs *RuntimeService) ExecSync(ctx context.Context, req *cri.ExecSyncRequest) (*cri.ExecSyncResponse, error) {
 	// based on https://medium.com/@vCabbage/go-timeout-commands-with-os-exec-commandcontext-ba0c861ed738
-	klog.V(4).Infof("ExecSync %v", req)
 	if len(req.Cmd) < 1 {
 		return nil, fmt.Errorf("exec command empty: %s", req.Cmd)
 	}
+	klog.V(4).Infof("ExecSync in %s: %v", req.ContainerId, redact.Command(req.Cmd))
+	metrics.ExecSessions.WithLabelValues("exec_sync").Inc()
+	metrics.ActiveExecSessions.WithLabelValues("exec_sync").Inc()
+	defer metrics.ActiveExecSessions.WithLabelValues("exec_sync").Dec()
 	timeout := time.Duration(defaultExecSyncTimeout)
 	if req.Timeout != 0 {
 		timeout = time.Duration(req.Timeout)
@@ -48,7 +53,7 @@ func (rs *RuntimeService) ExecSync(ctx context.Context, req *cri.ExecSyncRequest
 	// The error returned by cmd.Output() will be OS specific based on what
 	// happens when a process is killed.
 	if childCtx.Err() == context.DeadlineExceeded {
-		klog.Errorf("ExecSync %v timeout error: %v", req, childCtx.Err())
+		klog.Errorf("ExecSync in %s timed out: %v", req.ContainerId, childCtx.Err())
 		return &cri.ExecSyncResponse{
 			Stdout:   out,
 			Stderr:   stdErr.Bytes(),
@@ -62,7 +67,7 @@ func (rs *RuntimeService) ExecSync(ctx context.Context, req *cri.ExecSyncRequest
 		if exitCodeErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitCodeErr.ExitCode()
 		}
-		klog.Errorf("ExecSync %v error: %v", req, err)
+		klog.V(2).Infof("ExecSync in %s failed with exit code %d: %v", req.ContainerId, exitCode, err)
 		return &cri.ExecSyncResponse{
 			Stdout:   out,
 			Stderr:   stdErr.Bytes(),
@@ -74,51 +79,23 @@ func (rs *RuntimeService) ExecSync(ctx context.Context, req *cri.ExecSyncRequest
 		Stderr:   stdErr.Bytes(),
 		ExitCode: 0,
 	}
-	klog.V(4).Infof("ExecSync %v: %v", req, resp)
 	return resp, nil
 }
 
 // Exec prepares a streaming endpoint to execute a command in the container.
 // The actual logic is implemented in pkg/streaming/streaming.go.
 func (rs *RuntimeService) Exec(ctx context.Context, req *cri.ExecRequest) (*cri.ExecResponse, error) {
-	klog.V(4).Infof("Exec %v", req)
-
-	resp, err := rs.streamingServer.GetExec(req)
-	if err != nil {
-		klog.Errorf("Exec %v error: %v", req, err)
-	} else {
-		klog.V(4).Infof("Exec %v: %v", req, resp)
-	}
-
-	return resp, err
+	return rs.streamingServer.GetExec(req)
 }
 
 // Attach prepares a streaming endpoint to attach to a running container.
 // The actual logic is implemented in pkg/streaming/streaming.go.
 func (rs *RuntimeService) Attach(ctx context.Context, req *cri.AttachRequest) (*cri.AttachResponse, error) {
-	klog.V(4).Infof("Attach %v", req)
-
-	resp, err := rs.streamingServer.GetAttach(req)
-	if err != nil {
-		klog.Errorf("Attach %v error: %v", req, err)
-	} else {
-		klog.V(4).Infof("Attach %v: %v", req, resp)
-	}
-
-	return resp, err
+	return rs.streamingServer.GetAttach(req)
 }
 
 // PortForward prepares a streaming endpoint to forward ports from a PodSandbox.
 // The actual logic is implemented in pkg/streaming/streaming.go.
 func (rs *RuntimeService) PortForward(ctx context.Context, req *cri.PortForwardRequest) (*cri.PortForwardResponse, error) {
-	klog.V(4).Infof("PortForward %v", req)
-
-	resp, err := rs.streamingServer.GetPortForward(req)
-	if err != nil {
-		klog.Errorf("PortForward %v error: %v", req, err)
-	} else {
-		klog.V(4).Infof("PortForward %v: %v", req, resp)
-	}
-
-	return resp, err
+	return rs.streamingServer.GetPortForward(req)
 }
@@ -0,0 +1,249 @@
+package runtimeservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/elotl/procri/pkg/imagestore"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+const (
+	// Where kubelet mounts the service account token, CA and namespace.
+	serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// Symlink kubelet swaps to update secret, configmap and projected
+	// volumes atomically, pointing to a directory with the current files.
+	atomicDataLink = "..data"
+
+	volumeRefreshInterval = 10 * time.Second
+)
+
+// RefreshVolumes keeps the copies of read-only volumes up to date with the
+// volumes kubelet updates, e.g. rotated service account tokens, and links
+// volumes on the host once their paths are free, until stop is closed.
+func (rs *RuntimeService) RefreshVolumes(stop <-chan struct{}) {
+	ticker := time.NewTicker(volumeRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rs.refreshVolumes()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (rs *RuntimeService) refreshVolumes() {
+	for _, cnt := range rs.listContainers() {
+		if cnt.State != cri.ContainerState_CONTAINER_EXITED {
+			linkHostPaths(cnt, rs.hostRoot)
+		}
+		for _, m := range cnt.Mounts {
+			if m.Copy == "" {
+				continue
+			}
+			if err := refreshVolume(m.HostPath, m.Copy); err != nil {
+				klog.Warningf("refreshing volume %s of container %s: %v", m.ContainerPath, cnt.ID, err)
+			}
+		}
+	}
+}
+
+// refreshVolume updates the read-only copy of an atomically updated volume
+// the way kubelet updates the volume: the new data directory is copied next
+// to the old one, then the data link is swapped. Other volumes are not
+// refreshed.
+func refreshVolume(hostPath, copy string) error {
+	target, err := os.Readlink(filepath.Join(hostPath, atomicDataLink))
+	if err != nil {
+		return nil
+	}
+	current, err := os.Readlink(filepath.Join(copy, atomicDataLink))
+	if err != nil || current == target {
+		return nil
+	}
+	if strings.Contains(target, "/") {
+		return fmt.Errorf("unexpected data link target %s", target)
+	}
+
+	// The top directory of the copy is only writable during the update.
+	info, err := os.Stat(copy)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(copy, info.Mode().Perm()|0200); err != nil {
+		return err
+	}
+	defer os.Chmod(copy, info.Mode().Perm())
+
+	data := filepath.Join(copy, target)
+	if _, err := os.Lstat(data); os.IsNotExist(err) {
+		if err := imagestore.CloneTree(filepath.Join(hostPath, target), data); err != nil {
+			return err
+		}
+		if err := makeReadOnly(data); err != nil {
+			return err
+		}
+	}
+	tmp := filepath.Join(copy, atomicDataLink+"_tmp")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(copy, atomicDataLink)); err != nil {
+		return err
+	}
+	if err := syncVolumeLinks(hostPath, copy); err != nil {
+		return err
+	}
+	old := filepath.Join(copy, current)
+	makeRemovable(old)
+	return os.RemoveAll(old)
+}
+
+// syncVolumeLinks makes the user visible files of the copy, symlinks into the
+// data directory, match those of the volume, for keys added or removed.
+func syncVolumeLinks(hostPath, copy string) error {
+	names := make(map[string]bool)
+	entries, err := ioutil.ReadDir(hostPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "..") || e.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		names[e.Name()] = true
+		link, err := os.Readlink(filepath.Join(hostPath, e.Name()))
+		if err != nil {
+			return err
+		}
+		existing, err := os.Readlink(filepath.Join(copy, e.Name()))
+		if err == nil && existing == link {
+			continue
+		}
+		_ = os.Remove(filepath.Join(copy, e.Name()))
+		if err := os.Symlink(link, filepath.Join(copy, e.Name())); err != nil {
+			return err
+		}
+	}
+	entries, err = ioutil.ReadDir(copy)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "..") || e.Mode()&os.ModeSymlink == 0 || names[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(copy, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kubeconfig is the subset of the kubeconfig format procri writes, as JSON.
+type kubeconfig struct {
+	APIVersion     string            `json:"apiVersion"`
+	Kind           string            `json:"kind"`
+	Clusters       []kubeconfigEntry `json:"clusters"`
+	Users          []kubeconfigEntry `json:"users"`
+	Contexts       []kubeconfigEntry `json:"contexts"`
+	CurrentContext string            `json:"current-context"`
+}
+
+type kubeconfigEntry struct {
+	Name    string            `json:"name"`
+	Cluster map[string]string `json:"cluster,omitempty"`
+	User    map[string]string `json:"user,omitempty"`
+	Context map[string]string `json:"context,omitempty"`
+}
+
+// setUpKubeconfig writes a kubeconfig into dir, the directory of the
+// container, for its service account, and points KUBECONFIG to it unless the
+// container sets it. In-cluster clients, e.g. rest.InClusterConfig, read the
+// token at its absolute path on the host instead, see linkHostPaths, which one
+// pod holds at a time. Nothing is written if the container has no service
+// account or API server.
+func setUpKubeconfig(dir, namespace string, cnt *Container) error {
+	if envValue(cnt.Env, "KUBECONFIG") != "" {
+		return nil
+	}
+	for _, m := range cnt.Mounts {
+		if filepath.Clean(m.ContainerPath) != serviceAccountPath {
+			continue
+		}
+		path := filepath.Join(dir, "kubeconfig")
+		written, err := writeKubeconfig(path, m.Link, namespace, cnt.Env)
+		if err != nil || !written {
+			return err
+		}
+		cnt.Env = append(cnt.Env, "KUBECONFIG="+path)
+		return nil
+	}
+	return nil
+}
+
+// writeKubeconfig writes a kubeconfig to path for the service account in
+// serviceAccount, the directory with its token, CA and namespace. It returns
+// false if the container has no API server.
+func writeKubeconfig(path, serviceAccount, namespace string, env []string) (bool, error) {
+	host, port := envValue(env, "KUBERNETES_SERVICE_HOST"), envValue(env, "KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return false, nil
+	}
+	config := kubeconfig{
+		APIVersion: "v1",
+		Kind:       "Config",
+		Clusters: []kubeconfigEntry{{
+			Name: "default",
+			Cluster: map[string]string{
+				"server":                "https://" + net.JoinHostPort(host, port),
+				"certificate-authority": filepath.Join(serviceAccount, "ca.crt"),
+			},
+		}},
+		Users: []kubeconfigEntry{{
+			Name: "default",
+			// Clients reread the token file, so rotated tokens are used.
+			User: map[string]string{"tokenFile": filepath.Join(serviceAccount, "token")},
+		}},
+		Contexts: []kubeconfigEntry{{
+			Name: "default",
+			Context: map[string]string{
+				"cluster":   "default",
+				"user":      "default",
+				"namespace": namespace,
+			},
+		}},
+		CurrentContext: "default",
+	}
+	buf, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func envValue(env []string, name string) string {
+	value := ""
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			value = strings.TrimPrefix(kv, name+"=")
+		}
+	}
+	return value
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog"
+)
+
+const (
+	// AdminDrainPath is the path of the drain mode resource of the admin API:
+	// GET returns the drain status, POST drains, with an optional timeout
+	// parameter, e.g. "?timeout=2m", and DELETE leaves drain mode.
+	AdminDrainPath = "/drain"
+
+	defaultDrainTimeout = 2 * time.Minute
+	// How long draining waits for killed processes to exit.
+	drainExitTimeout = 30 * time.Second
+)
+
+// ServeAdmin serves the admin API on the unix socket addr, accessible only by
+// its owner.
+func (s *ProcriServer) ServeAdmin(addr string) error {
+	klog.Infof("starting admin listener at %s", addr)
+	if err := syscall.Unlink(addr); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	err = s.adminServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *ProcriServer) newAdminServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminDrainPath, s.handleDrain)
+	return &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
+
+func (s *ProcriServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		timeout := defaultDrainTimeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			var err error
+			timeout, err = time.ParseDuration(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid timeout: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		// Draining goes on if the client goes away.
+		ctx, cancel := context.WithTimeout(context.Background(), timeout+drainExitTimeout)
+		defer cancel()
+		if err := s.runtimeService.Drain(ctx, timeout); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if err := s.runtimeService.Undrain(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.runtimeService.DrainStatus())
+}
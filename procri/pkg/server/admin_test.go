@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/peterbourgon/diskv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elotl/procri/pkg/runtimeservice"
+)
+
+func TestAdminDrain(t *testing.T) {
+	dataStore := diskv.New(diskv.Options{BasePath: t.TempDir()})
+	rs, err := runtimeservice.NewRuntimeService(nil, "127.0.0.1", dataStore, t.TempDir(), "v0.0.1", nil)
+	require.NoError(t, err)
+	s := &ProcriServer{runtimeService: rs}
+	server := httptest.NewServer(s.newAdminServer().Handler)
+	defer server.Close()
+
+	drain := func(method, query string) (int, runtimeservice.DrainStatus) {
+		req, err := http.NewRequest(method, server.URL+AdminDrainPath+query, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var status runtimeservice.DrainStatus
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		}
+		return resp.StatusCode, status
+	}
+
+	code, status := drain(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Draining)
+	code, _ = drain(http.MethodPost, "?timeout=soon")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, status = drain(http.MethodPost, "?timeout=1s")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Draining)
+	code, status = drain(http.MethodDelete, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Draining)
+	code, _ = drain(http.MethodPut, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/elotl/procri/pkg/redact"
+	"github.com/elotl/procri/pkg/tracing"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/klog"
+)
+
+// Methods kubelet calls periodically. They are logged at a higher verbosity
+// to keep the default log readable.
+var pollingMethods = map[string]bool{
+	"Status":             true,
+	"Version":            true,
+	"ListPodSandbox":     true,
+	"PodSandboxStatus":   true,
+	"ListContainers":     true,
+	"ContainerStatus":    true,
+	"ContainerStats":     true,
+	"ListContainerStats": true,
+	"ListImages":         true,
+	"ImageStatus":        true,
+	"ImageFsInfo":        true,
+}
+
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+func chainStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, next)
+			}
+		}
+		return chained(srv, ss)
+	}
+}
+
+// tracedStream overrides the context of a server stream, so handlers see the
+// request span.
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// requestTracer starts a span for every request, continuing the trace from
+// the W3C traceparent, tracestate and baggage in the request metadata if
+// there are any.
+type requestTracer struct {
+	exporter *tracing.Exporter
+}
+
+func (t *requestTracer) startSpan(ctx context.Context, fullMethod string) (context.Context, *tracing.Span) {
+	parent := tracing.SpanContext{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(tracing.TraceparentHeader); len(values) > 0 {
+			sc, err := tracing.ParseTraceparent(values[0])
+			if err != nil {
+				klog.V(4).Infof("%s: %v", fullMethod, err)
+			} else {
+				parent = sc
+			}
+		}
+		// Trace state belongs to the parent, it is dropped with it.
+		if values := md.Get(tracing.TracestateHeader); len(values) > 0 && parent.TraceID.IsValid() {
+			state, err := tracing.ParseTracestate(strings.Join(values, ","))
+			if err != nil {
+				klog.V(4).Infof("%s: %v", fullMethod, err)
+			} else {
+				parent.TraceState = state
+			}
+		}
+		if values := md.Get(tracing.BaggageHeader); len(values) > 0 {
+			baggage, err := tracing.ParseBaggage(strings.Join(values, ","))
+			if err != nil {
+				klog.V(4).Infof("%s: %v", fullMethod, err)
+			} else {
+				parent.Baggage = baggage
+			}
+		}
+	}
+	span := tracing.StartSpan(strings.TrimPrefix(fullMethod, "/"), parent)
+	span.SetAttribute("rpc.system", "grpc")
+	return tracing.ContextWithSpan(ctx, span), span
+}
+
+func (t *requestTracer) finishSpan(span *tracing.Span, err error) {
+	span.End = time.Now()
+	span.SetAttribute("rpc.grpc.status_code", status.Code(err).String())
+	if err != nil {
+		span.Error = err.Error()
+	}
+	if span.Context.Sampled {
+		t.exporter.Export(span)
+	}
+}
+
+func (t *requestTracer) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := t.startSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	t.finishSpan(span, err)
+	return resp, err
+}
+
+func (t *requestTracer) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := t.startSpan(ss.Context(), info.FullMethod)
+	err := handler(srv, &tracedStream{ServerStream: ss, ctx: ctx})
+	t.finishSpan(span, err)
+	return err
+}
+
+// recoverPanic turns a panic of a handler into an Internal error, so one bad
+// request doesn't take down procri and all its containers.
+func recoverPanic(fullMethod string, err *error) {
+	if r := recover(); r != nil {
+		klog.Errorf("%s panicked: %v\n%s", fullMethod, r, debug.Stack())
+		*err = status.Errorf(codes.Internal, "%s panicked: %v", fullMethod, r)
+	}
+}
+
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer recoverPanic(info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+func recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverPanic(info.FullMethod, &err)
+	return handler(srv, ss)
+}
+
+func logUnaryRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	summary := summarizeRequest(req)
+	if klog.V(6) {
+		summary += fmt.Sprintf(" request=%+v", redact.Request(req))
+	}
+	logRequest(ctx, info.FullMethod, time.Since(start), summary, err)
+	return resp, err
+}
+
+func logStreamRequest(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logRequest(ss.Context(), info.FullMethod, time.Since(start), "", err)
+	return err
+}
+
+// logRequest writes one key=value line per request.
+func logRequest(ctx context.Context, fullMethod string, duration time.Duration, summary string, err error) {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	line := fmt.Sprintf("method=%s duration=%s code=%s", method, duration, status.Code(err))
+	if span := tracing.SpanFromContext(ctx); span != nil {
+		line += " trace_id=" + span.Context.TraceID.String()
+	}
+	if summary = strings.TrimSpace(summary); summary != "" {
+		line += " " + summary
+	}
+	switch {
+	case err != nil:
+		klog.Errorf("%s error=%q", line, err.Error())
+	case pollingMethods[method]:
+		klog.V(5).Info(line)
+	default:
+		klog.V(2).Info(line)
+	}
+}
+
+// summarizeRequest picks the identifying fields of a CRI request. Only IDs
+// and names are included, never configuration, credentials or commands.
+func summarizeRequest(req interface{}) string {
+	fields := make([]string, 0)
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, fmt.Sprintf("%s=%q", key, value))
+		}
+	}
+
+	switch r := req.(type) {
+	case *cri.RunPodSandboxRequest:
+		if md := r.GetConfig().GetMetadata(); md != nil {
+			add("namespace", md.Namespace)
+			add("name", md.Name)
+		}
+	case *cri.CreateContainerRequest:
+		add("name", r.GetConfig().GetMetadata().GetName())
+		add("image", r.GetConfig().GetImage().GetImage())
+	}
+	if r, ok := req.(interface{ GetPodSandboxId() string }); ok {
+		add("pod_sandbox_id", r.GetPodSandboxId())
+	}
+	if r, ok := req.(interface{ GetContainerId() string }); ok {
+		add("container_id", r.GetContainerId())
+	}
+	if r, ok := req.(interface{ GetImage() *cri.ImageSpec }); ok {
+		add("image", r.GetImage().GetImage())
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+
+	"github.com/elotl/procri/pkg/klogtest"
+)
+
+func TestChainUnaryInterceptorsOrder(t *testing.T) {
+	calls := make([]string, 0)
+	record := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+	chained := chainUnaryInterceptors(record("first"), record("second"))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return "ok", nil
+	}
+
+	resp, err := chained(context.Background(), nil, &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func TestSummarizeRequest(t *testing.T) {
+	testCases := []struct {
+		name    string
+		req     interface{}
+		summary string
+	}{
+		{
+			name: "create container",
+			req: &cri.CreateContainerRequest{
+				PodSandboxId: "default_nginx",
+				Config: &cri.ContainerConfig{
+					Metadata: &cri.ContainerMetadata{Name: "nginx"},
+					Image:    &cri.ImageSpec{Image: "nginx:latest"},
+					Envs:     []*cri.KeyValue{{Key: "PASSWORD", Value: "hunter2"}},
+				},
+			},
+			summary: `name="nginx" image="nginx:latest" pod_sandbox_id="default_nginx"`,
+		},
+		{
+			name: "pull image",
+			req: &cri.PullImageRequest{
+				Image: &cri.ImageSpec{Image: "registry.example.com/app:v1"},
+				Auth:  &cri.AuthConfig{Username: "user", Password: "hunter2"},
+			},
+			summary: `image="registry.example.com/app:v1"`,
+		},
+		{
+			name: "exec sync",
+			req: &cri.ExecSyncRequest{
+				ContainerId: "c1",
+				Cmd:         []string{"sh", "-c", "echo hunter2"},
+			},
+			summary: `container_id="c1"`,
+		},
+		{
+			name:    "version",
+			req:     &cri.VersionRequest{},
+			summary: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.summary, summarizeRequest(tc.req))
+		})
+	}
+}
+
+func TestLogUnaryRequestDoesNotLogSecrets(t *testing.T) {
+	secret := "hunter2"
+	requests := []interface{}{
+		&cri.CreateContainerRequest{
+			Config: &cri.ContainerConfig{
+				Metadata: &cri.ContainerMetadata{Name: "app"},
+				Args:     []string{"--password", secret},
+				Envs:     []*cri.KeyValue{{Key: "X", Value: secret}},
+			},
+		},
+		&cri.PullImageRequest{Auth: &cri.AuthConfig{Password: secret}},
+		&cri.ExecSyncRequest{Cmd: []string{"sh", "-c", secret}},
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	logs := klogtest.Capture(t, func() {
+		for _, req := range requests {
+			_, err := logUnaryRequest(context.Background(), req, &grpc.UnaryServerInfo{FullMethod: "/runtime.v1alpha2.RuntimeService/Test"}, handler)
+			assert.NoError(t, err)
+		}
+	})
+
+	assert.Contains(t, logs, "request=")
+	assert.NotContains(t, logs, secret)
+}
+
+func TestRecoverUnary(t *testing.T) {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		var tagged interface{} = "app@sha256:abc"
+		return tagged.(fmt.Stringer).String(), nil
+	}
+	var err error
+	klogtest.Capture(t, func() {
+		_, err = recoverUnary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/runtime.v1alpha2.ImageService/PullImage"}, handler)
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -1,13 +1,23 @@
 package server
 
 import (
+	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"syscall"
 
+	"github.com/elotl/procri/pkg/dns"
+	"github.com/elotl/procri/pkg/imagepolicy"
 	"github.com/elotl/procri/pkg/imageservice"
+	"github.com/elotl/procri/pkg/imagestore"
+	"github.com/elotl/procri/pkg/metrics"
+	"github.com/elotl/procri/pkg/mountpolicy"
+	"github.com/elotl/procri/pkg/registry"
 	"github.com/elotl/procri/pkg/runtimeservice"
+	"github.com/elotl/procri/pkg/streaming"
+	"github.com/elotl/procri/pkg/tracing"
 	"github.com/peterbourgon/diskv"
 
 	"google.golang.org/grpc"
@@ -16,45 +26,227 @@ import (
 	k8sstreaming "k8s.io/kubernetes/pkg/kubelet/server/streaming"
 )
 
+// Directories of the data store.
+const (
+	imageStoreDir       = "images"
+	imageDataStoreDir   = "imageservice"
+	runtimeDataStoreDir = "runtimeService"
+	podsDir             = "pods"
+)
+
 type ProcriServer struct {
 	listener       net.Listener
 	server         *grpc.Server
 	runtimeService *runtimeservice.RuntimeService
 	imageService   *imageservice.ImageService
+	dnsStub        *dns.Stub
+	adminServer    *http.Server
+	stop           chan struct{}
+}
+
+// Options configures the CRI services.
+type Options struct {
+	// IP address of the host, reported for pod sandboxes.
+	IPAddress string
+	// Directory for persisting data.
+	DataStoreBasePath string
+	RuntimeVersion    string
+	// Exports request traces if not nil.
+	Exporter *tracing.Exporter
+	// File with the keys to encrypt stored registry credentials. If empty,
+	// credentials are not stored.
+	CredentialKeyFile string
+	// Pull images from registries. If false, pulls only record the image.
+	PullImages bool
+	// Registries accessed via plain HTTP, e.g. "localhost:5000".
+	InsecureRegistries []string
+	// Maximum number of images pulled at a time. Unlimited if not positive.
+	MaxConcurrentPulls int
+	// JSON file with the image verification policy. If empty, all images
+	// are accepted.
+	ImagePolicyFile string
+	// JSON file with the policy for the paths containers mount volumes at.
+	// If empty, mounts over system directories are denied.
+	MountPolicyFile string
+	// Address to serve the DNS stub resolver for the cluster domain on, over
+	// UDP and TCP, e.g. "127.0.0.1:53". If empty, there is no stub resolver.
+	DNSListen string
+	// Directory of the resolver configuration of the host, e.g.
+	// "/etc/resolver", to point to the stub resolver for the cluster domain.
+	// If empty, the resolver of the host is left alone.
+	DNSResolverDir string
+	// Domain of the cluster, e.g. "cluster.local".
+	ClusterDomain string
+	// Forward host ports of pods to their container ports in userspace.
+	HostPortProxy bool
 }
 
-func NewServer(
-	streamingServer k8sstreaming.Server,
-	ipAddress string,
-	dataStoreBasePath string,
-	runtimeVersion string,
-) (*ProcriServer, error) {
-	imageDataStorePath := filepath.Join(dataStoreBasePath, "imageservice")
+func NewServer(streamingServer k8sstreaming.Server, opts Options) (*ProcriServer, error) {
+	var credentialStore *imageservice.CredentialStore
+	if opts.CredentialKeyFile != "" {
+		credentialDataStorePath := filepath.Join(opts.DataStoreBasePath, "imagecredentials")
+		credentialDataStore := diskv.New(diskv.Options{BasePath: credentialDataStorePath, FilePerm: 0600, PathPerm: 0700})
+		var err error
+		credentialStore, err = imageservice.NewCredentialStore(credentialDataStore, opts.CredentialKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var policy *imagepolicy.Policy
+	if opts.ImagePolicyFile != "" {
+		if !opts.PullImages {
+			return nil, fmt.Errorf("an image policy requires pulling images")
+		}
+		var err error
+		policy, err = imagepolicy.Load(opts.ImagePolicyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mountPolicy := mountpolicy.Default()
+	if opts.MountPolicyFile != "" {
+		var err error
+		mountPolicy, err = mountpolicy.Load(opts.MountPolicyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var puller *imageservice.Puller
+	if opts.PullImages {
+		store, err := imagestore.New(filepath.Join(opts.DataStoreBasePath, imageStoreDir))
+		if err != nil {
+			return nil, err
+		}
+		puller = imageservice.NewPuller(registry.NewClient(opts.InsecureRegistries), store, policy, opts.MaxConcurrentPulls)
+	}
+
+	imageDataStorePath := filepath.Join(opts.DataStoreBasePath, imageDataStoreDir)
 	imageDataStore := diskv.New(diskv.Options{BasePath: imageDataStorePath})
-	imageService := imageservice.NewImageService(imageDataStore)
+	imageService, err := imageservice.NewImageService(imageDataStore, credentialStore, puller)
+	if err != nil {
+		return nil, err
+	}
 
-	runtimeDataStorePath := filepath.Join(dataStoreBasePath, "runtimeService")
+	runtimeDataStorePath := filepath.Join(opts.DataStoreBasePath, runtimeDataStoreDir)
 	runtimeDataStore := diskv.New(diskv.Options{BasePath: runtimeDataStorePath})
 	runtimeService, err := runtimeservice.NewRuntimeService(
 		streamingServer,
-		ipAddress,
+		opts.IPAddress,
 		runtimeDataStore,
-		runtimeVersion,
+		filepath.Join(opts.DataStoreBasePath, podsDir),
+		opts.RuntimeVersion,
+		imageService,
 	)
 	if err != nil {
 		return nil, err
 	}
+	imageService.SetImageUsers(runtimeService)
+	runtimeService.SetMountPolicy(mountPolicy)
+	// Port-forward forwards datagrams to the UDP ports of pods.
+	if s, ok := streamingServer.(*streaming.Server); ok {
+		s.SetPortProtocols(runtimeService)
+	}
+	if opts.HostPortProxy {
+		runtimeService.EnableHostPortProxy()
+	}
+
+	var dnsStub *dns.Stub
+	if opts.DNSListen != "" {
+		conn, err := net.ListenPacket("udp", opts.DNSListen)
+		if err != nil {
+			return nil, fmt.Errorf("starting DNS stub resolver: %v", err)
+		}
+		listener, err := net.Listen("tcp", conn.LocalAddr().String())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starting DNS stub resolver: %v", err)
+		}
+		dnsStub = dns.NewStub(opts.ClusterDomain, conn, listener)
+		if opts.DNSResolverDir != "" {
+			if err := dnsStub.InstallResolver(opts.DNSResolverDir); err != nil {
+				dnsStub.Close()
+				return nil, fmt.Errorf("configuring the resolver for %s: %v", dnsStub.Domain(), err)
+			}
+		}
+		runtimeService.SetDNSForwarder(dnsStub)
+		klog.Infof("serving DNS for %s on %s", dnsStub.Domain(), opts.DNSListen)
+		go func() {
+			if err := dnsStub.Serve(); err != nil {
+				klog.V(2).Infof("DNS stub resolver stopped: %v", err)
+			}
+		}()
+	}
+
+	// Panics are recovered innermost, so they are logged and counted as
+	// errors.
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		metrics.UnaryServerInterceptor,
+		logUnaryRequest,
+		recoverUnary,
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		metrics.StreamServerInterceptor,
+		logStreamRequest,
+		recoverStream,
+	}
+	if opts.Exporter != nil {
+		// The tracer goes first, so the request log line has the trace ID.
+		tracer := &requestTracer{exporter: opts.Exporter}
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{tracer.unary}, unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{tracer.stream}, streamInterceptors...)
+	}
 
 	s := &ProcriServer{
-		server:         grpc.NewServer(),
+		server: grpc.NewServer(
+			grpc.UnaryInterceptor(chainUnaryInterceptors(unaryInterceptors...)),
+			grpc.StreamInterceptor(chainStreamInterceptors(streamInterceptors...)),
+		),
 		imageService:   imageService,
 		runtimeService: runtimeService,
+		dnsStub:        dnsStub,
+		stop:           make(chan struct{}),
 	}
+	s.adminServer = s.newAdminServer()
 	cri.RegisterRuntimeServiceServer(s.server, s.runtimeService)
 	cri.RegisterImageServiceServer(s.server, s.imageService)
+	metrics.MustRegister(runtimeservice.NewStateCollector(s.runtimeService))
+	go s.runtimeService.RefreshVolumes(s.stop)
 	return s, nil
 }
 
+// OpenImageService opens the image store of the server with data store
+// dataStoreBasePath, for offline tools. It can be used while the server runs,
+// but does not pull images or access stored registry credentials. If
+// imagePolicyFile is set, imported images have to pass that policy.
+func OpenImageService(dataStoreBasePath, imagePolicyFile string) (*imageservice.ImageService, error) {
+	var policy *imagepolicy.Policy
+	if imagePolicyFile != "" {
+		var err error
+		policy, err = imagepolicy.Load(imagePolicyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	store, err := imagestore.Open(filepath.Join(dataStoreBasePath, imageStoreDir))
+	if err != nil {
+		return nil, err
+	}
+	puller := imageservice.NewPuller(registry.NewClient(nil), store, policy, 0)
+	imageDataStore := diskv.New(diskv.Options{BasePath: filepath.Join(dataStoreBasePath, imageDataStoreDir)})
+	return imageservice.NewImageService(imageDataStore, nil, puller)
+}
+
+// OpenRuntimeService opens the pods and containers of the server with data
+// store dataStoreBasePath, for offline tools. Their state is the one last
+// recorded by the server, and processes are not managed.
+func OpenRuntimeService(dataStoreBasePath string) (*runtimeservice.RuntimeService, error) {
+	dataStore := diskv.New(diskv.Options{BasePath: filepath.Join(dataStoreBasePath, runtimeDataStoreDir)})
+	return runtimeservice.NewRuntimeService(nil, "", dataStore, filepath.Join(dataStoreBasePath, podsDir), "", nil)
+}
+
 func (s *ProcriServer) Serve(addr string) error {
 	klog.Infof("starting listener at %s", addr)
 	if err := syscall.Unlink(addr); err != nil && !os.IsNotExist(err) {
@@ -69,6 +261,11 @@ func (s *ProcriServer) Serve(addr string) error {
 }
 
 func (s *ProcriServer) Close() error {
+	close(s.stop)
+	if s.dnsStub != nil {
+		_ = s.dnsStub.Close()
+	}
+	_ = s.adminServer.Close()
 	s.server.Stop()
 	return s.listener.Close()
 }
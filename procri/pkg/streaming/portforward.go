@@ -0,0 +1,217 @@
+package streaming
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/elotl/procri/pkg/metrics"
+	"k8s.io/klog"
+)
+
+const (
+	dialTimeout = 2 * time.Second
+	// MaxDatagramSize is the size of the largest datagram a frame carries.
+	MaxDatagramSize = 65535
+)
+
+// PortProtocols tells the protocol of a port of a pod.
+type PortProtocols interface {
+	// PortProtocol returns "udp" if port-forward to port of the sandbox
+	// forwards datagrams, and "tcp" otherwise.
+	PortProtocol(podSandboxID string, port int32) string
+}
+
+// portForwardAddrs returns the addresses processes of pods may listen on,
+// the loopback addresses of both families and the address of the host.
+func portForwardAddrs(hostIP string) []string {
+	addrs := []string{"127.0.0.1", "::1"}
+	if ip := net.ParseIP(hostIP); ip != nil && !ip.IsLoopback() && !ip.IsUnspecified() {
+		addrs = append(addrs, hostIP)
+	}
+	return addrs
+}
+
+// dialPort connects to the first address in addrs with a listener on port.
+func dialPort(addrs []string, port int32) (net.Conn, error) {
+	var errs []string
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, strconv.Itoa(int(port))), dialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("nothing is listening on port %d on %s: %s",
+		port, strings.Join(addrs, ", "), strings.Join(errs, "; "))
+}
+
+// WriteDatagram writes datagram to w as a frame: its length as a big endian
+// 16 bit integer, then its bytes. Port-forward of UDP ports carries frames.
+func WriteDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(datagram))
+	}
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a frame written by WriteDatagram from r, and returns
+// the datagram. It returns io.EOF if r ends between frames.
+func ReadDatagram(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	datagram := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, datagram); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return datagram, nil
+}
+
+// udpForwarder sends the datagrams framed on a port-forward stream to a UDP
+// port, and frames the replies. UDP has no connections, so it moves on to
+// the next address whenever the current one turns out to have no listener,
+// resending the datagram that was refused.
+type udpForwarder struct {
+	addrs  []string
+	port   int32
+	stream io.Writer
+	errCh  chan error
+
+	mu   sync.Mutex
+	next int
+	conn net.Conn
+	last []byte
+	errs []string
+}
+
+// dial connects to the next address. Must be called with mu held.
+func (f *udpForwarder) dial() error {
+	for f.next < len(f.addrs) {
+		addr := net.JoinHostPort(f.addrs[f.next], strconv.Itoa(int(f.port)))
+		f.next++
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			f.errs = append(f.errs, err.Error())
+			continue
+		}
+		f.conn = conn
+		go f.reply(conn)
+		return nil
+	}
+	return fmt.Errorf("nothing is listening on UDP port %d on %s: %s",
+		f.port, strings.Join(f.addrs, ", "), strings.Join(f.errs, "; "))
+}
+
+func (f *udpForwarder) send(datagram []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		if err := f.dial(); err != nil {
+			return err
+		}
+	}
+	f.last = datagram
+	n, err := f.conn.Write(datagram)
+	metrics.PortForwardBytes.WithLabelValues("in").Add(float64(n))
+	if err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	// A refused datagram is resent by reply.
+	return nil
+}
+
+// reply frames the datagrams received on conn until it fails.
+func (f *udpForwarder) reply(conn net.Conn) {
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err == nil {
+			metrics.PortForwardBytes.WithLabelValues("out").Add(float64(n))
+			if err := WriteDatagram(f.stream, buf[:n]); err != nil {
+				f.fail(err)
+				return
+			}
+			continue
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.conn != conn {
+			// Closed by close.
+			return
+		}
+		conn.Close()
+		f.conn = nil
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			f.fail(err)
+			return
+		}
+		f.errs = append(f.errs, err.Error())
+		if err := f.dial(); err != nil {
+			f.fail(err)
+			return
+		}
+		klog.V(5).Infof("forwarding UDP port %d to %s", f.port, f.conn.RemoteAddr())
+		if _, err := f.conn.Write(f.last); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			f.fail(err)
+		}
+		return
+	}
+}
+
+// fail ends forwarding with err, or successfully if err is nil. Only the
+// first call counts.
+func (f *udpForwarder) fail(err error) {
+	select {
+	case f.errCh <- err:
+	default:
+	}
+}
+
+func (f *udpForwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// forwardUDP forwards the datagrams framed on stream to port, until stream
+// ends or nothing listens on port.
+func forwardUDP(addrs []string, port int32, stream io.ReadWriter) error {
+	f := &udpForwarder{addrs: addrs, port: port, stream: stream, errCh: make(chan error, 1)}
+	defer f.close()
+	go func() {
+		for {
+			datagram, err := ReadDatagram(stream)
+			if err == io.EOF {
+				f.fail(nil)
+				return
+			}
+			if err == nil {
+				err = f.send(datagram)
+			}
+			if err != nil {
+				f.fail(err)
+				return
+			}
+		}
+	}()
+	return <-f.errCh
+}
@@ -0,0 +1,122 @@
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenIPv6(t *testing.T, network string) interface{} {
+	var l interface{}
+	var err error
+	if network == "tcp" {
+		l, err = net.Listen("tcp", "[::1]:0")
+	} else {
+		l, err = net.ListenPacket("udp", "[::1]:0")
+	}
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	return l
+}
+
+func TestPortForwardIPv6(t *testing.T) {
+	l := listenIPv6(t, "tcp").(net.Listener)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	port := int32(l.Addr().(*net.TCPAddr).Port)
+
+	client, stream := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- handlePortForward(context.Background(), portForwardAddrs(""), port, stream) }()
+	_, err := client.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	client.Close()
+	<-done
+}
+
+func TestPortForwardNothingListening(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := int32(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	_, stream := net.Pipe()
+	err = handlePortForward(context.Background(), []string{"127.0.0.1"}, port, stream)
+	assert.Contains(t, err.Error(), "nothing is listening on port")
+}
+
+func TestPortForwardUDP(t *testing.T) {
+	// The first address has no listener, so the datagram is resent to the
+	// second.
+	backend := listenIPv6(t, "udp").(net.PacketConn)
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = backend.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+	port := int32(backend.LocalAddr().(*net.UDPAddr).Port)
+
+	client, stream := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- forwardUDP([]string{"127.0.0.1", "::1"}, port, stream) }()
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	for _, msg := range []string{"one", "two"} {
+		require.NoError(t, WriteDatagram(client, []byte(msg)))
+		reply, err := ReadDatagram(client)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.ToUpper([]byte(msg)), reply)
+	}
+	client.Close()
+	assert.NoError(t, <-done)
+}
+
+func TestDatagramFraming(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteDatagram(&buf, []byte("hello")))
+	require.NoError(t, WriteDatagram(&buf, nil))
+	d, err := ReadDatagram(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(d))
+	d, err = ReadDatagram(&buf)
+	require.NoError(t, err)
+	assert.Empty(t, d)
+	_, err = ReadDatagram(&buf)
+	assert.Equal(t, io.EOF, err)
+
+	buf.Write([]byte{0, 5, 'a'})
+	_, err = ReadDatagram(&buf)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Error(t, WriteDatagram(&buf, make([]byte, MaxDatagramSize+1)))
+}
+
+func TestServerCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{addr: l.Addr().String()}
+	assert.NoError(t, s.Check())
+	l.Close()
+	assert.Error(t, s.Check())
+}
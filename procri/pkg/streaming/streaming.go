@@ -6,11 +6,12 @@ import (
 	"io"
 	"net"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/creack/pty"
 	"github.com/docker/docker/pkg/pools"
-	"github.com/pkg/errors"
+	"github.com/elotl/procri/pkg/metrics"
 	"golang.org/x/sys/unix"
 	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/klog"
@@ -18,18 +19,64 @@ import (
 	k8sstreaming "k8s.io/kubernetes/pkg/kubelet/server/streaming"
 )
 
-func NewStreamingServer(addr string) (k8sstreaming.Server, error) {
+// Server is the streaming server of procri.
+type Server struct {
+	k8sstreaming.Server
+	addr    string
+	runtime *streamingRuntime
+}
+
+// Check returns an error if the server doesn't accept connections.
+func (s *Server) Check() error {
+	conn, err := net.DialTimeout("tcp", s.addr, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("streaming server is down: %v", err)
+	}
+	return conn.Close()
+}
+
+// SetPortProtocols sets what decides whether port-forward forwards TCP or
+// UDP. Without it, all ports are TCP ports.
+func (s *Server) SetPortProtocols(protocols PortProtocols) {
+	s.runtime.mu.Lock()
+	defer s.runtime.mu.Unlock()
+	s.runtime.protocols = protocols
+}
+
+func NewStreamingServer(addr string) (*Server, error) {
 	config := k8sstreaming.DefaultConfig
 	config.Addr = addr
-	runtime := newStreamingRuntime()
-	return k8sstreaming.NewServer(config, runtime)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	runtime := newStreamingRuntime(host)
+	server, err := k8sstreaming.NewServer(config, runtime)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{Server: server, addr: addr, runtime: runtime}, nil
 }
 
 type streamingRuntime struct {
+	// Addresses port-forward connects to.
+	addrs []string
+
+	mu        sync.Mutex
+	protocols PortProtocols
 }
 
-func newStreamingRuntime() k8sstreaming.Runtime {
-	return &streamingRuntime{}
+func newStreamingRuntime(hostIP string) *streamingRuntime {
+	return &streamingRuntime{addrs: portForwardAddrs(hostIP)}
+}
+
+func (s *streamingRuntime) portProtocol(podSandboxID string, port int32) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.protocols == nil {
+		return "tcp"
+	}
+	return s.protocols.PortProtocol(podSandboxID, port)
 }
 
 type WinSize struct {
@@ -79,6 +126,9 @@ func (s *streamingRuntime) Exec(containerID string, cmd []string, stdin io.Reade
 	if len(cmd) < 1 {
 		return fmt.Errorf("empty command")
 	}
+	metrics.ExecSessions.WithLabelValues("exec").Inc()
+	metrics.ActiveExecSessions.WithLabelValues("exec").Inc()
+	defer metrics.ActiveExecSessions.WithLabelValues("exec").Dec()
 	var command *exec.Cmd
 	if len(cmd) == 1 {
 		command = exec.Command(cmd[0])
@@ -111,7 +161,12 @@ func (s *streamingRuntime) Attach(containerID string, stdin io.Reader, stdout, s
 func (s *streamingRuntime) PortForward(podSandboxID string, port int32, stream io.ReadWriteCloser) error {
 	defer stream.Close()
 	ctx := context.TODO()
-	err := handlePortForward(ctx, port, stream)
+	var err error
+	if s.portProtocol(podSandboxID, port) == "udp" {
+		err = forwardUDP(s.addrs, port, stream)
+	} else {
+		err = handlePortForward(ctx, s.addrs, port, stream)
+	}
 	if err != nil {
 		klog.Errorf("port forwarding error: %v", err)
 	}
@@ -120,12 +175,12 @@ func (s *streamingRuntime) PortForward(podSandboxID string, port int32, stream i
 	return err
 }
 
-func handlePortForward(ctx context.Context, port int32, stream io.ReadWriteCloser) error {
+func handlePortForward(ctx context.Context, addrs []string, port int32, stream io.ReadWriteCloser) error {
 	// shameless copy from
 	// https://github.com/cri-o/cri-o/blob/84464383a1c12a5cde27a4afc5a2b1f4eaa6b3ce/internal/oci/runtime_oci.go#L322
-	conn, err := net.Dial("tcp4", fmt.Sprintf("localhost:%d", port))
+	conn, err := dialPort(addrs, port)
 	if err != nil {
-		return errors.Wrapf(err, "dialing %d", port)
+		return err
 	}
 	defer conn.Close()
 
@@ -134,14 +189,16 @@ func handlePortForward(ctx context.Context, port int32, stream io.ReadWriteClose
 	// Copy from the the namespace port connection to the client stream
 	go func() {
 		klog.V(5).Infof("copy data from container port %d to client", port)
-		_, err := io.Copy(stream, conn)
+		n, err := io.Copy(stream, conn)
+		metrics.PortForwardBytes.WithLabelValues("out").Add(float64(n))
 		errCh <- err
 	}()
 
 	// Copy from the client stream to the namespace port connection
 	go func() {
 		klog.V(5).Infof("copy data from client to container port %d", port)
-		_, err := io.Copy(conn, stream)
+		n, err := io.Copy(conn, stream)
+		metrics.PortForwardBytes.WithLabelValues("in").Add(float64(n))
 		errCh <- err
 	}()
 
@@ -0,0 +1,287 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	exportBatchSize     = 256
+	exportQueueSize     = 2048
+	exportFlushInterval = 5 * time.Second
+	exportTimeout       = 10 * time.Second
+
+	// Failed exports are retried with exponential backoff, as the OTLP
+	// specification asks, for at most exportRetryElapsed.
+	exportRetryInitial = 1 * time.Second
+	exportRetryMax     = 30 * time.Second
+	exportRetryElapsed = 60 * time.Second
+
+	otlpSpanKindServer = 2
+	otlpStatusOK       = 1
+	otlpStatusError    = 2
+)
+
+// Exporter sends finished spans in batches to an OTLP/HTTP collector, using
+// the JSON encoding of the OTLP protocol.
+type Exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	queue       chan *Span
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewExporter creates an exporter for the collector at endpoint, e.g.
+// "http://otel-collector:4318". Spans are posted to <endpoint>/v1/traces.
+func NewExporter(endpoint, serviceName string) (*Exporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: must be an http or https URL", endpoint)
+	}
+	e := &Exporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, exportQueueSize),
+		done:        make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+// Export queues a finished span. Spans are dropped if the queue is full, so
+// a slow collector never blocks CRI requests.
+func (e *Exporter) Export(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		klog.V(4).Infof("tracing queue full, dropping span %s", span.Name)
+	}
+}
+
+// Close flushes queued spans and stops the exporter.
+func (e *Exporter) Close() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *Exporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(exportFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			klog.Warningf("exporting %d spans to %s: %v", len(batch), e.url, err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOTLPAttributes(attrs map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: attrs[k]}})
+	}
+	return result
+}
+
+func (e *Exporter) encode(spans []*Span) ([]byte, error) {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			TraceState:        s.Context.TraceState,
+			Name:              s.Name,
+			Kind:              otlpSpanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        toOTLPAttributes(s.Attributes),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.Parent.IsValid() {
+			o.ParentSpanID = s.Parent.String()
+		}
+		if s.Error != "" {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		otlpSpans = append(otlpSpans, o)
+	}
+	req := otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: toOTLPAttributes(map[string]string{"service.name": e.serviceName}),
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: e.serviceName},
+						Spans: otlpSpans,
+					},
+				},
+			},
+		},
+	}
+	return json.Marshal(req)
+}
+
+// retryableError is an export failure that may succeed later. after is the
+// delay the collector asked for, or zero.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// send exports spans, retrying while the collector is unreachable or asks
+// for it. It gives up early when the exporter is closed.
+func (e *Exporter) send(spans []*Span) error {
+	body, err := e.encode(spans)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(exportRetryElapsed)
+	backoff := exportRetryInitial
+	for {
+		err := e.post(body)
+		retryable, ok := err.(*retryableError)
+		if !ok {
+			return err
+		}
+		delay := backoff
+		if retryable.after > 0 {
+			delay = retryable.after
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return retryable.err
+		}
+		klog.V(4).Infof("exporting spans to %s: %v, retrying in %s", e.url, retryable.err, delay)
+		select {
+		case <-time.After(delay):
+		case <-e.done:
+			return retryable.err
+		}
+		if backoff *= 2; backoff > exportRetryMax {
+			backoff = exportRetryMax
+		}
+	}
+}
+
+func (e *Exporter) post(body []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	err = fmt.Errorf("collector returned %s", resp.Status)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		after := time.Duration(0)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			after = time.Duration(seconds) * time.Second
+		}
+		return &retryableError{err: err, after: after}
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// TraceparentHeader is the W3C trace context header, as propagated in
+	// gRPC metadata.
+	TraceparentHeader = "traceparent"
+	// TracestateHeader carries vendor specific trace state along with
+	// traceparent.
+	TracestateHeader = "tracestate"
+	// BaggageHeader is the W3C baggage header, key/value pairs propagated
+	// along the trace.
+	BaggageHeader = "baggage"
+
+	maxTracestateMembers = 32
+	maxBaggageMembers    = 180
+	maxBaggageSize       = 8192
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext identifies a span within a trace, and carries the state that
+// is propagated along with it.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+	Baggage    string
+}
+
+// ParseTraceparent parses a W3C traceparent header value, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(value string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	if len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("invalid traceparent version %q", parts[0])
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid trace ID in traceparent %q", value)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid span ID in traceparent %q", value)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("invalid flags in traceparent %q", value)
+	}
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+	return sc, nil
+}
+
+// ParseTracestate checks a W3C tracestate header value, and returns it with
+// empty list members removed.
+func ParseTracestate(value string) (string, error) {
+	members := make([]string, 0)
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		i := strings.Index(member, "=")
+		if i <= 0 || i > 256 || len(member)-i-1 > 256 || strings.ContainsAny(member, " \t") {
+			return "", fmt.Errorf("invalid tracestate member %q", member)
+		}
+		members = append(members, member)
+	}
+	if len(members) > maxTracestateMembers {
+		return "", fmt.Errorf("tracestate has more than %d members", maxTracestateMembers)
+	}
+	return strings.Join(members, ","), nil
+}
+
+// ParseBaggage checks a W3C baggage header value, and returns it with empty
+// list members removed.
+func ParseBaggage(value string) (string, error) {
+	if len(value) > maxBaggageSize {
+		return "", fmt.Errorf("baggage is larger than %d bytes", maxBaggageSize)
+	}
+	members := make([]string, 0)
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		pair := member
+		if i := strings.Index(pair, ";"); i >= 0 {
+			pair = pair[:i]
+		}
+		if i := strings.Index(pair, "="); i <= 0 || strings.TrimSpace(pair[:i]) == "" {
+			return "", fmt.Errorf("invalid baggage member %q", member)
+		}
+		members = append(members, member)
+	}
+	if len(members) > maxBaggageMembers {
+		return "", fmt.Errorf("baggage has more than %d members", maxBaggageMembers)
+	}
+	return strings.Join(members, ","), nil
+}
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Span is a single timed operation, e.g. one CRI request.
+type Span struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// StartSpan starts a new span. If parent is valid, the new span joins its
+// trace, otherwise a new trace is started.
+func StartSpan(name string, parent SpanContext) *Span {
+	span := &Span{
+		Name:  name,
+		Start: time.Now(),
+	}
+	if parent.TraceID.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Context.TraceState = parent.TraceState
+		span.Parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	_, _ = rand.Read(span.Context.SpanID[:])
+	span.Context.Baggage = parent.Baggage
+	return span
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns the span stored in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Inject sets the trace context headers of the span in ctx on header, so the
+// trace continues in the service a request is sent to.
+func Inject(ctx context.Context, header http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	header.Set(TraceparentHeader, span.Context.Traceparent())
+	if span.Context.TraceState != "" {
+		header.Set(TracestateHeader, span.Context.TraceState)
+	}
+	if span.Context.Baggage != "" {
+		header.Set(BaggageHeader, span.Context.Baggage)
+	}
+}
@@ -0,0 +1,215 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		value   string
+		sampled bool
+		fail    bool
+	}{
+		{
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			sampled: true,
+		},
+		{
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			sampled: false,
+		},
+		{
+			value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			fail:  true,
+		},
+		{
+			value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			fail:  true,
+		},
+		{
+			value: "00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+			fail:  true,
+		},
+		{
+			value: "garbage",
+			fail:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			sc, err := ParseTraceparent(tc.value)
+			if tc.fail {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.sampled, sc.Sampled)
+			assert.Equal(t, tc.value, sc.Traceparent())
+		})
+	}
+}
+
+func TestStartSpanJoinsParentTrace(t *testing.T) {
+	parent, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+
+	span := StartSpan("child", parent)
+	assert.Equal(t, parent.TraceID, span.Context.TraceID)
+	assert.Equal(t, parent.SpanID, span.Parent)
+	assert.NotEqual(t, parent.SpanID, span.Context.SpanID)
+
+	root := StartSpan("root", SpanContext{})
+	assert.True(t, root.Context.TraceID.IsValid())
+	assert.False(t, root.Parent.IsValid())
+}
+
+func TestExporterPostsSpans(t *testing.T) {
+	received := make(chan otlpTraceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		req := otlpTraceRequest{}
+		assert.NoError(t, json.Unmarshal(body, &req))
+		received <- req
+	}))
+	defer collector.Close()
+
+	exporter, err := NewExporter(collector.URL, "procri")
+	require.NoError(t, err)
+
+	span := StartSpan("runtime.v1alpha2.RuntimeService/Version", SpanContext{})
+	span.SetAttribute("rpc.system", "grpc")
+	span.End = span.Start
+	exporter.Export(span)
+	exporter.Close()
+
+	req := <-received
+	require.Len(t, req.ResourceSpans, 1)
+	require.Len(t, req.ResourceSpans[0].ScopeSpans, 1)
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, span.Context.TraceID.String(), spans[0].TraceID)
+	assert.Equal(t, "runtime.v1alpha2.RuntimeService/Version", spans[0].Name)
+	assert.Equal(t, otlpStatusOK, spans[0].Status.Code)
+}
+
+// collectorPayload is an ExportTraceServiceRequest in the JSON encoding of
+// OTLP/HTTP, laid out like the trace example of opentelemetry-proto and with
+// the field names of its JSON mapping of trace.proto.
+const collectorPayload = `{
+  "resourceSpans": [
+    {
+      "resource": {
+        "attributes": [
+          {"key": "service.name", "value": {"stringValue": "procri"}}
+        ]
+      },
+      "scopeSpans": [
+        {
+          "scope": {"name": "procri"},
+          "spans": [
+            {
+              "traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+              "spanId": "eee19b7ec3c1b174",
+              "traceState": "congo=t61rcWkgMzE",
+              "parentSpanId": "00f067aa0ba902b7",
+              "name": "runtime.v1alpha2.RuntimeService/StartContainer",
+              "kind": 2,
+              "startTimeUnixNano": "1544712660000000000",
+              "endTimeUnixNano": "1544712661000000000",
+              "attributes": [
+                {"key": "rpc.system", "value": {"stringValue": "grpc"}}
+              ],
+              "status": {"code": 2, "message": "container not found"}
+            }
+          ]
+        }
+      ]
+    }
+  ]
+}`
+
+func TestEncodeMatchesCollectorPayload(t *testing.T) {
+	parent, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	parent.TraceState = "congo=t61rcWkgMzE"
+	span := StartSpan("runtime.v1alpha2.RuntimeService/StartContainer", parent)
+	span.Context.SpanID = SpanID{0xee, 0xe1, 0x9b, 0x7e, 0xc3, 0xc1, 0xb1, 0x74}
+	span.Start = time.Unix(1544712660, 0)
+	span.End = time.Unix(1544712661, 0)
+	span.SetAttribute("rpc.system", "grpc")
+	span.Error = "container not found"
+
+	body, err := (&Exporter{serviceName: "procri"}).encode([]*Span{span})
+	require.NoError(t, err)
+	assert.JSONEq(t, collectorPayload, string(body))
+}
+
+func TestInjectPropagatesTraceContext(t *testing.T) {
+	parent := SpanContext{
+		TraceID:    TraceID{1},
+		SpanID:     SpanID{2},
+		Sampled:    true,
+		TraceState: "vendor=value",
+		Baggage:    "tenant=a",
+	}
+	span := StartSpan("pull", parent)
+	header := http.Header{}
+	Inject(ContextWithSpan(context.Background(), span), header)
+	assert.Equal(t, span.Context.Traceparent(), header.Get(TraceparentHeader))
+	assert.Equal(t, "vendor=value", header.Get(TracestateHeader))
+	assert.Equal(t, "tenant=a", header.Get(BaggageHeader))
+
+	header = http.Header{}
+	Inject(context.Background(), header)
+	assert.Empty(t, header)
+}
+
+func TestParseTracestateAndBaggage(t *testing.T) {
+	state, err := ParseTracestate("rojo=00f067aa0ba902b7, ,congo=t61rcWkgMzE")
+	assert.NoError(t, err)
+	assert.Equal(t, "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE", state)
+	_, err = ParseTracestate("novalue")
+	assert.Error(t, err)
+
+	baggage, err := ParseBaggage("userId=alice, serverNode=DF%2028;prop")
+	assert.NoError(t, err)
+	assert.Equal(t, "userId=alice,serverNode=DF%2028;prop", baggage)
+	_, err = ParseBaggage("=value")
+	assert.Error(t, err)
+}
+
+func TestExporterRetries(t *testing.T) {
+	attempts := 0
+	received := make(chan struct{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- struct{}{}
+	}))
+	defer collector.Close()
+
+	exporter, err := NewExporter(collector.URL, "procri")
+	require.NoError(t, err)
+	defer exporter.Close()
+	span := StartSpan("runtime.v1alpha2.RuntimeService/Version", SpanContext{})
+	span.End = span.Start
+	require.NoError(t, exporter.send([]*Span{span}))
+	<-received
+	assert.Equal(t, 2, attempts)
+}